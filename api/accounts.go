@@ -0,0 +1,232 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+	"gorm.io/gorm"
+)
+
+// ListAccounts Get a list of all accounts
+// @Summary Get all local ESXi users that postconfig creates
+// @Tags accounts
+// @Accept  json
+// @Produce  json
+// @Param group_id query int false "Only the accounts of the group"
+// @Success 200 {array} models.Account
+// @Failure 500 {object} models.APIError
+// @Router /accounts [get]
+func ListAccounts(c *gin.Context) {
+	query := db.DB.Order("group_id").Order("username")
+	if v := c.Query("group_id"); v != "" {
+		query = query.Where("group_id = ?", v)
+	}
+
+	var items []models.Account
+	if res := query.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	for i := range items {
+		items[i].Password = ""
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetAccount Get an existing account
+// @Summary Get an existing account
+// @Tags accounts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Account ID"
+// @Success 200 {object} models.Account
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /accounts/{id} [get]
+func GetAccount(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Account
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	item.Password = ""
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CreateAccount Create a new account
+// @Summary Create a new local ESXi user on the hosts of a group
+// @Tags accounts
+// @Accept  json
+// @Produce  json
+// @Param item body models.AccountForm true "Add an account"
+// @Success 200 {object} models.Account
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /accounts [post]
+func CreateAccount(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var form models.AccountForm
+
+		if err := c.ShouldBind(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		if res := db.DB.First(&models.Group{}, form.GroupID); res.Error != nil {
+			Error(c, http.StatusBadRequest, fmt.Errorf("the group of the account could not be found")) // 400
+			return
+		}
+
+		item := models.Account{AccountForm: form}
+
+		// the password is optional, a user without one can only log in with its ssh keys
+		if form.Password != "" {
+			if err := verifyPassword(form.Password); err != nil {
+				Error(c, http.StatusBadRequest, err) // 400
+				return
+			}
+			password, err := secrets.Encrypt(form.Password, key)
+			if err != nil {
+				Error(c, http.StatusInternalServerError, err) // 500
+				return
+			}
+			item.Password = password
+		}
+
+		if res := db.DB.Create(&item); res.Error != nil {
+			Error(c, http.StatusBadRequest, res.Error) // 400
+			return
+		}
+
+		item.Password = ""
+		c.JSON(http.StatusOK, item) // 200
+	}
+}
+
+// UpdateAccount Update an existing account
+// @Summary Update an existing account, the password is kept when none is given
+// @Tags accounts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Account ID"
+// @Param  item body models.AccountForm true "Update an account"
+// @Success 200 {object} models.Account
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /accounts/{id} [patch]
+func UpdateAccount(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// Load the form data
+		var form models.AccountForm
+		if err := c.ShouldBind(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		if res := db.DB.First(&models.Group{}, form.GroupID); res.Error != nil {
+			Error(c, http.StatusBadRequest, fmt.Errorf("the group of the account could not be found")) // 400
+			return
+		}
+
+		// Load the item
+		var item models.Account
+		if res := db.DB.First(&item, id); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+			} else {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+			}
+			return
+		}
+
+		// replace the whole account, so keys and the lockdown exception can be removed, but keep the password
+		password := item.Password
+		item.AccountForm = form
+		item.Password = password
+
+		if form.Password != "" {
+			if err := verifyPassword(form.Password); err != nil {
+				Error(c, http.StatusBadRequest, err) // 400
+				return
+			}
+			item.Password, err = secrets.Encrypt(form.Password, key)
+			if err != nil {
+				Error(c, http.StatusInternalServerError, err) // 500
+				return
+			}
+		}
+
+		// Save it
+		if res := db.DB.Save(&item); res.Error != nil {
+			Error(c, http.StatusBadRequest, res.Error) // 400
+			return
+		}
+
+		item.Password = ""
+		c.JSON(http.StatusOK, item) // 200
+	}
+}
+
+// DeleteAccount Remove an existing account
+// @Summary Remove an existing account, it's not removed from hosts that are already installed
+// @Tags accounts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Account ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /accounts/{id} [delete]
+func DeleteAccount(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Account
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// Delete it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
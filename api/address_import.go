@@ -0,0 +1,272 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"gorm.io/gorm"
+)
+
+// errRollback is returned from a transaction to discard it without an error
+var errRollback = errors.New("rollback")
+
+// ImportAddresses Import hosts from csv or yaml
+// @Summary Import hosts from csv or yaml, every row is validated and all hosts are added in a single transaction
+// @Tags addresses
+// @Accept  plain
+// @Produce  json
+// @Param  format query string false "csv or yaml, detected from the content type by default"
+// @Param  dry_run query bool false "Only validate the rows"
+// @Param  item body string true "Hosts with the columns hostname, mac, ip, group and domain, the ip and hostname are assigned when empty"
+// @Success 200 {object} models.AddressImportResult
+// @Failure 400 {object} models.AddressImportResult
+// @Failure 500 {object} models.APIError
+// @Router /addresses/import [post]
+func ImportAddresses(c *gin.Context) {
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	var rows []models.AddressImportRow
+	switch importFormat(c) {
+	case "csv":
+		rows, err = decodeAddressCSV(body)
+	case "yaml":
+		err = yaml.UnmarshalStrict(body, &rows)
+	default:
+		err = fmt.Errorf("unsupported format, use csv or yaml")
+	}
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	result := models.AddressImportResult{DryRun: dryRun, Rows: len(rows), Errors: []models.AddressImportError{}}
+
+	// addresses reserved for rows without an ip may not be handed out by the dhcp server before they are committed
+	models.AllocationMu.Lock()
+	defer models.AllocationMu.Unlock()
+
+	// all rows are added in one transaction to report the errors of every row, and only committed if all succeed
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		groups := make(map[string]models.Group)
+		user := CurrentUser(c)
+
+		for i, row := range rows {
+			item, err := importAddress(tx, row, groups)
+			if err == nil && !user.InScope(item.GroupID) {
+				err = fmt.Errorf("the user may only manage hosts of group %d", user.GroupID.Int32)
+			}
+			if err == nil {
+				err = tx.Create(&item).Error
+			}
+			if err != nil {
+				// rows are numbered from 1, not counting the header of a csv
+				result.Errors = append(result.Errors, models.AddressImportError{Row: i + 1, Error: err.Error()})
+				continue
+			}
+			result.Imported++
+		}
+
+		if len(result.Errors) > 0 || dryRun {
+			return errRollback
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errRollback) {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	if len(result.Errors) > 0 {
+		result.Imported = 0
+		c.JSON(http.StatusBadRequest, result) // 400
+		return
+	}
+	if dryRun {
+		result.Imported = 0
+	}
+
+	c.JSON(http.StatusOK, result) // 200
+
+	logrus.WithFields(logrus.Fields{
+		"rows":    result.Rows,
+		"dry run": dryRun,
+	}).Info("import")
+}
+
+// ExportAddresses Export hosts as csv or yaml
+// @Summary Export the registered hosts the user may manage in the format used by the import, dynamic leases are not included
+// @Tags addresses
+// @Produce  plain
+// @Param  format query string false "csv or yaml, defaults to csv"
+// @Success 200 {string} string
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /addresses/export [get]
+func ExportAddresses(c *gin.Context) {
+	// only hosts registered to a group can be imported again, leases of the dhcp server have no group
+	query := db.DB.Preload("Group").Where("group_id IS NOT NULL")
+	if scope := CurrentUser(c).Scope(); scope.Valid {
+		query = query.Where("group_id = ?", scope.Int32)
+	}
+
+	var items []models.Address
+	if res := query.Order("id").Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	rows := make([]models.AddressImportRow, 0, len(items))
+	for _, v := range items {
+		rows = append(rows, models.AddressImportRow{
+			Hostname: v.Hostname,
+			Mac:      v.Mac,
+			IP:       v.IP,
+			Group:    v.Group.Name,
+			Domain:   v.Domain,
+		})
+	}
+
+	format := c.DefaultQuery("format", "csv")
+	switch format {
+	case "csv":
+		c.Header("Content-Disposition", "attachment; filename=hosts.csv")
+		c.Header("Content-Type", "text/csv")
+		c.Status(http.StatusOK)
+		if err := encodeAddressCSV(c.Writer, rows); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"err": err,
+			}).Error("export")
+		}
+	case "yaml":
+		out, err := yaml.Marshal(rows)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=hosts.yaml")
+		c.Data(http.StatusOK, "application/x-yaml", out)
+	default:
+		Error(c, http.StatusBadRequest, fmt.Errorf("unsupported format %s, use csv or yaml", format)) // 400
+	}
+}
+
+// importFormat returns the format of an import from the query, or the content type
+func importFormat(c *gin.Context) string {
+	if format := c.Query("format"); format != "" {
+		return format
+	}
+
+	switch contentType := c.ContentType(); {
+	case strings.Contains(contentType, "csv"):
+		return "csv"
+	case strings.Contains(contentType, "yaml"):
+		return "yaml"
+	}
+	return ""
+}
+
+// importAddress validates a row the same way as a new address, groups are cached by name
+func importAddress(tx *gorm.DB, row models.AddressImportRow, groups map[string]models.Group) (models.Address, error) {
+	group, ok := groups[row.Group]
+	if !ok {
+		if res := tx.Where("name = ?", row.Group).First(&group); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				return models.Address{}, fmt.Errorf("group %q does not exist", row.Group)
+			}
+			return models.Address{}, res.Error
+		}
+		groups[row.Group] = group
+	}
+
+	item := models.Address{AddressForm: models.AddressForm{
+		Hostname: row.Hostname,
+		Mac:      row.Mac,
+		IP:       row.IP,
+		Domain:   row.Domain,
+	}}
+	item.PoolID.Int32, item.PoolID.Valid = int32(group.PoolID), true
+	item.GroupID.Int32, item.GroupID.Valid = int32(group.ID), true
+
+	err := validateAddress(tx, &item)
+	return item, err
+}
+
+// decodeAddressCSV reads hosts from a csv with a header, the columns can be in any order
+func decodeAddressCSV(body []byte) ([]models.AddressImportRow, error) {
+	r := csv.NewReader(strings.NewReader(string(body)))
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the csv header: %w", err)
+	}
+
+	columns := make(map[string]int)
+	for i, v := range header {
+		columns[strings.ToLower(strings.TrimSpace(v))] = i
+	}
+	for _, v := range []string{"mac", "group"} {
+		if _, ok := columns[v]; !ok {
+			return nil, fmt.Errorf("the csv is missing the %s column", v)
+		}
+	}
+
+	value := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var rows []models.AddressImportRow
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, models.AddressImportRow{
+			Hostname: value(record, "hostname"),
+			Mac:      value(record, "mac"),
+			IP:       value(record, "ip"),
+			Group:    value(record, "group"),
+			Domain:   value(record, "domain"),
+		})
+	}
+
+	return rows, nil
+}
+
+func encodeAddressCSV(w io.Writer, rows []models.AddressImportRow) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(models.AddressImportColumns); err != nil {
+		return err
+	}
+	for _, v := range rows {
+		if err := cw.Write([]string{v.Hostname, v.Mac, v.IP, v.Group, v.Domain}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+)
+
+func TestExportImportAddresses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, format := range []string{"csv", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			testDB(t, &models.Pool{}, &models.PoolRange{}, &models.Group{}, &models.Address{})
+
+			pool := models.Pool{PoolForm: models.PoolForm{Name: "pool", StartAddress: "10.0.0.10", EndAddress: "10.0.0.250", Netmask: 24, LeaseTime: 3600, Gateway: "10.0.0.1"}, NetAddress: "10.0.0.0"}
+			if res := db.DB.Create(&pool); res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			group := models.Group{GroupForm: models.GroupForm{PoolID: pool.ID, Name: "esx"}}
+			if res := db.DB.Create(&group); res.Error != nil {
+				t.Fatal(res.Error)
+			}
+
+			hosts := []models.Address{
+				{AddressForm: models.AddressForm{Hostname: "esx01", Mac: "00:50:56:00:00:01", IP: "10.0.0.11", Domain: "lab.local"}},
+				{AddressForm: models.AddressForm{Hostname: "esx02", Mac: "00:50:56:00:00:02", IP: "10.0.0.12", Domain: "lab.local"}},
+			}
+			for i := range hosts {
+				hosts[i].PoolID.Int32, hosts[i].PoolID.Valid = int32(pool.ID), true
+				hosts[i].GroupID.Int32, hosts[i].GroupID.Valid = int32(group.ID), true
+				if res := db.DB.Create(&hosts[i]); res.Error != nil {
+					t.Fatal(res.Error)
+				}
+			}
+			// a lease of the dhcp server has no group, and would fail the import
+			lease := models.Address{AddressForm: models.AddressForm{Mac: "00:50:56:00:00:99", IP: "10.0.0.99"}, Expires: time.Now().Add(time.Hour)}
+			lease.PoolID.Int32, lease.PoolID.Valid = int32(pool.ID), true
+			if res := db.DB.Create(&lease); res.Error != nil {
+				t.Fatal(res.Error)
+			}
+
+			r := gin.New()
+			r.GET("/v1/addresses/export", ExportAddresses)
+			r.POST("/v1/addresses/import", ImportAddresses)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/addresses/export?format="+format, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("export: got %d %s", w.Code, w.Body.String())
+			}
+			exported := w.Body.String()
+			if strings.Contains(exported, lease.Mac) {
+				t.Errorf("export: got the lease %s in\n%s", lease.Mac, exported)
+			}
+
+			// import the export into an inventory without the hosts
+			if res := db.DB.Where("group_id IS NOT NULL").Delete(&models.Address{}); res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			w = httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/addresses/import?format="+format, strings.NewReader(exported)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("import: got %d %s", w.Code, w.Body.String())
+			}
+
+			var imported []models.Address
+			if res := db.DB.Where("group_id IS NOT NULL").Order("ip").Find(&imported); res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			if len(imported) != len(hosts) {
+				t.Fatalf("got %d hosts, want %d", len(imported), len(hosts))
+			}
+			for i, want := range hosts {
+				if got := imported[i]; got.Hostname != want.Hostname || got.Mac != want.Mac || got.IP != want.IP || got.Domain != want.Domain || got.GroupID != want.GroupID {
+					t.Errorf("host %d: got %s %s %s %s %v, want %s %s %s %s %v", i, got.Hostname, got.Mac, got.IP, got.Domain, got.GroupID, want.Hostname, want.Mac, want.IP, want.Domain, want.GroupID)
+				}
+			}
+		})
+	}
+}
+
+func TestScopedHosts(t *testing.T) {
+	testDB(t, &models.Pool{}, &models.PoolRange{}, &models.Group{}, &models.Address{})
+	gin.SetMode(gin.TestMode)
+
+	pool := models.Pool{PoolForm: models.PoolForm{Name: "pool", StartAddress: "10.0.0.10", EndAddress: "10.0.0.250", Netmask: 24, LeaseTime: 3600, Gateway: "10.0.0.1"}, NetAddress: "10.0.0.0"}
+	if res := db.DB.Create(&pool); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	var hosts []models.Address
+	for i, name := range []string{"esx", "other"} {
+		group := models.Group{GroupForm: models.GroupForm{PoolID: pool.ID, Name: name}}
+		if res := db.DB.Create(&group); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		host := models.Address{AddressForm: models.AddressForm{Hostname: name + "01", Mac: "00:50:56:00:00:0" + strconv.Itoa(i+1), IP: "10.0.0.1" + strconv.Itoa(i+1)}}
+		host.PoolID.Int32, host.PoolID.Valid = int32(pool.ID), true
+		host.GroupID.Int32, host.GroupID.Valid = int32(group.ID), true
+		if res := db.DB.Create(&host); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		hosts = append(hosts, host)
+	}
+
+	// an operator of the first group
+	operator := models.User{UserForm: models.UserForm{Username: "operator", Role: models.RoleOperator}}
+	operator.GroupID = hosts[0].GroupID
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("user", operator) })
+	r.GET("/v1/addresses/export", ExportAddresses)
+	r.GET("/v1/addresses/:id/ks/preview", PreviewKs)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/addresses/export", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), hosts[0].Hostname) || strings.Contains(w.Body.String(), hosts[1].Hostname) {
+		t.Errorf("export: got %d\n%s\nwant only %s", w.Code, w.Body.String(), hosts[0].Hostname)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/addresses/"+strconv.Itoa(hosts[1].ID)+"/ks/preview", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("preview of a host of another group: got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -1,12 +1,12 @@
 package api
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/imdario/mergo"
@@ -86,10 +86,50 @@ func SearchAddress(c *gin.Context) {
 
 	query := db.DB
 
+	// attributes are matched on their value inherited from the pool and group, after the other fields
+	var attributes map[string]interface{}
+	if filter, ok := form["attributes"]; ok {
+		delete(form, "attributes")
+
+		if attributes, ok = filter.(map[string]interface{}); !ok {
+			Error(c, http.StatusBadRequest, fmt.Errorf("attributes must be an object")) // 400
+			return
+		}
+		if err := validateAttributeFilter(attributes); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+	}
+
 	for k, v := range form {
 		query = query.Where(k, v)
 	}
 
+	if attributes != nil {
+		var items []models.Address
+		if res := query.Preload("Pool").Preload("Group").Find(&items); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		for _, item := range items {
+			ok, err := matchAttributes(item, attributes)
+			if err != nil {
+				Error(c, http.StatusInternalServerError, err) // 500
+				return
+			}
+			if ok {
+				// respond like other searches, which only include the pool
+				item.Group = models.Group{}
+				c.JSON(http.StatusOK, item) // 200
+				return
+			}
+		}
+
+		Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		return
+	}
+
 	// Load the item
 	var item models.Address
 	if res := query.Preload("Pool").First(&item); res.Error != nil {
@@ -109,7 +149,7 @@ func SearchAddress(c *gin.Context) {
 // @Tags addresses
 // @Accept  json
 // @Produce  json
-// @Param item body models.AddressForm true "Add ip address"
+// @Param item body models.AddressForm true "Add ip address, the ip and hostname are assigned from the pool and group when empty"
 // @Success 200 {object} models.Address
 // @Failure 400 {object} models.APIError
 // @Failure 500 {object} models.APIError
@@ -124,46 +164,19 @@ func CreateAddress(c *gin.Context) {
 
 	item := models.Address{AddressForm: form}
 
-	// get the pool network info to verify if this ip should be added to the pool.
-	var na models.Pool
-	db.DB.First(&na, "id = ?", item.AddressForm.PoolID)
+	if !inScope(c, item.GroupID) {
+		return
+	}
 
-	cidr := item.IP + "/" + strconv.Itoa(na.Netmask)
-	network := na.NetAddress + "/" + strconv.Itoa(na.Netmask)
+	// the address reserved by validateAddress may not be handed out by the dhcp server before it is stored
+	models.AllocationMu.Lock()
+	defer models.AllocationMu.Unlock()
 
-	// first check if the address is even in the network.
-	_, neta, _ := net.ParseCIDR(network)
-	ipb, _, _ := net.ParseCIDR(cidr)
-	start := net.ParseIP(na.StartAddress)
-	end := net.ParseIP(na.EndAddress)
-	if neta.Contains(ipb) {
-		//then check if it's in the given range by the pool.
-		trial := net.ParseIP(item.IP)
-
-		if bytes.Compare(trial, start) >= 0 && bytes.Compare(trial, end) <= 0 {
-			logrus.WithFields(logrus.Fields{
-				"ip":    trial,
-				"start": start,
-				"end":   end,
-			}).Debug("ip validation successful")
-		} else {
-			logrus.WithFields(logrus.Fields{
-				"ip":    trial,
-				"start": start,
-				"end":   end,
-			}).Debug("the ip address is not in the scope of the dhcp pool associated with the group")
-			Error(c, http.StatusBadRequest, fmt.Errorf("the ip address is not in the scope of the dhcp pool associated with the group")) // 400
-			return
-		}
-	} else {
-		Error(c, http.StatusBadRequest, fmt.Errorf("the ip address is not in the scope of the dhcp pool associated with the group")) // 400
+	if err := validateAddress(db.DB, &item); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
 		return
 	}
 
-	// ensure the mac address is properly formated.
-	mac, _ := net.ParseMAC(item.Mac)
-	item.Mac = mac.String()
-
 	// if ip address checks pas, continue to commit.
 	if item.ID != 0 { // Save if its an existing item
 		if res := db.DB.Save(&item); res.Error != nil {
@@ -221,6 +234,17 @@ func UpdateAddress(c *gin.Context) {
 		return
 	}
 
+	// reject a custom kickstart that would fail when the host is installed
+	if err := validateKs(form.Ks); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	if err := validateAttributes(form.Attributes); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
 	// Load the item
 	var item models.Address
 	if res := db.DB.First(&item, id); res.Error != nil {
@@ -232,15 +256,38 @@ func UpdateAddress(c *gin.Context) {
 		return
 	}
 
+	// operators can neither change hosts outside their group, nor move hosts out of it
+	if !inScope(c, item.GroupID) {
+		return
+	}
+
 	// Merge the item and the form data
 	if err := mergo.Merge(&item, models.Address{AddressForm: form}, mergo.WithOverride); err != nil {
 		Error(c, http.StatusInternalServerError, err) // 500
 	}
 
+	if !inScope(c, item.GroupID) {
+		return
+	}
+
 	// Mergo doesn't overwrite 0 or false values, force set
 	item.AddressForm.Reimage = form.Reimage
 	item.AddressForm.Progress = form.Progress
 
+	normalizeIdentifiers(&item)
+
+	// a template id of 0 removes the template, and the version is always set together with the template
+	if form.TemplateID.Valid {
+		item.AddressForm.TemplateVersion = form.TemplateVersion
+		if form.TemplateID.Int32 == 0 {
+			item.AddressForm.TemplateID = models.NullInt32{}
+		}
+	}
+	if err := validateTemplateID(db.DB, item.TemplateID); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
 	// Save it
 	if res := db.DB.Save(&item); res.Error != nil {
 		Error(c, http.StatusInternalServerError, res.Error) // 500
@@ -284,6 +331,10 @@ func DeleteAddress(c *gin.Context) {
 		return
 	}
 
+	if !inScope(c, item.GroupID) {
+		return
+	}
+
 	// delete it
 	if res := db.DB.Delete(&item); res.Error != nil {
 		Error(c, http.StatusInternalServerError, res.Error) // 500
@@ -292,3 +343,144 @@ func DeleteAddress(c *gin.Context) {
 
 	c.JSON(http.StatusNoContent, gin.H{}) //204
 }
+
+// validateAddress checks that a new address is within the scope of its pool and that its kickstart and attributes are valid.
+// The mac address is normalized, a template id of 0 is removed, and the ip and hostname are assigned when they are empty.
+func validateAddress(tx *gorm.DB, item *models.Address) error {
+	// a template id of 0 means the address has no template
+	if item.TemplateID.Valid && item.TemplateID.Int32 == 0 {
+		item.TemplateID = models.NullInt32{}
+	}
+	if err := validateTemplateID(tx, item.TemplateID); err != nil {
+		return err
+	}
+
+	// reject a custom kickstart that would fail when the host is installed
+	if err := validateKs(item.Ks); err != nil {
+		return err
+	}
+
+	if err := validateAttributes(item.Attributes); err != nil {
+		return err
+	}
+
+	// the group is optional, but its pool is used when the address has none
+	var group models.Group
+	if item.GroupID.Valid {
+		if res := tx.First(&group, item.GroupID.Int32); res.Error != nil {
+			return fmt.Errorf("the group of the address could not be found")
+		}
+		if !item.PoolID.Valid {
+			item.PoolID.Int32, item.PoolID.Valid = int32(group.PoolID), true
+		}
+	}
+
+	// get the pool network info to verify if this ip should be added to the pool.
+	var na models.PoolWithAddresses
+	if res := tx.Table("pools").Preload("Ranges").First(&na, "id = ?", item.AddressForm.PoolID); res.Error != nil {
+		return fmt.Errorf("the pool of the address could not be found")
+	}
+
+	// reserve the next free address of the pool when no ip was given
+	if item.IP == "" {
+		ip, err := na.NextUnassigned(tx)
+		if err != nil {
+			return fmt.Errorf("no ip address was given and %w", err)
+		}
+		item.IP = ip.String()
+	}
+
+	if item.Hostname == "" && group.HostnamePattern != "" {
+		item.Pool = na.Pool
+		item.Group = group
+		hostname, err := generateHostname(tx, *item, group.HostnamePattern)
+		item.Pool, item.Group = models.Pool{}, models.Group{}
+		if err != nil {
+			return err
+		}
+		item.Hostname = hostname
+	}
+
+	cidr := item.IP + "/" + strconv.Itoa(na.Netmask)
+	network := na.NetAddress + "/" + strconv.Itoa(na.Netmask)
+
+	// first check if the address is even in the network.
+	_, neta, _ := net.ParseCIDR(network)
+	ipb, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("the ip address %q is not valid", item.IP)
+	}
+	start := net.ParseIP(na.StartAddress)
+	end := net.ParseIP(na.EndAddress)
+	if !neta.Contains(ipb) {
+		return fmt.Errorf("the ip address is not in the scope of the dhcp pool associated with the group")
+	}
+
+	//then check if it's in one of the ranges given by the pool.
+	trial := net.ParseIP(item.IP)
+	if !na.InRange(trial) {
+		logrus.WithFields(logrus.Fields{
+			"ip":    trial,
+			"start": start,
+			"end":   end,
+		}).Debug("the ip address is not in the scope of the dhcp pool associated with the group")
+		return fmt.Errorf("the ip address is not in the scope of the dhcp pool associated with the group")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"ip":    trial,
+		"start": start,
+		"end":   end,
+	}).Debug("ip validation successful")
+
+	// ensure the mac address is properly formated.
+	mac, err := net.ParseMAC(item.Mac)
+	if err != nil {
+		return fmt.Errorf("the mac address %q is not valid", item.Mac)
+	}
+	item.Mac = mac.String()
+
+	normalizeIdentifiers(item)
+
+	return nil
+}
+
+// normalizeIdentifiers formats the alternative identifiers of an address like the dhcp server does
+func normalizeIdentifiers(item *models.Address) {
+	item.ClientID = strings.ToLower(strings.TrimSpace(item.ClientID))
+	item.UUID = strings.ToLower(strings.TrimSpace(item.UUID))
+	item.Serial = strings.TrimSpace(item.Serial)
+}
+
+// generateHostname returns the first hostname generated by the pattern of the group that is not used by another host,
+// the sequence starts at 1
+func generateHostname(tx *gorm.DB, item models.Address, pattern string) (string, error) {
+	attributes, err := item.EffectiveAttributes()
+	if err != nil {
+		return "", err
+	}
+
+	var hostnames []string
+	if res := tx.Model(&models.Address{}).Where("hostname <> ''").Pluck("hostname", &hostnames); res.Error != nil {
+		return "", res.Error
+	}
+	used := make(map[string]bool, len(hostnames))
+	for _, v := range hostnames {
+		used[strings.ToLower(v)] = true
+	}
+
+	for seq := 1; seq <= len(hostnames)+1; seq++ {
+		hostname, err := models.ExpandHostname(pattern, attributes, seq)
+		if err != nil {
+			return "", err
+		}
+		if !used[strings.ToLower(hostname)] {
+			return hostname, nil
+		}
+		if !models.UsesSequence(pattern) {
+			return "", fmt.Errorf("the hostname %s generated by the pattern of the group is already used", hostname)
+		}
+	}
+
+	return "", fmt.Errorf("could not generate a free hostname with the pattern %s", pattern)
+}
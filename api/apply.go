@@ -0,0 +1,725 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// Apply Reconcile pools, groups, hosts, options and device classes with a declarative site
+// @Summary Reconcile the database with a site in yaml or json, everything is applied in a single transaction
+// @Tags apply
+// @Accept  plain
+// @Produce  json
+// @Param  plan query bool false "Only return the changes that would be made"
+// @Param  prune query bool false "Delete what is not in the site"
+// @Param  item body models.Site true "The site"
+// @Success 200 {object} models.ApplyResult
+// @Failure 400 {object} models.APIError
+// @Router /apply [post]
+func Apply(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		plan, _ := strconv.ParseBool(c.Query("plan"))
+		prune, _ := strconv.ParseBool(c.Query("prune"))
+
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		site, err := DecodeSite(body)
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		result, err := ApplySite(site, key, plan, prune, auditActor(c))
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		c.JSON(http.StatusOK, result) // 200
+	}
+}
+
+// DecodeSite decodes a site from yaml or json, unknown fields are rejected to catch typos
+func DecodeSite(body []byte) (models.Site, error) {
+	var site models.Site
+
+	// yaml is converted to json to reuse the json names and types of the models
+	var v interface{}
+	if err := yaml.Unmarshal(body, &v); err != nil {
+		return site, err
+	}
+	j, err := json.Marshal(yamlToJSON(v))
+	if err != nil {
+		return site, err
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(j)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&site); err != nil {
+		return site, err
+	}
+
+	return site, nil
+}
+
+// yamlToJSON converts the maps decoded by yaml to maps that can be encoded as json
+func yamlToJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			m[fmt.Sprint(k)] = yamlToJSON(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = yamlToJSON(value)
+		}
+	}
+	return v
+}
+
+// ApplySite reconciles the database with a site. Everything is changed in one transaction, which is rolled back
+// when only planning, so that a plan is validated exactly like an apply. The applied changes are recorded in the audit
+// log as made by the actor of the entry.
+func ApplySite(site models.Site, key string, plan bool, prune bool, actor models.AuditEntry) (models.ApplyResult, error) {
+	result := models.ApplyResult{Plan: plan, Prune: prune}
+
+	// addresses are allocated for hosts without an ip, and the dhcp server may not hand them out before the commit
+	models.AllocationMu.Lock()
+	defer models.AllocationMu.Unlock()
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		a := siteApplier{tx: tx, key: key}
+		if err := a.load(); err != nil {
+			return err
+		}
+
+		steps := []func(models.Site) error{a.applyDeviceClasses, a.applyPools, a.applyGroups, a.applyAddresses, a.applyOptions}
+		if prune {
+			steps = append(steps, a.applyPrune)
+		}
+		for _, step := range steps {
+			if err := step(site); err != nil {
+				return err
+			}
+		}
+
+		result.Changes = a.changes
+		if plan {
+			// the items created by a plan are rolled back
+			for i := range result.Changes {
+				if result.Changes[i].Action == "create" {
+					result.Changes[i].ID = 0
+				}
+			}
+			return errRollback
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errRollback) {
+		return result, err
+	}
+
+	if !plan {
+		logrus.WithFields(logrus.Fields{
+			"changes": len(result.Changes),
+			"prune":   prune,
+		}).Info("apply")
+		auditApply(actor, result.Changes)
+	}
+
+	return result, nil
+}
+
+// siteApplier keeps the existing items by their identifier while reconciling a site
+type siteApplier struct {
+	tx      *gorm.DB
+	key     string
+	changes []models.ApplyChange
+
+	classes map[string]models.DeviceClass
+	pools   map[string]models.Pool
+	groups  map[string]models.Group
+	// addresses are the registered hosts by ip and mac, a host being re-imaged shares its ip with the installed host
+	addresses map[string]models.Address
+
+	// identifiers of everything in the site, the rest is deleted when pruning
+	keep map[string]map[string]bool
+}
+
+func (a *siteApplier) load() error {
+	a.keep = map[string]map[string]bool{"device class": {}, "pool": {}, "group": {}, "address": {}, "option": {}}
+
+	var classes []models.DeviceClass
+	var pools []models.Pool
+	var groups []models.Group
+	var addresses []models.Address
+	for _, v := range []interface{}{&classes, &pools, &groups} {
+		if res := a.tx.Find(v); res.Error != nil {
+			return res.Error
+		}
+	}
+
+	// dynamic leases and declined addresses have no group, they are not part of a site and never pruned
+	if res := a.tx.Where("group_id IS NOT NULL").Find(&addresses); res.Error != nil {
+		return res.Error
+	}
+
+	a.classes = make(map[string]models.DeviceClass)
+	for _, v := range classes {
+		if _, ok := a.classes[v.Name]; ok {
+			return fmt.Errorf("more than one device class is named %s, names must be unique to apply a site", v.Name)
+		}
+		a.classes[v.Name] = v
+	}
+	a.pools = make(map[string]models.Pool)
+	for _, v := range pools {
+		if _, ok := a.pools[v.Name]; ok {
+			return fmt.Errorf("more than one pool is named %s, names must be unique to apply a site", v.Name)
+		}
+		a.pools[v.Name] = v
+	}
+	a.groups = make(map[string]models.Group)
+	for _, v := range groups {
+		if _, ok := a.groups[v.Name]; ok {
+			return fmt.Errorf("more than one group is named %s, names must be unique to apply a site", v.Name)
+		}
+		a.groups[v.Name] = v
+	}
+	a.addresses = make(map[string]models.Address)
+	for _, v := range addresses {
+		a.addresses[hostKey(v.IP, v.Mac)] = v
+	}
+
+	return nil
+}
+
+// hostKey identifies a registered host by its ip and mac address
+func hostKey(ip string, mac string) string {
+	if hw, err := net.ParseMAC(mac); err == nil {
+		mac = hw.String()
+	}
+	return ip + " " + mac
+}
+
+// addressByMac returns the key of the registered host with the mac, for a host of the site without an ip. A new host
+// gets a key of its own that can't be taken by a registered host.
+func (a *siteApplier) addressByMac(mac string) (string, error) {
+	var keys []string
+	for key, v := range a.addresses {
+		if hostKey("", v.Mac) == hostKey("", mac) {
+			keys = append(keys, key)
+		}
+	}
+	switch len(keys) {
+	case 0:
+		return hostKey("", mac), nil
+	case 1:
+		return keys[0], nil
+	}
+	sort.Strings(keys)
+	return "", fmt.Errorf("the mac is registered to more than one host (%s), set the ip of the host", strings.Join(keys, ", "))
+}
+
+// address returns the registered host with the ip, preferring the one in the site
+func (a *siteApplier) address(ip string) (models.Address, bool) {
+	var found models.Address
+	var ok bool
+	for key, v := range a.addresses {
+		if v.IP != ip {
+			continue
+		}
+		if a.keep["address"][key] {
+			return v, true
+		}
+		found, ok = v, true
+	}
+	return found, ok
+}
+
+// mark records that an item is in the site, and fails on duplicates
+func (a *siteApplier) mark(kind string, name string) error {
+	if a.keep[kind][name] {
+		return fmt.Errorf("%s %s is in the site more than once", kind, name)
+	}
+	a.keep[kind][name] = true
+	return nil
+}
+
+func (a *siteApplier) change(action string, kind string, id int, name string, diff []string) {
+	a.changes = append(a.changes, models.ApplyChange{Action: action, Kind: kind, ID: id, Name: name, Diff: diff})
+}
+
+func (a *siteApplier) applyDeviceClasses(site models.Site) error {
+	for _, v := range site.DeviceClasses {
+		if err := a.mark("device class", v.Name); err != nil {
+			return err
+		}
+
+		item, ok := a.classes[v.Name]
+		if !ok {
+			item = models.DeviceClass{DeviceClassForm: v}
+			if res := a.tx.Create(&item); res.Error != nil {
+				return fmt.Errorf("device class %s: %w", v.Name, res.Error)
+			}
+			a.classes[v.Name] = item
+			a.change("create", "device class", item.ID, v.Name, nil)
+			continue
+		}
+
+		if diff := diffFields(item.DeviceClassForm, v); len(diff) > 0 {
+			item.DeviceClassForm = v
+			if res := a.tx.Save(&item); res.Error != nil {
+				return fmt.Errorf("device class %s: %w", v.Name, res.Error)
+			}
+			a.classes[v.Name] = item
+			a.change("update", "device class", item.ID, v.Name, diff)
+		}
+	}
+	return nil
+}
+
+func (a *siteApplier) applyPools(site models.Site) error {
+	for _, v := range site.Pools {
+		if err := a.mark("pool", v.Name); err != nil {
+			return err
+		}
+		if err := validateAttributes(v.Attributes); err != nil {
+			return fmt.Errorf("pool %s: %w", v.Name, err)
+		}
+
+		item, ok := a.pools[v.Name]
+		if !ok {
+			item = models.Pool{PoolForm: v}
+			if res := a.tx.Create(&item); res.Error != nil {
+				return fmt.Errorf("pool %s: %w", v.Name, res.Error)
+			}
+			a.pools[v.Name] = item
+			a.change("create", "pool", item.ID, v.Name, nil)
+			continue
+		}
+
+		if diff := diffFields(item.PoolForm, v); len(diff) > 0 {
+			item.PoolForm = v
+			if res := a.tx.Save(&item); res.Error != nil {
+				return fmt.Errorf("pool %s: %w", v.Name, res.Error)
+			}
+			a.pools[v.Name] = item
+			a.change("update", "pool", item.ID, v.Name, diff)
+		}
+	}
+	return nil
+}
+
+func (a *siteApplier) applyGroups(site models.Site) error {
+	for _, v := range site.Groups {
+		if err := a.mark("group", v.Name); err != nil {
+			return err
+		}
+
+		form, err := a.groupForm(v)
+		if err != nil {
+			return fmt.Errorf("group %s: %w", v.Name, err)
+		}
+
+		item, ok := a.groups[v.Name]
+		if !ok {
+			if form.Password == "" {
+				return fmt.Errorf("group %s: a password is required", v.Name)
+			}
+			item = models.Group{GroupForm: form}
+			if res := a.tx.Create(&item); res.Error != nil {
+				return fmt.Errorf("group %s: %w", v.Name, res.Error)
+			}
+			a.groups[v.Name] = item
+			a.change("create", "group", item.ID, v.Name, nil)
+			continue
+		}
+
+		// ciphertexts differ every time a password is encrypted, keep the existing one unless the password changed
+		if form.Password == "" || decryptable(form.Password, a.key) == decryptable(item.Password, a.key) {
+			form.Password = item.Password
+		}
+
+		if diff := diffFields(item.GroupForm, form); len(diff) > 0 {
+			item.GroupForm = form
+			if res := a.tx.Save(&item); res.Error != nil {
+				return fmt.Errorf("group %s: %w", v.Name, res.Error)
+			}
+			a.groups[v.Name] = item
+			a.change("update", "group", item.ID, v.Name, diff)
+		}
+	}
+	return nil
+}
+
+// groupForm resolves the pool, image and template of a group by name
+func (a *siteApplier) groupForm(v models.SiteGroup) (models.GroupForm, error) {
+	form := models.GroupForm{
+		Name:            v.Name,
+		DNS:             strings.Join(strings.Fields(v.DNS), ""),
+		NTP:             strings.Join(strings.Fields(v.NTP), ""),
+		Password:        v.Password,
+		Ks:              v.Ks,
+		Syslog:          strings.Join(strings.Fields(v.Syslog), ""),
+		Vlan:            v.Vlan,
+		CallbackURL:     v.CallbackURL,
+		BootDisk:        v.BootDisk,
+		Options:         v.Options,
+		Attributes:      v.Attributes,
+		TemplateVersion: v.TemplateVersion,
+		HostnamePattern: v.HostnamePattern,
+	}
+
+	pool, ok := a.pools[v.Pool]
+	if !ok {
+		return form, fmt.Errorf("pool %q does not exist", v.Pool)
+	}
+	form.PoolID = pool.ID
+
+	if v.Image != "" {
+		var image models.Image
+		if res := a.tx.Where("iso_image = ?", v.Image).First(&image); res.Error != nil {
+			return form, fmt.Errorf("image %q has not been uploaded", v.Image)
+		}
+		form.ImageID = image.ID
+	}
+
+	if v.Template != "" {
+		var template models.Template
+		if res := a.tx.Where("name = ?", v.Template).First(&template); res.Error != nil {
+			return form, fmt.Errorf("template %q does not exist", v.Template)
+		}
+		if template.Snippet {
+			return form, fmt.Errorf("template %q is a snippet, it can only be included by other templates", v.Template)
+		}
+		form.TemplateID.Int32, form.TemplateID.Valid = int32(template.ID), true
+	}
+
+	if v.Password != "" && decryptable(v.Password, a.key) == "" {
+		return form, fmt.Errorf("the password is not encrypted with the secrets key of this server")
+	}
+	if err := validateKs(v.Ks); err != nil {
+		return form, err
+	}
+	if err := validateAttributes(v.Attributes); err != nil {
+		return form, err
+	}
+	if err := models.ValidateHostnamePattern(v.HostnamePattern); err != nil {
+		return form, err
+	}
+
+	return form, nil
+}
+
+func (a *siteApplier) applyAddresses(site models.Site) error {
+	for _, v := range site.Addresses {
+		// a host without an ip in the site is assigned one when it is created, and matched by its mac from then on
+		name := v.IP
+		key := hostKey(v.IP, v.Mac)
+		if v.IP == "" {
+			name = v.Mac
+			var err error
+			if key, err = a.addressByMac(v.Mac); err != nil {
+				return fmt.Errorf("address %s: %w", name, err)
+			}
+		}
+		if err := a.mark("address", key); err != nil {
+			return err
+		}
+
+		group, ok := a.groups[v.Group]
+		if !ok {
+			return fmt.Errorf("address %s: group %q does not exist", name, v.Group)
+		}
+
+		// fields that are not part of the site, such as the progress, are kept
+		item, exists := a.addresses[key]
+		form := item.AddressForm
+		if v.IP != "" {
+			form.IP = v.IP
+		}
+		form.Mac = v.Mac
+		form.Hostname = v.Hostname
+		form.Domain = v.Domain
+		form.SecondaryIPs = v.SecondaryIPs
+		form.Attributes = v.Attributes
+		form.ClientID = v.ClientID
+		form.UUID = v.UUID
+		form.Serial = v.Serial
+		form.PoolID.Int32, form.PoolID.Valid = int32(group.PoolID), true
+		form.GroupID.Int32, form.GroupID.Valid = int32(group.ID), true
+
+		desired := models.Address{AddressForm: form}
+		if err := validateAddress(a.tx, &desired); err != nil {
+			return fmt.Errorf("address %s: %w", name, err)
+		}
+
+		if !exists {
+			if res := a.tx.Create(&desired); res.Error != nil {
+				return fmt.Errorf("address %s: %w", name, res.Error)
+			}
+			if v.IP == "" {
+				// the key of a new host is only known once it is assigned an ip
+				delete(a.keep["address"], key)
+				key = hostKey(desired.IP, desired.Mac)
+				a.keep["address"][key] = true
+			}
+			a.addresses[key] = desired
+			a.change("create", "address", desired.ID, desired.IP, nil)
+			continue
+		}
+
+		if diff := diffFields(item.AddressForm, desired.AddressForm); len(diff) > 0 {
+			item.AddressForm = desired.AddressForm
+			if res := a.tx.Save(&item); res.Error != nil {
+				return fmt.Errorf("address %s: %w", name, res.Error)
+			}
+			a.addresses[key] = item
+			a.change("update", "address", item.ID, item.IP, diff)
+		}
+	}
+	return nil
+}
+
+func (a *siteApplier) applyOptions(site models.Site) error {
+	var existing []models.Option
+	if res := a.tx.Find(&existing); res.Error != nil {
+		return res.Error
+	}
+
+	options := make(map[string]models.Option)
+	for _, v := range existing {
+		options[optionKey(v.OptionForm)] = v
+	}
+
+	for _, v := range site.Options {
+		form := models.OptionForm{OpCode: v.OpCode, Data: v.Data, Priority: v.Priority}
+		if v.Pool != "" {
+			pool, ok := a.pools[v.Pool]
+			if !ok {
+				return fmt.Errorf("option %d: pool %q does not exist", v.OpCode, v.Pool)
+			}
+			form.PoolID = pool.ID
+		}
+		if v.Address != "" {
+			address, ok := a.address(v.Address)
+			if !ok {
+				return fmt.Errorf("option %d: address %q does not exist", v.OpCode, v.Address)
+			}
+			form.AddressID = address.ID
+		}
+		if v.DeviceClass != "" {
+			class, ok := a.classes[v.DeviceClass]
+			if !ok {
+				return fmt.Errorf("option %d: device class %q does not exist", v.OpCode, v.DeviceClass)
+			}
+			form.DeviceClassID = class.ID
+		}
+		if _, _, err := (models.Option{OptionForm: form}).ToDHCPOption(); err != nil {
+			return fmt.Errorf("option %d: %w", v.OpCode, err)
+		}
+
+		key := optionKey(form)
+		name := optionName(v)
+		if err := a.mark("option", key); err != nil {
+			return fmt.Errorf("option %s is in the site more than once", name)
+		}
+
+		item, ok := options[key]
+		if !ok {
+			item = models.Option{OptionForm: form}
+			if res := a.tx.Create(&item); res.Error != nil {
+				return fmt.Errorf("option %s: %w", name, res.Error)
+			}
+			a.change("create", "option", item.ID, name, nil)
+			continue
+		}
+
+		if diff := diffFields(item.OptionForm, form); len(diff) > 0 {
+			item.OptionForm = form
+			if res := a.tx.Save(&item); res.Error != nil {
+				return fmt.Errorf("option %s: %w", name, res.Error)
+			}
+			a.change("update", "option", item.ID, name, diff)
+		}
+	}
+	return nil
+}
+
+// optionKey identifies an option by its scope, code and priority
+func optionKey(o models.OptionForm) string {
+	return fmt.Sprintf("%d/%d/%d/%d/%d", o.PoolID, o.AddressID, o.DeviceClassID, o.OpCode, o.Priority)
+}
+
+func optionName(o models.SiteOption) string {
+	name := strconv.Itoa(int(o.OpCode))
+	for _, v := range []string{o.Pool, o.Address, o.DeviceClass} {
+		if v != "" {
+			name += " " + v
+		}
+	}
+	return fmt.Sprintf("%s priority %d", name, o.Priority)
+}
+
+// applyPrune deletes everything that is not in the site, dependents first
+func (a *siteApplier) applyPrune(site models.Site) error {
+	// items are kept in maps, sort the deletions to get a stable plan
+	start := len(a.changes)
+	defer func() {
+		order := map[string]int{"option": 0, "address": 1, "group": 2, "pool": 3, "device class": 4}
+		deleted := a.changes[start:]
+		sort.SliceStable(deleted, func(i, j int) bool {
+			if deleted[i].Kind != deleted[j].Kind {
+				return order[deleted[i].Kind] < order[deleted[j].Kind]
+			}
+			return deleted[i].Name < deleted[j].Name
+		})
+	}()
+
+	var options []models.Option
+	if res := a.tx.Find(&options); res.Error != nil {
+		return res.Error
+	}
+	for _, v := range options {
+		if a.keep["option"][optionKey(v.OptionForm)] {
+			continue
+		}
+		if res := a.tx.Delete(&v); res.Error != nil {
+			return res.Error
+		}
+		a.change("delete", "option", v.ID, fmt.Sprintf("%d id %d", v.OpCode, v.ID), nil)
+	}
+
+	for key, v := range a.addresses {
+		if a.keep["address"][key] {
+			continue
+		}
+		if res := a.tx.Delete(&v); res.Error != nil {
+			return res.Error
+		}
+		a.change("delete", "address", v.ID, key, nil)
+	}
+
+	// groups and pools are only pruned when nothing outside the site depends on them, as when they are deleted with the api
+	for name, v := range a.groups {
+		if a.keep["group"][name] {
+			continue
+		}
+		conflict, err := groupInUse(a.tx, v.ID)
+		if err != nil {
+			return err
+		}
+		if conflict != "" {
+			return fmt.Errorf("group %s can't be pruned, %s", name, conflict)
+		}
+		if res := a.tx.Delete(&v); res.Error != nil {
+			return res.Error
+		}
+		a.change("delete", "group", v.ID, name, nil)
+	}
+
+	for name, v := range a.pools {
+		if a.keep["pool"][name] {
+			continue
+		}
+		conflict, err := poolInUse(a.tx, v.ID)
+		if err != nil {
+			return err
+		}
+		if conflict != "" {
+			return fmt.Errorf("pool %s can't be pruned, %s", name, conflict)
+		}
+		if res := a.tx.Where("pool_id = ?", v.ID).Delete(&models.PoolRange{}); res.Error != nil {
+			return res.Error
+		}
+		if res := a.tx.Delete(&v); res.Error != nil {
+			return res.Error
+		}
+		a.change("delete", "pool", v.ID, name, nil)
+	}
+
+	for name, v := range a.classes {
+		if a.keep["device class"][name] {
+			continue
+		}
+		if res := a.tx.Delete(&v); res.Error != nil {
+			return res.Error
+		}
+		a.change("delete", "device class", v.ID, name, nil)
+	}
+
+	return nil
+}
+
+// diffFields returns the fields that differ between two forms of the same type, as "name: old -> new"
+func diffFields(old interface{}, new interface{}) []string {
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+
+	var diff []string
+	for i := 0; i < ov.NumField(); i++ {
+		name := strings.Split(ov.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = ov.Type().Field(i).Name
+		}
+
+		a, b := formatField(ov.Field(i).Interface()), formatField(nv.Field(i).Interface())
+		if a == b {
+			continue
+		}
+		if name == "password" {
+			diff = append(diff, "password: changed")
+			continue
+		}
+		diff = append(diff, fmt.Sprintf("%s: %s -> %s", name, a, b))
+	}
+	return diff
+}
+
+// formatField formats a value as json, json columns are normalized so formatting differences are not a change
+func formatField(v interface{}) string {
+	if j, ok := v.(datatypes.JSON); ok {
+		var decoded interface{}
+		if len(j) == 0 || json.Unmarshal(j, &decoded) != nil {
+			return string(j)
+		}
+		v = decoded
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(out)
+}
+
+// decryptable returns the decrypted secret, or an empty string if it is not encrypted with the key
+func decryptable(ciphertext string, key string) string {
+	plaintext, err := secrets.Decrypt(ciphertext, key)
+	if err != nil {
+		return ""
+	}
+	return plaintext
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+)
+
+// testSite is a pool with a group, and the hosts of the group. The password of the group is encrypted with the key.
+func testSite(t *testing.T, key string, addresses ...models.SiteAddress) models.Site {
+	t.Helper()
+
+	password, err := secrets.Encrypt("VMware1!VMware1!", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return models.Site{
+		Pools:     []models.PoolForm{{Name: "pool", StartAddress: "10.0.0.10", EndAddress: "10.0.0.250", Netmask: 24, LeaseTime: 3600, Gateway: "10.0.0.1"}},
+		Groups:    []models.SiteGroup{{Name: "esx", Pool: "pool", Password: password}},
+		Addresses: addresses,
+	}
+}
+
+// testKey returns a new secrets key
+func testKey(t *testing.T) string {
+	t.Helper()
+
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestApplyAddressWithoutIP(t *testing.T) {
+	testDB(t, &models.Pool{}, &models.PoolRange{}, &models.Group{}, &models.Address{}, &models.DeviceClass{}, &models.Option{}, &models.AuditEntry{})
+
+	key := testKey(t)
+	site := testSite(t, key, models.SiteAddress{Mac: "00:50:56:00:00:01", Hostname: "esx01", Group: "esx"})
+	for i, want := range []int{3, 0} {
+		result, err := ApplySite(site, key, false, true, models.AuditEntry{})
+		if err != nil {
+			t.Fatalf("apply %d: %v", i, err)
+		}
+		if len(result.Changes) != want {
+			t.Errorf("apply %d: got %v, want %d changes", i, result.Changes, want)
+		}
+	}
+
+	var addresses []models.Address
+	if res := db.DB.Find(&addresses); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if len(addresses) != 1 || addresses[0].IP == "" {
+		t.Errorf("got %+v, want one host with an assigned ip", addresses)
+	}
+}
+
+func TestApplyPruneInUse(t *testing.T) {
+	testDB(t, &models.Pool{}, &models.PoolRange{}, &models.Group{}, &models.Address{}, &models.DeviceClass{}, &models.Option{}, &models.AuditEntry{}, &models.GroupRule{}, &models.Account{})
+
+	key := testKey(t)
+	if _, err := ApplySite(testSite(t, key), key, false, false, models.AuditEntry{}); err != nil {
+		t.Fatal(err)
+	}
+	var group models.Group
+	if res := db.DB.Where("name = ?", "esx").First(&group); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	rule := models.GroupRule{GroupRuleForm: models.GroupRuleForm{Name: "dell", SerialPrefix: "SN", GroupID: group.ID}}
+	if res := db.DB.Create(&rule); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	// the group of the rule is not pruned
+	empty := models.Site{Pools: testSite(t, key).Pools}
+	if _, err := ApplySite(empty, key, false, true, models.AuditEntry{}); err == nil || !strings.Contains(err.Error(), "group rules") {
+		t.Fatalf("prune of a group with rules: got %v", err)
+	}
+
+	// neither is a pool with an active lease
+	if res := db.DB.Delete(&rule); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	lease := models.Address{AddressForm: models.AddressForm{IP: "10.0.0.20", Mac: "00:50:56:00:00:02"}, Expires: time.Now().Add(time.Hour)}
+	lease.PoolID.Int32, lease.PoolID.Valid = int32(group.PoolID), true
+	if res := db.DB.Create(&lease); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if _, err := ApplySite(models.Site{}, key, false, true, models.AuditEntry{}); err == nil || !strings.Contains(err.Error(), "active leases") {
+		t.Fatalf("prune of a pool with a lease: got %v", err)
+	}
+
+	// nothing was deleted by the failed prunes, and the group goes once nothing depends on it
+	result, err := ApplySite(empty, key, false, true, models.AuditEntry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Changes) != 1 || result.Changes[0].Kind != "group" || result.Changes[0].Action != "delete" {
+		t.Errorf("got %v, want the group deleted", result.Changes)
+	}
+}
@@ -0,0 +1,322 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/imdario/mergo"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ListAttributes Get a list of all attribute definitions
+// @Summary Get all attribute definitions
+// @Tags attributes
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.Attribute
+// @Failure 500 {object} models.APIError
+// @Router /attributes [get]
+func ListAttributes(c *gin.Context) {
+	var items []models.Attribute
+	if res := db.DB.Order("key").Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetAttribute Get an existing attribute definition
+// @Summary Get an existing attribute definition
+// @Tags attributes
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Attribute ID"
+// @Success 200 {object} models.Attribute
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /attributes/{id} [get]
+func GetAttribute(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Attribute
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CreateAttribute Define a new attribute
+// @Summary Define a new attribute
+// @Tags attributes
+// @Accept  json
+// @Produce  json
+// @Param item body models.AttributeForm true "Add an attribute definition"
+// @Success 200 {object} models.Attribute
+// @Failure 400 {object} models.APIError
+// @Router /attributes [post]
+func CreateAttribute(c *gin.Context) {
+	var form models.AttributeForm
+
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item := models.Attribute{AttributeForm: form}
+
+	if res := db.DB.Create(&item); res.Error != nil {
+		Error(c, http.StatusBadRequest, res.Error) // 400
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// UpdateAttribute Update an existing attribute definition
+// @Summary Update an existing attribute definition, the key can't be changed
+// @Tags attributes
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Attribute ID"
+// @Param  item body models.AttributeForm true "Update an attribute definition"
+// @Success 200 {object} models.Attribute
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /attributes/{id} [patch]
+func UpdateAttribute(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the form data
+	var form models.AttributeForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Attribute
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// values are stored by key on pools, groups and hosts
+	if form.Key != item.Key {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the key of an attribute can't be changed")) // 400
+		return
+	}
+
+	// Merge the item and the form data
+	if err := mergo.Merge(&item, models.Attribute{AttributeForm: form}, mergo.WithOverride); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+	}
+
+	// Mergo doesn't overwrite empty values, force set
+	item.Description = form.Description
+	item.AdvancedOption = form.AdvancedOption
+
+	// Save it
+	if res := db.DB.Save(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// DeleteAttribute Remove an existing attribute definition
+// @Summary Remove an existing attribute definition, values already set are kept but no longer validated
+// @Tags attributes
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Attribute ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /attributes/{id} [delete]
+func DeleteAttribute(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Attribute
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// Save it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+// GetAddressAttributes Get the effective attributes of a host
+// @Summary Get the attributes of a host, inherited from its pool and group
+// @Tags addresses
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Address ID"
+// @Success 200 {object} map[string]models.EffectiveAttribute
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /addresses/{id}/attributes [get]
+func GetAddressAttributes(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Address
+	if res := db.DB.Preload(clause.Associations).First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	sources, err := item.AttributeSources()
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	attributes := map[string]models.EffectiveAttribute{}
+	for _, source := range sources {
+		for k, v := range source.Values {
+			attributes[k] = models.EffectiveAttribute{Value: v, Source: source.Name}
+		}
+	}
+
+	c.JSON(http.StatusOK, attributes) // 200
+}
+
+// attributeDefinitions returns all attribute definitions by key
+func attributeDefinitions() (map[string]models.Attribute, error) {
+	var items []models.Attribute
+	if res := db.DB.Find(&items); res.Error != nil {
+		return nil, res.Error
+	}
+
+	definitions := make(map[string]models.Attribute)
+	for _, v := range items {
+		definitions[v.Key] = v
+	}
+	return definitions, nil
+}
+
+// validateAttributes checks that the attributes of a pool, group or host are defined and of the right type
+func validateAttributes(raw datatypes.JSON) error {
+	values, err := models.DecodeAttributes(raw)
+	if err != nil {
+		return fmt.Errorf("attributes must be an object: %w", err)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	definitions, err := attributeDefinitions()
+	if err != nil {
+		return err
+	}
+
+	for k, v := range values {
+		definition, ok := definitions[k]
+		if !ok {
+			return fmt.Errorf("attribute %s is not defined", k)
+		}
+		if err := definition.Validate(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateAttributeFilter checks that only defined attributes are searched for
+func validateAttributeFilter(filter map[string]interface{}) error {
+	definitions, err := attributeDefinitions()
+	if err != nil {
+		return err
+	}
+
+	for k := range filter {
+		if _, ok := definitions[k]; !ok {
+			return fmt.Errorf("attribute %s is not defined", k)
+		}
+	}
+	return nil
+}
+
+// matchAttributes returns if the attributes of a host, inherited from its pool and group, have all the values of the filter
+func matchAttributes(item models.Address, filter map[string]interface{}) (bool, error) {
+	attributes, err := item.EffectiveAttributes()
+	if err != nil {
+		return false, err
+	}
+
+	for k, v := range filter {
+		if !reflect.DeepEqual(attributes[k], v) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sampleAttributes returns a value for every defined attribute, used to lint kickstart templates
+func sampleAttributes() (map[string]interface{}, error) {
+	definitions, err := attributeDefinitions()
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := make(map[string]interface{})
+	for k, v := range definitions {
+		attributes[k] = v.Sample()
+	}
+	return attributes, nil
+}
@@ -0,0 +1,425 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/config"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+)
+
+// auditModels are the resources of the api whose changes are recorded field by field
+var auditModels = map[string]func() interface{}{
+	"pools":          func() interface{} { return &models.Pool{} },
+	"addresses":      func() interface{} { return &models.Address{} },
+	"attributes":     func() interface{} { return &models.Attribute{} },
+	"discovered":     func() interface{} { return &models.DiscoveredHost{} },
+	"group_rules":    func() interface{} { return &models.GroupRule{} },
+	"options":        func() interface{} { return &models.Option{} },
+	"device_classes": func() interface{} { return &models.DeviceClass{} },
+	"groups":         func() interface{} { return &models.Group{} },
+	"images":         func() interface{} { return &models.Image{} },
+	"templates":      func() interface{} { return &models.Template{} },
+	"users":          func() interface{} { return &models.User{} },
+	"tokens":         func() interface{} { return &models.Token{} },
+	"accounts":       func() interface{} { return &models.Account{} },
+}
+
+// auditedReads are the segments of the GET requests that are recorded, because they act on hosts or reveal secrets
+var auditedReads = map[string]bool{
+	"postconfig":  true,
+	"credentials": true,
+}
+
+// auditSkip are the segments of requests that only read, although they are posted
+var auditSkip = map[string]bool{
+	"search": true,
+	"lint":   true,
+}
+
+// auditFields change with every save and are left out of the changes
+var auditFields = map[string]bool{
+	"created_at": true,
+	"updated_at": true,
+}
+
+// auditSyslog receives a copy of the audit log when forwarding to syslog is configured
+var auditSyslog io.Writer
+
+// SetupAudit enables forwarding the audit log to syslog
+func SetupAudit(conf *config.Config) {
+	auditSyslog = nil
+	if conf.Audit.Syslog == "" {
+		return
+	}
+
+	w, err := dialSyslog(conf.Audit.Syslog)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"syslog": conf.Audit.Syslog,
+			"err":    err,
+		}).Error("audit: can't forward to syslog")
+		return
+	}
+	auditSyslog = w
+}
+
+// Audit records the changes made with the api and the sensitive reads in the audit log
+func Audit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !strings.HasPrefix(c.FullPath(), "/v1/") {
+			c.Next()
+			return
+		}
+		segments := strings.Split(strings.TrimPrefix(c.FullPath(), "/v1/"), "/")
+		if !audited(c.Request.Method, segments) {
+			c.Next()
+			return
+		}
+
+		entry := models.AuditEntry{
+			IP:       c.ClientIP(),
+			Method:   c.Request.Method,
+			Path:     c.Request.URL.Path,
+			Action:   auditAction(c.Request.Method, segments),
+			Resource: segments[0],
+		}
+		entry.ResourceID, _ = strconv.Atoi(c.Param("id"))
+
+		// an item of a resource, e.g. PATCH /v1/groups/:id, is compared before and after
+		single := len(segments) == 2 && segments[1] == ":id"
+		create := len(segments) == 1 && c.Request.Method == http.MethodPost
+
+		var before map[string]interface{}
+		if single && c.Request.Method != http.MethodGet {
+			before = auditSnapshot(entry.Resource, entry.ResourceID)
+		}
+
+		// the created item is only known from the response
+		var body *auditWriter
+		if create {
+			body = &auditWriter{ResponseWriter: c.Writer}
+			c.Writer = body
+		}
+
+		c.Next()
+
+		user := CurrentUser(c)
+		entry.UserID = user.ID
+		entry.Username = user.Username
+		entry.Status = c.Writer.Status()
+
+		if entry.Status < http.StatusMultipleChoices {
+			var after map[string]interface{}
+			switch {
+			case single && c.Request.Method != http.MethodDelete:
+				after = auditSnapshot(entry.Resource, entry.ResourceID)
+			case create && auditModels[entry.Resource] != nil:
+				if err := json.Unmarshal(body.buf.Bytes(), &after); err == nil {
+					if id, ok := after["id"].(float64); ok {
+						entry.ResourceID = int(id)
+					}
+				}
+			}
+
+			if changes := auditDiff(before, after); len(changes) > 0 {
+				entry.Changes, _ = json.Marshal(changes)
+			}
+		}
+
+		recordAudit(entry)
+	}
+}
+
+// ListAudit Get the audit log
+// @Summary Get the audit log, newest first
+// @Tags audit
+// @Accept  json
+// @Produce  json
+// @Param username query string false "Username"
+// @Param action query string false "Action, e.g. create, update, delete or login"
+// @Param resource query string false "Resource, e.g. groups"
+// @Param resource_id query int false "ID of the resource"
+// @Param since query string false "Entries since, RFC3339"
+// @Param until query string false "Entries until, RFC3339"
+// @Param limit query int false "Maximum number of entries, 100 by default"
+// @Param offset query int false "Number of entries to skip"
+// @Success 200 {array} models.AuditEntry
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /audit [get]
+func ListAudit(c *gin.Context) {
+	query := db.DB.Order("id desc")
+
+	for _, field := range []string{"username", "action", "resource", "resource_id"} {
+		if v := c.Query(field); v != "" {
+			query = query.Where(field+" = ?", v)
+		}
+	}
+
+	for field, op := range map[string]string{"since": ">=", "until": "<="} {
+		if v := c.Query(field); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				Error(c, http.StatusBadRequest, fmt.Errorf("%s: %w", field, err)) // 400
+				return
+			}
+			query = query.Where("created_at "+op+" ?", t)
+		}
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		Error(c, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and 1000")) // 400
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		Error(c, http.StatusBadRequest, fmt.Errorf("offset must be a positive number")) // 400
+		return
+	}
+
+	var items []models.AuditEntry
+	if res := query.Limit(limit).Offset(offset).Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// auditLogin records a login with a password or with single sign-on
+func auditLogin(c *gin.Context, user models.User, username string, err error) {
+	entry := models.AuditEntry{
+		UserID:   user.ID,
+		Username: username,
+		IP:       c.ClientIP(),
+		Method:   c.Request.Method,
+		Path:     c.Request.URL.Path,
+		Action:   "login",
+		Resource: "users",
+		Status:   http.StatusOK,
+	}
+	if err != nil {
+		entry.Action = "login_failed"
+		entry.Status = http.StatusUnauthorized
+	}
+	recordAudit(entry)
+}
+
+// auditActor returns an entry with the user and the request, for changes that are recorded by the handler itself
+func auditActor(c *gin.Context) models.AuditEntry {
+	user := CurrentUser(c)
+	return models.AuditEntry{
+		UserID:   user.ID,
+		Username: user.Username,
+		IP:       c.ClientIP(),
+		Method:   c.Request.Method,
+		Path:     c.Request.URL.Path,
+		Status:   http.StatusOK,
+	}
+}
+
+// auditKinds are the resources of the kinds of items in a site
+var auditKinds = map[string]string{
+	"device class": "device_classes",
+	"pool":         "pools",
+	"group":        "groups",
+	"address":      "addresses",
+	"option":       "options",
+}
+
+// auditApply records each change of an applied site
+func auditApply(actor models.AuditEntry, changes []models.ApplyChange) {
+	for _, v := range changes {
+		entry := actor
+		entry.Action = v.Action
+		entry.Resource = auditKinds[v.Kind]
+		entry.ResourceID = v.ID
+
+		fields := map[string]models.AuditChange{}
+		switch v.Action {
+		case "create":
+			fields["name"] = models.AuditChange{New: v.Name}
+		case "delete":
+			fields["name"] = models.AuditChange{Old: v.Name}
+		}
+		// the diff of a field is "name: old -> new"
+		for _, d := range v.Diff {
+			field := strings.SplitN(d, ": ", 2)
+			values := strings.SplitN(field[len(field)-1], " -> ", 2)
+			change := models.AuditChange{New: values[len(values)-1]}
+			if len(values) == 2 {
+				change.Old = values[0]
+			}
+			if sensitive(field[0]) {
+				change = models.AuditChange{Old: redact(change.Old), New: redact(change.New)}
+			}
+			fields[field[0]] = change
+		}
+		entry.Changes, _ = json.Marshal(fields)
+
+		recordAudit(entry)
+	}
+}
+
+// AuditGroupRule records that a discovered host was registered to a group by a rule
+func AuditGroupRule(actor models.AuditEntry, rule *models.GroupRule, item models.Address) {
+	entry := actor
+	entry.Action = "assign"
+	entry.Resource = "addresses"
+	entry.ResourceID = item.ID
+	entry.Changes, _ = json.Marshal(map[string]models.AuditChange{
+		"group_id": {New: item.GroupID.Int32},
+		"hostname": {New: item.Hostname},
+		"ip":       {New: item.IP},
+		"reimage":  {New: item.Reimage},
+		"rule":     {New: rule.Name},
+	})
+	recordAudit(entry)
+}
+
+// recordAudit stores the entry and forwards it to syslog
+func recordAudit(entry models.AuditEntry) {
+	if res := db.DB.Create(&entry); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": res.Error,
+		}).Error("audit")
+	}
+
+	if auditSyslog != nil {
+		b, _ := json.Marshal(entry)
+		if _, err := auditSyslog.Write(b); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"err": err,
+			}).Error("audit: syslog")
+		}
+	}
+}
+
+func audited(method string, segments []string) bool {
+	for _, s := range segments {
+		if auditSkip[s] {
+			return false
+		}
+	}
+
+	switch method {
+	case http.MethodGet:
+		for _, s := range segments {
+			if auditedReads[s] {
+				return true
+			}
+		}
+		return false
+	case http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// auditAction is the verb of the method, or the last part of the path for actions like /discovered/:id/claim
+func auditAction(method string, segments []string) string {
+	last := segments[len(segments)-1]
+	if !strings.HasPrefix(last, ":") && (len(segments) > 1 || auditModels[last] == nil) {
+		return last
+	}
+
+	switch method {
+	case http.MethodPost:
+		return "create"
+	case http.MethodPatch, http.MethodPut:
+		return "update"
+	case http.MethodDelete:
+		return "delete"
+	}
+	return "read"
+}
+
+// auditSnapshot returns the stored item as its json fields
+func auditSnapshot(resource string, id int) map[string]interface{} {
+	model, ok := auditModels[resource]
+	if !ok {
+		return nil
+	}
+
+	item := model()
+	if res := db.DB.First(item, id); res.Error != nil {
+		return nil
+	}
+
+	var fields map[string]interface{}
+	b, _ := json.Marshal(item)
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+// auditDiff returns the fields that differ, created and deleted items have all their fields in the changes
+func auditDiff(before, after map[string]interface{}) map[string]models.AuditChange {
+	changes := make(map[string]models.AuditChange)
+
+	keys := make(map[string]bool)
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+
+	for k := range keys {
+		was, now := before[k], after[k]
+		if auditFields[k] || reflect.DeepEqual(was, now) {
+			continue
+		}
+		if sensitive(k) {
+			was, now = redact(was), redact(now)
+		}
+		changes[k] = models.AuditChange{Old: was, New: now}
+	}
+	return changes
+}
+
+// sensitive returns true for fields that hold secrets, their values are never recorded
+func sensitive(field string) bool {
+	// a custom kickstart may hold passwords in plain text
+	if field == "ks" {
+		return true
+	}
+	for _, s := range []string{"password", "secret", "token", "hash"} {
+		if strings.HasSuffix(field, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact hides a value, but keeps that it was set
+func redact(v interface{}) interface{} {
+	if v == nil || v == "" {
+		return v
+	}
+	return "[redacted]"
+}
+
+// auditWriter keeps a copy of the response
+type auditWriter struct {
+	gin.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	w.buf.Write(b)
+	return w.ResponseWriter.Write(b)
+}
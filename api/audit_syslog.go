@@ -0,0 +1,23 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package api
+
+import (
+	"io"
+	"log/syslog"
+	"net/url"
+)
+
+// dialSyslog connects to the local syslog daemon for "local", or to a server at udp://host:514 or tcp://host:514
+func dialSyslog(target string) (io.Writer, error) {
+	if target == "local" {
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "go-via")
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	return syslog.Dial(u.Scheme, u.Host, syslog.LOG_INFO|syslog.LOG_AUTH, "go-via")
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package api
+
+import (
+	"fmt"
+	"io"
+)
+
+func dialSyslog(target string) (io.Writer, error) {
+	return nil, fmt.Errorf("syslog is not supported on this platform")
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/config"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// auditEntries returns the audit log, oldest first
+func auditEntries(t *testing.T) []models.AuditEntry {
+	t.Helper()
+
+	var entries []models.AuditEntry
+	if res := db.DB.Order("id").Find(&entries); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	return entries
+}
+
+func TestSensitive(t *testing.T) {
+	for field, want := range map[string]bool{
+		"password":      true,
+		"root_password": true,
+		"ks_token_hash": true,
+		"bind_secret":   true,
+		"ks":            true,
+		"hostname":      false,
+		"ks_url":        false,
+	} {
+		if got := sensitive(field); got != want {
+			t.Errorf("sensitive(%q) = %v, want %v", field, got, want)
+		}
+	}
+}
+
+func TestAuditApply(t *testing.T) {
+	testDB(t, &models.AuditEntry{})
+
+	auditApply(models.AuditEntry{Username: "cli", Method: "CLI", Path: "apply -f site.yaml"}, []models.ApplyChange{
+		{Action: "create", Kind: "pool", ID: 1, Name: "lab"},
+		{Action: "update", Kind: "group", ID: 2, Name: "esx", Diff: []string{`dns: "10.0.0.1" -> "10.0.0.2"`, "password: changed", `ks: "rootpw old" -> "rootpw new"`}},
+		{Action: "delete", Kind: "device class", ID: 3, Name: "old"},
+	})
+
+	entries := auditEntries(t)
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	for i, want := range []struct {
+		action, resource string
+		id               int
+	}{
+		{"create", "pools", 1},
+		{"update", "groups", 2},
+		{"delete", "device_classes", 3},
+	} {
+		if e := entries[i]; e.Username != "cli" || e.Action != want.action || e.Resource != want.resource || e.ResourceID != want.id {
+			t.Errorf("entry %d: got %s %s %s %d, want %s %s %d", i, e.Username, e.Action, e.Resource, e.ResourceID, want.action, want.resource, want.id)
+		}
+	}
+
+	var changes map[string]models.AuditChange
+	if err := json.Unmarshal(entries[1].Changes, &changes); err != nil {
+		t.Fatal(err)
+	}
+	if c := changes["dns"]; c.Old != `"10.0.0.1"` || c.New != `"10.0.0.2"` {
+		t.Errorf("dns: got %v -> %v", c.Old, c.New)
+	}
+	for _, field := range []string{"password", "ks"} {
+		if c := changes[field]; c.New != "[redacted]" || (c.Old != nil && c.Old != "[redacted]") {
+			t.Errorf("%s: got %v -> %v, want it redacted", field, c.Old, c.New)
+		}
+	}
+}
+
+func TestAuditFailedLogins(t *testing.T) {
+	testDB(t, &models.User{}, &models.Token{}, &models.AuditEntry{})
+	gin.SetMode(gin.TestMode)
+
+	previous := providers
+	providers = []Provider{Local{policy: config.Security{LockoutThreshold: 2, LockoutDuration: 15}}}
+	t.Cleanup(func() { providers = previous })
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcryptCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := db.DB.Create(&models.User{UserForm: models.UserForm{Username: "admin", Role: models.RoleAdmin, Password: string(hash)}}); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	r := gin.New()
+	r.GET("/v1/pools", Authenticate(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	request := func(auth func(*http.Request)) int {
+		req := httptest.NewRequest(http.MethodGet, "/v1/pools", nil)
+		auth(req)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := request(func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+tokenPrefix+"unknown") }); code != http.StatusUnauthorized {
+		t.Errorf("unknown token: got %d", code)
+	}
+	for i := 0; i < 2; i++ {
+		if code := request(func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }); code != http.StatusUnauthorized {
+			t.Errorf("wrong password: got %d", code)
+		}
+	}
+	// the locked user is rejected even with the right password
+	if code := request(func(r *http.Request) { r.SetBasicAuth("admin", "secret") }); code != http.StatusUnauthorized {
+		t.Errorf("locked user: got %d", code)
+	}
+
+	var actions []string
+	for _, e := range auditEntries(t) {
+		actions = append(actions, e.Action+" "+e.Username)
+	}
+	want := []string{"token_rejected ", "login_failed admin", "locked admin", "login_failed admin", "login_failed admin"}
+	if len(actions) != len(want) {
+		t.Fatalf("got %q, want %q", actions, want)
+	}
+	for i := range want {
+		if actions[i] != want[i] {
+			t.Errorf("entry %d: got %q, want %q", i, actions[i], want[i])
+		}
+	}
+}
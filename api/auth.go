@@ -0,0 +1,197 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Authenticate authenticates the user of a request with a token, a session cookie or basic auth. The user is
+// available to the handlers with CurrentUser.
+func Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if secret := requestToken(c); secret != "" {
+			var user models.User
+			var err error
+			if sso != nil && !strings.HasPrefix(secret, tokenPrefix) {
+				// not one of ours, a JWT of the identity provider
+				user, err = sso.Verify(c.Request.Context(), secret)
+			} else {
+				var token models.Token
+				if user, token, err = tokenUser(secret); err == nil {
+					c.Set("token", token)
+				}
+			}
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"token": prefix(secret),
+					"err":   err,
+				}).Info("auth")
+				recordAudit(models.AuditEntry{
+					IP:       c.ClientIP(),
+					Method:   c.Request.Method,
+					Path:     c.Request.URL.Path,
+					Action:   "token_rejected",
+					Resource: "tokens",
+					Status:   http.StatusUnauthorized,
+				})
+				c.Writer.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				Error(c, http.StatusUnauthorized, errInvalidToken) // 401
+				c.Abort()
+				return
+			}
+
+			if mustChangePassword(c, user) {
+				return
+			}
+
+			c.Set("user", user)
+			c.Next()
+			return
+		}
+
+		username, password, hasAuth := c.Request.BasicAuth()
+		if !hasAuth {
+			logrus.WithFields(logrus.Fields{
+				"login": "unauthorized request",
+			}).Info("auth")
+			c.Writer.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		//check the credentials with the local users and the directory
+		user, err := authenticate(username, password)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"username": username,
+				"status":   err.Error(),
+			}).Info("auth")
+			auditLogin(c, user, username, err)
+			c.Writer.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"username": username,
+			"status":   "successfully authenticated",
+		}).Debug("auth")
+
+		if mustChangePassword(c, user) {
+			return
+		}
+
+		c.Set("user", user)
+		c.Next()
+	}
+}
+
+// passwordChangeRoutes can be used before a required password change
+var passwordChangeRoutes = map[string]bool{
+	"GET /v1/users/me":           true,
+	"POST /v1/users/me/password": true,
+	"POST /v1/logout":            true,
+}
+
+// mustChangePassword blocks the api and the metrics until the user has changed a password that has to be changed, and
+// responds with 403. The web interface keeps loading so the password can be changed there.
+func mustChangePassword(c *gin.Context, user models.User) bool {
+	gated := strings.HasPrefix(c.Request.URL.Path, "/v1/") || c.Request.URL.Path == "/metrics"
+	if !user.PasswordChange || !gated || passwordChangeRoutes[c.Request.Method+" "+c.FullPath()] {
+		return false
+	}
+
+	Error(c, http.StatusForbidden, fmt.Errorf("the password must be changed first, at POST /v1/users/me/password")) // 403
+	c.Abort()
+	return true
+}
+
+// requestToken returns the bearer token or session of a request. Browsers can't set headers on websockets, so they
+// may also pass the token as query parameter.
+func requestToken(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if cookie, err := c.Cookie(sessionCookie); err == nil && cookie != "" {
+		return cookie
+	}
+	if c.IsWebsocket() {
+		return c.Query("token")
+	}
+	return ""
+}
+
+// prefix returns the part of a secret that is safe to log
+func prefix(secret string) string {
+	if len(secret) > len(tokenPrefix)+6 {
+		return secret[:len(tokenPrefix)+6]
+	}
+	return secret
+}
+
+// CurrentUser returns the authenticated user of a request
+func CurrentUser(c *gin.Context) models.User {
+	user, _ := c.Get("user")
+	u, _ := user.(models.User)
+	return u
+}
+
+// Require only allows users with at least the given role
+func Require(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if user := CurrentUser(c); !user.HasRole(role) {
+			forbidden(c, user, role)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Permit allows every user to read, and only users with at least the given role to make changes
+func Permit(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		required := role
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			required = models.RoleReadOnly
+		}
+
+		if user := CurrentUser(c); !user.HasRole(required) {
+			forbidden(c, user, required)
+			return
+		}
+		c.Next()
+	}
+}
+
+// inScope checks if the user may manage the hosts of a group, and responds with 403 when not
+func inScope(c *gin.Context, groupID models.NullInt32) bool {
+	user := CurrentUser(c)
+	if user.InScope(groupID) {
+		return true
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"username": user.Username,
+		"group":    groupID.Int32,
+		"path":     c.Request.URL.Path,
+	}).Info("auth: host outside the group of the user")
+	Error(c, http.StatusForbidden, fmt.Errorf("the user may only manage hosts of group %d", user.GroupID.Int32)) // 403
+	return false
+}
+
+func forbidden(c *gin.Context, user models.User, role string) {
+	logrus.WithFields(logrus.Fields{
+		"username": user.Username,
+		"role":     user.Role,
+		"required": role,
+		"method":   c.Request.Method,
+		"path":     c.Request.URL.Path,
+	}).Info("auth: permission denied")
+	Error(c, http.StatusForbidden, fmt.Errorf("the %s role is required", role)) // 403
+	c.Abort()
+}
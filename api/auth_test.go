@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/models"
+)
+
+func TestMustChangePassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		user := models.User{UserForm: models.UserForm{Username: "admin", Role: models.RoleAdmin}, PasswordChange: true}
+		if mustChangePassword(c, user) {
+			return
+		}
+		c.Next()
+	})
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/v1/pools", ok)
+	r.GET("/v1/users/me", ok)
+	r.GET("/metrics", ok)
+	r.GET("/", ok)
+
+	for path, want := range map[string]int{
+		"/v1/pools":    http.StatusForbidden,
+		"/metrics":     http.StatusForbidden,
+		"/v1/users/me": http.StatusOK,
+		"/":            http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("%s: got %d, want %d", path, w.Code, want)
+		}
+	}
+}
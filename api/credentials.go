@@ -0,0 +1,146 @@
+package api
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+	"gorm.io/gorm"
+)
+
+// rootPasswordLength is the length of the generated root passwords
+const rootPasswordLength = 20
+
+// rootPasswordClasses are the characters of the generated root passwords, one of each class is always used. The
+// special characters are safe on the rootpw line of a kickstart.
+var rootPasswordClasses = []string{
+	"abcdefghijkmnopqrstuvwxyz",
+	"ABCDEFGHJKLMNPQRSTUVWXYZ",
+	"23456789",
+	"!%+-=_.@",
+}
+
+// generateRootPassword returns a random password that fullfills the password complexity requirements of ESXi
+func generateRootPassword() (string, error) {
+	all := ""
+	for _, class := range rootPasswordClasses {
+		all += class
+	}
+
+	b := make([]byte, 0, rootPasswordLength)
+	for i := 0; i < rootPasswordLength; i++ {
+		chars := all
+		if i < len(rootPasswordClasses) {
+			chars = rootPasswordClasses[i]
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		b = append(b, chars[n.Int64()])
+	}
+
+	// shuffle, so the classes aren't always in the same positions
+	for i := len(b) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		j := n.Int64()
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b), nil
+}
+
+// rootPassword returns the decrypted root password of the host, which is the password generated for the host or else
+// the password of its group
+func rootPassword(item models.Address, key string) (string, string, error) {
+	if item.RootPassword != "" {
+		password, err := secrets.Decrypt(item.RootPassword, key)
+		if err != nil {
+			return "", models.CredentialsHost, fmt.Errorf("the root password of the host can't be decrypted: %w", err)
+		}
+		return password, models.CredentialsHost, nil
+	}
+
+	password, err := secrets.Decrypt(item.Group.Password, key)
+	if err != nil {
+		return "", models.CredentialsGroup, fmt.Errorf("the password of the group can't be decrypted: %w", err)
+	}
+	return password, models.CredentialsGroup, nil
+}
+
+// installRootPassword returns the root password to install the host with, and the encrypted password to store on the
+// host. A new password is generated for every install when the group has unique passwords, otherwise the password of
+// the group is used and nothing is stored.
+func installRootPassword(item models.Address, options models.GroupOptions, key string) (string, string, error) {
+	if !options.UniquePasswords {
+		password, err := secrets.Decrypt(item.Group.Password, key)
+		if err != nil {
+			return "", "", fmt.Errorf("the password of the group can't be decrypted: %w", err)
+		}
+		return password, "", nil
+	}
+
+	password, err := generateRootPassword()
+	if err != nil {
+		return "", "", err
+	}
+	encrypted, err := secrets.Encrypt(password, key)
+	if err != nil {
+		return "", "", err
+	}
+	return password, encrypted, nil
+}
+
+// GetAddressCredentials Get the root credentials of an address
+// @Summary Get the root credentials of an address, the request is recorded in the audit log
+// @Tags addresses
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Address ID"
+// @Success 200 {object} models.Credentials
+// @Failure 400 {object} models.APIError
+// @Failure 403 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /addresses/{id}/credentials [get]
+func GetAddressCredentials(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// Load the item
+		var item models.Address
+		if res := db.DB.Preload("Group").First(&item, id); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+			} else {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+			}
+			return
+		}
+
+		if !inScope(c, item.GroupID) {
+			return
+		}
+
+		password, source, err := rootPassword(item, key)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		c.JSON(http.StatusOK, models.Credentials{Username: "root", Password: password, Source: source}) // 200
+	}
+}
@@ -0,0 +1,395 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// discoveryks is served to unregistered hosts of a discovery pool. It has no install directive, so the installer never
+// touches the disks, the %pre script reports the hardware and powers the host off until it is claimed.
+var discoveryks = template.Must(template.New("discovery").Parse(`
+vmaccepteula
+
+%pre --interpreter=python
+import json, os, ssl, subprocess, urllib.request
+
+def esxcli(*args):
+    try:
+        return json.loads(subprocess.check_output(["esxcli", "--formatter=json"] + list(args)).decode())
+    except Exception:
+        return None
+
+platform = esxcli("hardware", "platform", "get") or {}
+cpu = esxcli("hardware", "cpu", "global", "get") or {}
+cpus = esxcli("hardware", "cpu", "list") or [{}]
+memory = esxcli("hardware", "memory", "get") or {}
+
+facts = {
+    "mac": "{{ .mac }}",
+    "serial": platform.get("SerialNumber", ""),
+    "vendor": platform.get("VendorName", ""),
+    "model": platform.get("ProductName", ""),
+    "cpu": {
+        "model": cpus[0].get("Brand", ""),
+        "packages": int(cpu.get("CPUPackages", 0)),
+        "cores": int(cpu.get("CPUCores", 0)),
+        "threads": int(cpu.get("CPUThreads", 0)),
+    },
+    "memory": int(memory.get("PhysicalMemory", 0)),
+    "nics": [{
+        "name": v.get("Name", ""),
+        "mac": v.get("MACAddress", ""),
+        "driver": v.get("Driver", ""),
+        "link": v.get("Link", ""),
+        "speed": int(v.get("Speed", 0)),
+    } for v in esxcli("network", "nic", "list") or []],
+    "disks": [{
+        "device": v.get("Device", ""),
+        "vendor": v.get("Vendor", ""),
+        "model": v.get("Model", ""),
+        "size": int(v.get("Size", 0)),
+        "ssd": bool(v.get("IsSSD", False)),
+        "local": bool(v.get("IsLocal", False)),
+    } for v in esxcli("storage", "core", "device", "list") or []],
+}
+
+req = urllib.request.Request("https://{{ .via_server }}/discovery/facts", data=json.dumps(facts).encode(), headers={"Content-Type": "application/json"})
+urllib.request.urlopen(req, context=ssl._create_unverified_context())
+os.system("poweroff -f")
+`))
+
+// ListDiscoveredHosts Get a list of all discovered hosts
+// @Summary Get all discovered hosts
+// @Tags discovery
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.DiscoveredHost
+// @Failure 500 {object} models.APIError
+// @Router /discovered [get]
+func ListDiscoveredHosts(c *gin.Context) {
+	var items []models.DiscoveredHost
+	if res := db.DB.Order("last_seen desc").Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetDiscoveredHost Get an existing discovered host
+// @Summary Get an existing discovered host
+// @Tags discovery
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Discovered host ID"
+// @Success 200 {object} models.DiscoveredHost
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /discovered/{id} [get]
+func GetDiscoveredHost(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.DiscoveredHost
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// DeleteDiscoveredHost Remove an existing discovered host
+// @Summary Remove an existing discovered host, it is recorded again the next time it boots
+// @Tags discovery
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Discovered host ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /discovered/{id} [delete]
+func DeleteDiscoveredHost(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.DiscoveredHost
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// Delete it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+// ClaimDiscoveredHost Register a discovered host as an address of a group
+// @Summary Register a discovered host as an address of a group, the ip and hostname are assigned by the group when empty
+// @Tags discovery
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Discovered host ID"
+// @Param  item body models.DiscoveredHostClaimForm true "Claim the host into a group"
+// @Success 200 {object} models.Address
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /discovered/{id}/claim [post]
+func ClaimDiscoveredHost(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	var form models.DiscoveredHostClaimForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the discovered host
+	var discovered models.DiscoveredHost
+	if res := db.DB.First(&discovered, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	if discovered.AddressID.Valid {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the host has already been claimed")) // 400
+		return
+	}
+
+	item := models.Address{
+		AddressForm: models.AddressForm{
+			IP:       form.IP,
+			Mac:      discovered.Mac,
+			Hostname: form.Hostname,
+			Domain:   form.Domain,
+			Reimage:  form.Reimage,
+		},
+	}
+	item.GroupID.Int32, item.GroupID.Valid = int32(form.GroupID), true
+
+	if !inScope(c, item.GroupID) {
+		return
+	}
+
+	models.AllocationMu.Lock()
+	defer models.AllocationMu.Unlock()
+
+	status := http.StatusInternalServerError
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		// the dynamic lease of the host is replaced by the registered address
+		if res := tx.Where("mac = ? AND group_id IS NULL", discovered.Mac).Delete(&models.Address{}); res.Error != nil {
+			return res.Error
+		}
+
+		if err := validateAddress(tx, &item); err != nil {
+			status = http.StatusBadRequest
+			return err
+		}
+
+		if res := tx.Create(&item); res.Error != nil {
+			return res.Error
+		}
+
+		discovered.AddressID.Int32, discovered.AddressID.Valid = int32(item.ID), true
+		return tx.Save(&discovered).Error
+	})
+	if err != nil {
+		Error(c, status, err)
+		return
+	}
+
+	// Load a new version with relations
+	if res := db.DB.Preload("Pool").First(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+
+	logrus.WithFields(logrus.Fields{
+		"id":       item.ID,
+		"mac":      item.Mac,
+		"ip":       item.IP,
+		"hostname": item.Hostname,
+		"group":    form.GroupID,
+	}).Info("discovery")
+}
+
+// DiscoveryKs serves the discovery kickstart to an unregistered host
+func DiscoveryKs(c *gin.Context) {
+	host, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
+
+	var item models.DiscoveredHost
+	if res := db.DB.Where("ip = ?", host).First(&item); res.Error != nil {
+		Error(c, http.StatusNotFound, fmt.Errorf("the host has not been discovered")) // 404
+		return
+	}
+
+	laddrport, _ := c.Request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	var ks bytes.Buffer
+	if err := discoveryks.Execute(&ks, map[string]interface{}{
+		"mac":        item.Mac,
+		"via_server": laddrport,
+	}); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", ks.Bytes())
+
+	logrus.WithFields(logrus.Fields{
+		"id":  item.ID,
+		"ip":  item.IP,
+		"mac": item.Mac,
+	}).Info("served discovery ks.cfg file")
+}
+
+// DiscoveryFacts stores the hardware details posted by a host booted into discovery, the host is identified by its address
+func DiscoveryFacts(c *gin.Context) {
+	host, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
+
+	var facts models.DiscoveryFacts
+	if err := c.ShouldBindJSON(&facts); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	var item models.DiscoveredHost
+	if res := db.DB.Where("ip = ?", host).First(&item); res.Error != nil {
+		Error(c, http.StatusNotFound, fmt.Errorf("the host has not been discovered")) // 404
+		return
+	}
+
+	raw, err := json.Marshal(facts)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	now := time.Now()
+	item.Facts = datatypes.JSON(raw)
+	item.FactsAt = &now
+	if res := db.DB.Save(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	// the facts are not authenticated, so a serial of a registered host is only pointed out to the operator, who can
+	// change the mac of the host after a nic has been replaced
+	if facts.Serial != "" {
+		var registered []models.Address
+		db.DB.Where("serial = ? AND mac <> ?", facts.Serial, item.Mac).Find(&registered)
+		for _, v := range registered {
+			logrus.WithFields(logrus.Fields{
+				"id":     item.ID,
+				"mac":    item.Mac,
+				"serial": facts.Serial,
+				"host":   v.ID,
+			}).Warn("discovery: the reported serial is registered to another host, update its mac if it is the same host")
+		}
+	}
+
+	// rules on the hardware can only match now that the facts are known
+	if !item.AddressID.Valid {
+		if err := assignDiscoveredHost(&item, auditActor(c)); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"id":  item.ID,
+				"mac": item.Mac,
+				"err": err,
+			}).Warn("discovery")
+		}
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+
+	logrus.WithFields(logrus.Fields{
+		"id":     item.ID,
+		"mac":    item.Mac,
+		"serial": facts.Serial,
+		"model":  facts.Model,
+	}).Info("discovery")
+}
+
+// assignDiscoveredHost registers the lease of a discovered host to the group of the first matching rule, which is
+// recorded in the audit log as done by the actor
+func assignDiscoveredHost(item *models.DiscoveredHost, actor models.AuditEntry) error {
+	var rule *models.GroupRule
+	var address models.Address
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var leases []models.Address
+		if res := tx.Where("mac = ? AND group_id IS NULL", item.Mac).Order("last_seen desc").Limit(1).Find(&leases); res.Error != nil {
+			return res.Error
+		}
+
+		// without a lease, the address is assigned by the pool of the group
+		address = models.Address{AddressForm: models.AddressForm{Mac: item.Mac, Hostname: "-"}}
+		if len(leases) > 0 {
+			address = leases[0]
+		}
+
+		var err error
+		rule, err = AssignGroupRules(tx, &address, *item)
+		if err != nil || rule == nil {
+			return err
+		}
+
+		if res := tx.Save(&address); res.Error != nil {
+			return res.Error
+		}
+
+		item.AddressID.Int32, item.AddressID.Valid = int32(address.ID), true
+		return tx.Save(item).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if rule != nil {
+		AuditGroupRule(actor, rule, address)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ListGroupRules Get a list of all group rules
+// @Summary Get all group rules in the order they are evaluated
+// @Tags group_rules
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.GroupRule
+// @Failure 500 {object} models.APIError
+// @Router /group_rules [get]
+func ListGroupRules(c *gin.Context) {
+	var items []models.GroupRule
+	if res := db.DB.Order("priority").Order("id").Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetGroupRule Get an existing group rule
+// @Summary Get an existing group rule
+// @Tags group_rules
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Group rule ID"
+// @Success 200 {object} models.GroupRule
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /group_rules/{id} [get]
+func GetGroupRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.GroupRule
+	if res := db.DB.Preload("Group").First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CreateGroupRule Create a new group rule
+// @Summary Create a new group rule
+// @Tags group_rules
+// @Accept  json
+// @Produce  json
+// @Param item body models.GroupRuleForm true "Add a group rule"
+// @Success 200 {object} models.GroupRule
+// @Failure 400 {object} models.APIError
+// @Router /group_rules [post]
+func CreateGroupRule(c *gin.Context) {
+	var form models.GroupRuleForm
+
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	if res := db.DB.First(&models.Group{}, form.GroupID); res.Error != nil {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the group of the rule could not be found")) // 400
+		return
+	}
+
+	item := models.GroupRule{GroupRuleForm: form}
+
+	if res := db.DB.Create(&item); res.Error != nil {
+		Error(c, http.StatusBadRequest, res.Error) // 400
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// UpdateGroupRule Update an existing group rule
+// @Summary Update the fields of an existing group rule that are sent, a criteria, the hostname_pattern or reimage is cleared by sending an empty value
+// @Tags group_rules
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Group rule ID"
+// @Param  item body models.GroupRuleForm true "Update a group rule"
+// @Success 200 {object} models.GroupRule
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /group_rules/{id} [patch]
+func UpdateGroupRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.GroupRule
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// only the fields that were sent are decoded onto the rule, so empty and false values clear a field instead of
+	// being skipped like by mergo, and the fields that were not sent are kept
+	if err := c.ShouldBindBodyWith(&item.GroupRuleForm, binding.JSON); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	if res := db.DB.First(&models.Group{}, item.GroupID); res.Error != nil {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the group of the rule could not be found")) // 400
+		return
+	}
+
+	// Save it
+	if res := db.DB.Save(&item); res.Error != nil {
+		Error(c, http.StatusBadRequest, res.Error) // 400
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// DeleteGroupRule Remove an existing group rule
+// @Summary Remove an existing group rule
+// @Tags group_rules
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Group rule ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /group_rules/{id} [delete]
+func DeleteGroupRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.GroupRule
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// Delete it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+// AssignGroupRules registers an address of a discovered host to the group of the first matching rule. The address is
+// only changed when a rule matches and the address is valid in the group, nil is returned when no rule matched.
+func AssignGroupRules(tx *gorm.DB, item *models.Address, host models.DiscoveredHost) (*models.GroupRule, error) {
+	var rules []models.GroupRule
+	if res := tx.Order("priority").Order("id").Find(&rules); res.Error != nil {
+		return nil, res.Error
+	}
+
+	for _, rule := range rules {
+		if !rule.Matches(host) {
+			continue
+		}
+
+		address := *item
+		address.GroupID.Int32, address.GroupID.Valid = int32(rule.GroupID), true
+		address.Reimage = rule.Reimage
+
+		// the hostname is generated by the pattern of the rule, or the group in validateAddress
+		address.Hostname = ""
+		if rule.HostnamePattern != "" {
+			if res := tx.First(&address.Group, rule.GroupID); res.Error != nil {
+				return nil, fmt.Errorf("the group of rule %s could not be found", rule.Name)
+			}
+			if address.PoolID.Valid {
+				tx.First(&address.Pool, address.PoolID.Int32)
+			}
+			hostname, err := generateHostname(tx, address, rule.HostnamePattern)
+			if err != nil {
+				return nil, err
+			}
+			address.Hostname = hostname
+			address.Pool, address.Group = models.Pool{}, models.Group{}
+		}
+
+		if err := validateAddress(tx, &address); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+
+		// keep the hostname the client sent when neither the rule nor the group has a pattern
+		if address.Hostname == "" {
+			address.Hostname = item.Hostname
+		}
+		*item = address
+
+		logrus.WithFields(logrus.Fields{
+			"rule":     rule.Name,
+			"mac":      item.Mac,
+			"ip":       item.IP,
+			"hostname": item.Hostname,
+			"group":    rule.GroupID,
+		}).Info("discovery")
+
+		return &rule, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+)
+
+func TestUpdateGroupRule(t *testing.T) {
+	testDB(t, &models.Group{}, &models.GroupRule{})
+	gin.SetMode(gin.TestMode)
+
+	group := models.Group{GroupForm: models.GroupForm{Name: "esx"}}
+	if res := db.DB.Create(&group); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	rule := models.GroupRule{GroupRuleForm: models.GroupRuleForm{Name: "dell", Priority: 10, SerialPrefix: "SN", GroupID: group.ID, HostnamePattern: "esx-{seq}", Reimage: true}}
+	if res := db.DB.Create(&rule); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	r := gin.New()
+	r.PATCH("/v1/group_rules/:id", UpdateGroupRule)
+	patch := func(body string, want int) models.GroupRule {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPatch, "/v1/group_rules/"+strconv.Itoa(rule.ID), bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("%s: got %d %s, want %d", body, w.Code, w.Body.String(), want)
+		}
+
+		var item models.GroupRule
+		if res := db.DB.First(&item, rule.ID); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		return item
+	}
+
+	// the fields that are not sent are kept
+	if item := patch(`{"priority": 5}`, http.StatusOK); item.Priority != 5 || item.Name != "dell" || item.SerialPrefix != "SN" || item.HostnamePattern != "esx-{seq}" || !item.Reimage {
+		t.Errorf("got %+v, want only the priority changed", item.GroupRuleForm)
+	}
+
+	// empty and false values clear the fields
+	if item := patch(`{"hostname_pattern": "", "reimage": false}`, http.StatusOK); item.HostnamePattern != "" || item.Reimage || item.Priority != 5 {
+		t.Errorf("got %+v, want the hostname pattern and reimage cleared", item.GroupRuleForm)
+	}
+
+	// a rule needs a criteria and an existing group
+	patch(`{"serial_prefix": ""}`, http.StatusBadRequest)
+	if item := patch(`{"group_id": 99}`, http.StatusBadRequest); item.GroupID != group.ID {
+		t.Errorf("got group %d, want %d", item.GroupID, group.ID)
+	}
+}
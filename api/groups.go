@@ -90,6 +90,31 @@ func CreateGroup(key string) func(c *gin.Context) {
 
 		item := models.Group{GroupForm: form}
 
+		// a template id of 0 means the group has no template
+		if item.TemplateID.Valid && item.TemplateID.Int32 == 0 {
+			item.TemplateID = models.NullInt32{}
+		}
+		if err := validateTemplateID(db.DB, item.TemplateID); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// reject a custom kickstart that would fail when hosts are installed
+		if err := validateKs(item.Ks); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		if err := validateAttributes(item.Attributes); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		if err := models.ValidateHostnamePattern(item.HostnamePattern); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
 		//remove whitespaces surrounding comma kickstart file breaks otherwise
 		item.DNS = strings.Join(strings.Fields(item.DNS), "")
 		item.NTP = strings.Join(strings.Fields(item.NTP), "")
@@ -100,7 +125,12 @@ func CreateGroup(key string) func(c *gin.Context) {
 			Error(c, http.StatusBadRequest, err) // 400
 			return
 		}
-		item.Password = secrets.Encrypt(item.Password, key)
+		password, err := secrets.Encrypt(item.Password, key)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+		item.Password = password
 
 		if res := db.DB.Create(&item); res.Error != nil {
 			Error(c, http.StatusInternalServerError, res.Error) // 500
@@ -152,6 +182,22 @@ func UpdateGroup(key string) func(c *gin.Context) {
 			return
 		}
 
+		// reject a custom kickstart that would fail when hosts are installed
+		if err := validateKs(form.Ks); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		if err := validateAttributes(form.Attributes); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		if err := models.ValidateHostnamePattern(form.HostnamePattern); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
 		// Load the item
 		var item models.Group
 		if res := db.DB.First(&item, id); res.Error != nil {
@@ -181,7 +227,12 @@ func UpdateGroup(key string) func(c *gin.Context) {
 				return
 			}
 
-			item.Password = secrets.Encrypt(item.Password, key)
+			password, err := secrets.Encrypt(item.Password, key)
+			if err != nil {
+				Error(c, http.StatusInternalServerError, err) // 500
+				return
+			}
+			item.Password = password
 		}
 
 		//mergo wont overwrite values with empty space. To enable removal of ntp, dns, syslog, vlan, always overwrite.
@@ -190,6 +241,20 @@ func UpdateGroup(key string) func(c *gin.Context) {
 		item.GroupForm.NTP = form.NTP
 		item.GroupForm.Syslog = form.Syslog
 		item.GroupForm.BootDisk = form.BootDisk
+		item.GroupForm.Attributes = form.Attributes
+		item.GroupForm.HostnamePattern = form.HostnamePattern
+
+		// a template id of 0 removes the template, and the version is always set together with the template
+		if form.TemplateID.Valid {
+			item.GroupForm.TemplateVersion = form.TemplateVersion
+			if form.TemplateID.Int32 == 0 {
+				item.GroupForm.TemplateID = models.NullInt32{}
+			}
+		}
+		if err := validateTemplateID(db.DB, item.TemplateID); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
 
 		// Save it
 		if res := db.DB.Preload("Pool").Save(&item); res.Error != nil {
@@ -226,7 +291,7 @@ func DeleteGroup(c *gin.Context) {
 
 	// Load the item
 	var item models.Group
-	if res := db.DB.Preload("Address").First(&item, id); res.Error != nil {
+	if res := db.DB.First(&item, id); res.Error != nil {
 		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
 			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
 		} else {
@@ -235,18 +300,52 @@ func DeleteGroup(c *gin.Context) {
 		return
 	}
 
-	// check if the group is empty, if it's not, deny the delete.
-	if len(item.Address) < 1 {
-		// Delete it
-		if res := db.DB.Delete(&item); res.Error != nil {
-			Error(c, http.StatusInternalServerError, res.Error) // 500
-			return
-		}
-		c.JSON(http.StatusNoContent, gin.H{}) //204
-	} else {
-		c.JSON(http.StatusConflict, "the group is not empty, please delete all hosts first.")
+	conflict, err := groupInUse(db.DB, item.ID)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+	if conflict != "" {
+		c.JSON(http.StatusConflict, conflict)
+		return
+	}
+
+	// Delete it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+// groupInUse returns why the group can't be deleted, while rules, accounts or hosts would be left without it
+func groupInUse(tx *gorm.DB, id int) (string, error) {
+	// rules would assign hosts to a group that no longer exists
+	var rules int64
+	if res := tx.Model(&models.GroupRule{}).Where("group_id = ?", id).Count(&rules); res.Error != nil {
+		return "", res.Error
+	}
+	if rules > 0 {
+		return "the group is used by group rules, please delete them first.", nil
+	}
+
+	var accounts int64
+	if res := tx.Model(&models.Account{}).Where("group_id = ?", id).Count(&accounts); res.Error != nil {
+		return "", res.Error
+	}
+	if accounts > 0 {
+		return "the group has accounts, please delete them first.", nil
+	}
+
+	var addresses int64
+	if res := tx.Model(&models.Address{}).Where("group_id = ?", id).Count(&addresses); res.Error != nil {
+		return "", res.Error
+	}
+	if addresses > 0 {
+		return "the group is not empty, please delete all hosts first.", nil
 	}
 
+	return "", nil
 }
 
 func verifyPassword(s string) error {
@@ -1,22 +1,27 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"text/template"
+	"time"
 
 	"encoding/base64"
 
 	"github.com/gin-gonic/gin"
 	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/metrics"
 	"github.com/maxiepax/go-via/models"
-	"github.com/maxiepax/go-via/secrets"
 	"github.com/sirupsen/logrus"
-	"gorm.io/gorm/clause"
 )
 
+// defaultTemplateName is the name of the template used when neither the host nor the group have a kickstart
+const defaultTemplateName = "default"
+
 var defaultks = `
 # Accept the VMware End User License Agreement
 vmaccepteula
@@ -44,19 +49,17 @@ reboot
 //func Ks(c *gin.Context) {
 func Ks(key string) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		var item models.Address
 		host, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
 
-		if res := db.DB.Preload(clause.Associations).Where("ip = ?", host).First(&item); res.Error != nil {
-			Error(c, http.StatusInternalServerError, res.Error) // 500
-			return
-		}
-
-		options := models.GroupOptions{}
-		json.Unmarshal(item.Group.Options, &options)
-
-		if reimage := db.DB.Model(&item).Where("ip = ?", host).Update("reimage", false); reimage.Error != nil {
-			Error(c, http.StatusInternalServerError, reimage.Error) // 500
+		// the host is identified by the one-time token in the kickstart url of its boot.cfg
+		item, err := ksTokenAddress(c.Query("token"))
+		if err != nil {
+			auditKsToken(c, host, item, err)
+			if errors.Is(err, errInvalidKsToken) {
+				Error(c, http.StatusForbidden, err) // 403
+			} else {
+				Error(c, http.StatusInternalServerError, err) // 500
+			}
 			return
 		}
 
@@ -67,58 +70,50 @@ func Ks(key string) func(c *gin.Context) {
 			}).Debug("ks")
 		}
 
-		logrus.Info("Disabling re-imaging for host to avoid re-install looping")
-
-		//convert netmask from bit to long format.
-		nm := net.CIDRMask(item.Pool.Netmask, 32)
-		netmask := ipv4MaskString(nm)
-
-		//decrypt the password
-		decryptedPassword := secrets.Decrypt(item.Group.Password, key)
-
-		//cleanup data to allow easier custom templating
-		data := map[string]interface{}{
-			"password":   decryptedPassword,
-			"ip":         item.IP,
-			"mac":        item.Mac,
-			"gateway":    item.Pool.Gateway,
-			"dns":        item.Group.DNS,
-			"hostname":   item.Hostname,
-			"netmask":    netmask,
-			"via_server": laddrport,
-			"erasedisks": options.EraseDisks,
-			"bootdisk":   item.Group.BootDisk,
-			"vlan":       item.Group.Vlan,
-			"createvmfs": options.CreateVMFS,
-		}
-
-		ks := defaultks
-
-		// check if default ks has been overridden.
-		if item.Ks != "" {
-			dec, _ := base64.StdEncoding.DecodeString(item.Ks)
-			ks = string(dec)
-			logrus.WithFields(logrus.Fields{
-				"custom host ks": ks,
-			}).Debug("ks")
-		} else if item.Group.Ks != "" {
-			dec, _ := base64.StdEncoding.DecodeString(item.Group.Ks)
-			ks = string(dec)
+		// the password of the group, or a new one for the host when the group has unique passwords
+		options := models.GroupOptions{}
+		json.Unmarshal(item.Group.Options, &options)
+		decryptedPassword, encryptedPassword, err := installRootPassword(item, options, key)
+		if err != nil {
 			logrus.WithFields(logrus.Fields{
-				"custom group ks": ks,
-			}).Debug("ks")
+				"id":    item.ID,
+				"group": item.Group.Name,
+				"err":   err,
+			}).Error("ks")
+			Error(c, http.StatusInternalServerError, fmt.Errorf("the root password of the host can't be determined")) // 500
+			return
 		}
 
-		t, err := template.New("").Parse(ks)
+		// render the whole kickstart before sending anything, so the host never receives a truncated file
+		data, err := kickstartData(item, decryptedPassword, laddrport)
+		var ks []byte
+		if err == nil {
+			ks, err = renderKickstart(item, data)
+		}
+		metrics.KickstartRenders.WithLabelValues(metrics.Result(err)).Inc()
 		if err != nil {
-			logrus.Info(err)
+			logrus.WithFields(logrus.Fields{
+				"id":   item.ID,
+				"ip":   item.IP,
+				"host": item.Hostname,
+				"err":  err,
+			}).Error("ks")
+			Error(c, http.StatusInternalServerError, err) // 500
 			return
 		}
-		err = t.Execute(c.Writer, data)
-		if err != nil {
-			logrus.Info(err)
+
+		// the token is used up together with the reimage flag, and the host is installed with the new root password
+		if reimage := db.DB.Model(&item).Updates(map[string]interface{}{"reimage": false, "ks_token_hash": "", "root_password": encryptedPassword}); reimage.Error != nil {
+			Error(c, http.StatusInternalServerError, reimage.Error) // 500
 			return
 		}
+		item.Reimage = false
+		item.KsTokenHash = ""
+		item.RootPassword = encryptedPassword
+
+		logrus.Info("Disabling re-imaging for host to avoid re-install looping")
+
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", ks)
 
 		logrus.Info("Served ks.cfg file")
 		logrus.WithFields(logrus.Fields{
@@ -142,6 +137,195 @@ func Ks(key string) func(c *gin.Context) {
 	}
 }
 
+// kickstartData returns the variables available to kickstart templates for an address. Besides the flat values,
+// the full address, group, pool and image are available, and attributes of the group overridden by the host.
+func kickstartData(item models.Address, password string, viaServer net.Addr) (map[string]interface{}, error) {
+	options := models.GroupOptions{}
+	json.Unmarshal(item.Group.Options, &options)
+
+	attributes, err := item.EffectiveAttributes()
+	if err != nil {
+		return nil, fmt.Errorf("invalid attributes: %w", err)
+	}
+
+	var image models.Image
+	if item.Group.ImageID != 0 {
+		db.DB.First(&image, item.Group.ImageID)
+	}
+
+	//convert netmask from bit to long format.
+	nm := net.CIDRMask(item.Pool.Netmask, 32)
+	netmask := ipv4MaskString(nm)
+
+	// never expose the encrypted passwords or the hash of the ks token, the decrypted password is passed separately
+	item.Group.Password = ""
+	item.RootPassword = ""
+	item.KsTokenHash = ""
+
+	//cleanup data to allow easier custom templating
+	return map[string]interface{}{
+		"password":      password,
+		"ip":            item.IP,
+		"mac":           item.DeviceMac(),
+		"gateway":       item.Pool.Gateway,
+		"dns":           item.Group.DNS,
+		"hostname":      item.Hostname,
+		"domain":        item.Domain,
+		"netmask":       netmask,
+		"via_server":    viaServer,
+		"erasedisks":    options.EraseDisks,
+		"bootdisk":      item.Group.BootDisk,
+		"vlan":          item.Group.Vlan,
+		"createvmfs":    options.CreateVMFS,
+		"ntp":           item.Group.NTP,
+		"syslog":        item.Group.Syslog,
+		"secondary_ips": splitList(",", item.SecondaryIPs),
+		"attributes":    attributes,
+		"address":       item,
+		"group":         item.Group,
+		"pool":          item.Pool,
+		"image":         image,
+	}, nil
+}
+
+// renderKickstart renders the kickstart of an address into memory
+func renderKickstart(item models.Address, data map[string]interface{}) ([]byte, error) {
+	t, err := kickstartTemplate(item)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// kickstartTemplate returns the kickstart to render for an address, with all snippets of the template library available to it.
+// A template or custom ks on the address takes precedence over the group, and the default template is used when neither have one.
+// A pinned version of a template includes the snippets as they were when the version was saved.
+func kickstartTemplate(item models.Address) (*template.Template, error) {
+	var ks string
+	var pinned time.Time
+	var err error
+
+	switch {
+	case item.TemplateID.Valid:
+		ks, pinned, err = pinnedTemplate(int(item.TemplateID.Int32), item.TemplateVersion)
+		logrus.WithFields(logrus.Fields{
+			"host template": item.TemplateID.Int32,
+			"version":       item.TemplateVersion,
+		}).Debug("ks")
+	case item.Ks != "":
+		dec, _ := base64.StdEncoding.DecodeString(item.Ks)
+		ks = string(dec)
+		logrus.WithFields(logrus.Fields{
+			"custom host ks": ks,
+		}).Debug("ks")
+	case item.Group.TemplateID.Valid:
+		ks, pinned, err = pinnedTemplate(int(item.Group.TemplateID.Int32), item.Group.TemplateVersion)
+		logrus.WithFields(logrus.Fields{
+			"group template": item.Group.TemplateID.Int32,
+			"version":        item.Group.TemplateVersion,
+		}).Debug("ks")
+	case item.Group.Ks != "":
+		dec, _ := base64.StdEncoding.DecodeString(item.Group.Ks)
+		ks = string(dec)
+		logrus.WithFields(logrus.Fields{
+			"custom group ks": ks,
+		}).Debug("ks")
+	default:
+		ks = defaultKickstart()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKickstart(ks, pinned)
+}
+
+// parseKickstart parses a kickstart with all snippets of the template library available to it, as they were at the
+// time a pinned version was saved or the latest versions when the time is zero. A snippet that can't be parsed only
+// fails the kickstarts that include it.
+func parseKickstart(ks string, pinned time.Time) (*template.Template, error) {
+	t := template.New("ks").Funcs(kickstartFuncs)
+
+	// make all snippets available to be included in the kickstart
+	var snippets []models.Template
+	if res := db.DB.Where("snippet").Find(&snippets); res.Error != nil {
+		return nil, res.Error
+	}
+	for _, v := range snippets {
+		content, ok, err := snippetContent(v.ID, pinned)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if _, err := t.New(v.Name).Parse(content); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"snippet": v.Name,
+				"err":     err,
+			}).Warn("ks: the snippet can't be parsed")
+		}
+	}
+
+	return t.Parse(ks)
+}
+
+// snippetContent returns the latest content of a snippet saved before the time, ok is false if the snippet didn't
+// exist yet. The zero time is the latest version.
+func snippetContent(id int, pinned time.Time) (string, bool, error) {
+	if pinned.IsZero() {
+		content, err := templateContent(id, 0)
+		return content, err == nil, err
+	}
+
+	var versions []models.TemplateVersion
+	if res := db.DB.Where("template_id = ? AND created_at <= ?", id, pinned).Order("version desc").Limit(1).Find(&versions); res.Error != nil {
+		return "", false, res.Error
+	}
+	if len(versions) == 0 {
+		return "", false, nil
+	}
+	return versions[0].Content, true, nil
+}
+
+// templateContent returns the content of a version of a template, version 0 is the latest version
+func templateContent(id int, version int) (string, error) {
+	content, _, err := pinnedTemplate(id, version)
+	return content, err
+}
+
+// pinnedTemplate returns the content of a version of a template and when it was saved, to include the snippets as they
+// were at that time. Version 0 is the latest version, which includes the latest snippets and returns the zero time.
+func pinnedTemplate(id int, version int) (string, time.Time, error) {
+	item, err := findTemplateVersion(id, version)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("could not load version %d of template %d: %w", version, id, err)
+	}
+	if version == 0 {
+		return item.Content, time.Time{}, nil
+	}
+
+	return item.Content, item.CreatedAt, nil
+}
+
+// defaultKickstart returns the latest version of the default template, or the built-in kickstart if it has been removed
+func defaultKickstart() string {
+	var item models.Template
+	if res := db.DB.Where("name = ?", defaultTemplateName).First(&item); res.Error == nil {
+		if ks, err := templateContent(item.ID, 0); err == nil {
+			return ks
+		}
+	}
+
+	return defaultks
+}
+
 func ipv4MaskString(m []byte) string {
 	if len(m) != 4 {
 		panic("ipv4Mask: len must be 4 bytes")
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// kickstartFuncs are the helper functions available to kickstart templates and snippets
+var kickstartFuncs = template.FuncMap{
+	// strings
+	"split":     splitList,
+	"join":      join,
+	"trim":      strings.TrimSpace,
+	"upper":     strings.ToUpper,
+	"lower":     strings.ToLower,
+	"replace":   func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"contains":  func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix": func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix": func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"quote":     strconv.Quote,
+	"default":   defaultValue,
+	"empty":     empty,
+	"list":      func(v ...interface{}) []interface{} { return v },
+
+	// networking
+	"cidrhost":    cidrHost,
+	"cidrnetmask": cidrNetmask,
+	"cidrprefix":  cidrPrefix,
+
+	// kickstart sections
+	"pre":       section("%pre"),
+	"post":      section("%post"),
+	"firstboot": section("%firstboot"),
+
+	// esxcli commands
+	"ntp":       ntpCommands,
+	"syslog":    syslogCommands,
+	"vswitch":   vswitchCommands,
+	"portgroup": portgroupCommands,
+}
+
+// splitList splits a separated list and removes surrounding whitespace and empty values
+func splitList(sep, s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, sep) {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func join(sep string, v interface{}) string {
+	return strings.Join(toStrings(v), sep)
+}
+
+// defaultValue returns the given value, or def if the value is empty. Use as {{ .vlan | default "0" }}
+func defaultValue(def interface{}, given ...interface{}) interface{} {
+	if len(given) == 0 || empty(given[0]) {
+		return def
+	}
+	return given[0]
+}
+
+func empty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return rv.IsZero()
+}
+
+// toStrings flattens strings, comma separated lists and slices into a list of strings
+func toStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return splitList(",", v)
+	case []string:
+		return v
+	case []interface{}:
+		var list []string
+		for _, i := range v {
+			list = append(list, toStrings(i)...)
+		}
+		return list
+	}
+	return []string{fmt.Sprint(v)}
+}
+
+// cidrHost returns the address of host number n in a network, e.g. {{ cidrhost "192.168.1.0/24" 10 }} is 192.168.1.10
+func cidrHost(cidr string, n int) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	if network.IP.To4() == nil {
+		return "", fmt.Errorf("cidrhost: %s is not an ipv4 network", cidr)
+	}
+
+	ones, bits := network.Mask.Size()
+	size := uint64(1) << uint(bits-ones)
+	if n < 0 {
+		n += int(size)
+	}
+	if n < 0 || uint64(n) >= size {
+		return "", fmt.Errorf("cidrhost: %s has no host number %d", cidr, n)
+	}
+
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(network.IP.To4())+uint32(n))
+	return ip.String(), nil
+}
+
+// cidrNetmask returns the netmask of a network in dotted format, e.g. 255.255.255.0
+func cidrNetmask(cidr string) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	return net.IP(network.Mask).String(), nil
+}
+
+func cidrPrefix(cidr string) (int, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0, err
+	}
+	ones, _ := network.Mask.Size()
+	return ones, nil
+}
+
+// section returns a builder for a kickstart section that runs the given commands with busybox,
+// e.g. {{ firstboot (ntp .ntp) (syslog .syslog) }}
+func section(name string) func(commands ...interface{}) string {
+	return func(commands ...interface{}) string {
+		var b strings.Builder
+		b.WriteString(name + " --interpreter=busybox\n")
+		for _, v := range commands {
+			for _, cmd := range toLines(v) {
+				b.WriteString(cmd + "\n")
+			}
+		}
+		return b.String()
+	}
+}
+
+// toLines flattens the output of the command helpers, single strings are used as is
+func toLines(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		var lines []string
+		for _, i := range v {
+			lines = append(lines, toLines(i)...)
+		}
+		return lines
+	}
+	return []string{fmt.Sprint(v)}
+}
+
+// ntpCommands configures and starts the ntp service with a comma separated list or slice of servers
+func ntpCommands(servers interface{}) []string {
+	list := toStrings(servers)
+	if len(list) == 0 {
+		return nil
+	}
+
+	cmd := "esxcli system ntp set --enabled=true"
+	for _, v := range list {
+		cmd += " --server=" + v
+	}
+	return []string{
+		cmd,
+		"esxcli network firewall ruleset set --ruleset-id=ntpClient --enabled=true",
+	}
+}
+
+// syslogCommands forwards logs to a comma separated list or slice of syslog servers, e.g. udp://192.168.1.5:514
+func syslogCommands(hosts interface{}) []string {
+	list := toStrings(hosts)
+	if len(list) == 0 {
+		return nil
+	}
+
+	return []string{
+		fmt.Sprintf("esxcli system syslog config set --loghost='%s'", strings.Join(list, ",")),
+		"esxcli system syslog reload",
+		"esxcli network firewall ruleset set --ruleset-id=syslog --enabled=true",
+		"esxcli network firewall refresh",
+	}
+}
+
+// vswitchCommands creates a standard vswitch with the given uplinks, a mtu of 0 keeps the default
+func vswitchCommands(name string, uplinks interface{}, mtu int) []string {
+	cmds := []string{fmt.Sprintf("esxcli network vswitch standard add --vswitch-name=%s", name)}
+	for _, v := range toStrings(uplinks) {
+		cmds = append(cmds, fmt.Sprintf("esxcli network vswitch standard uplink add --uplink-name=%s --vswitch-name=%s", v, name))
+	}
+	if mtu > 0 {
+		cmds = append(cmds, fmt.Sprintf("esxcli network vswitch standard set --mtu=%d --vswitch-name=%s", mtu, name))
+	}
+	return cmds
+}
+
+// portgroupCommands adds a portgroup to a standard vswitch, a vlan of 0 is untagged
+func portgroupCommands(name string, vswitch string, vlan int) []string {
+	return []string{
+		fmt.Sprintf("esxcli network vswitch standard portgroup add --portgroup-name='%s' --vswitch-name=%s", name, vswitch),
+		fmt.Sprintf("esxcli network vswitch standard portgroup set --portgroup-name='%s' --vlan-id=%d", name, vlan),
+	}
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errInvalidKickstart is returned when a kickstart fails the lint checks at save time
+var errInvalidKickstart = errors.New("invalid kickstart")
+
+// requiredDirectives are the commands every ESXi kickstart needs to install unattended, one of the alternatives of each
+var requiredDirectives = [][]string{
+	{"vmaccepteula"},
+	{"rootpw"},
+	{"install", "upgrade", "installorupgrade"},
+	{"network"},
+}
+
+// sampleAddress is used to render kickstarts that are not yet assigned to a host
+var sampleAddress = models.Address{
+	AddressForm: models.AddressForm{
+		IP:       "192.168.1.10",
+		Mac:      "00:50:56:00:00:01",
+		Hostname: "esxi01",
+		Domain:   "example.com",
+
+		SecondaryIPs: "192.168.2.10",
+	},
+	Pool: models.Pool{
+		PoolForm: models.PoolForm{
+			Netmask: 24,
+			Gateway: "192.168.1.1",
+		},
+	},
+	Group: models.Group{
+		GroupForm: models.GroupForm{
+			DNS:      "192.168.1.2",
+			BootDisk: "t10.ATA_sample",
+			Vlan:     "100",
+			NTP:      "192.168.1.3",
+			Syslog:   "udp://192.168.1.4:514",
+		},
+	},
+}
+
+// PreviewKs Render the kickstart of a host
+// @Summary Render the kickstart of a host without marking it as re-imaged, the root password is masked
+// @Tags addresses
+// @Produce  plain
+// @Param  id path int true "Address ID"
+// @Success 200 {string} string
+// @Failure 400 {object} models.APIError
+// @Failure 403 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /addresses/{id}/ks/preview [get]
+func PreviewKs(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Address
+	if res := db.DB.Preload(clause.Associations).First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// the kickstart holds the network and attributes of the host, operators may only see the hosts of their group
+	if !inScope(c, item.GroupID) {
+		return
+	}
+
+	laddrport, _ := c.Request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	data, err := kickstartData(item, "********", laddrport)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	ks, err := renderKickstart(item, data)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", ks)
+}
+
+// LintKs Check a kickstart for errors
+// @Summary Check that a kickstart parses, only uses known variables and contains the required ESXi directives
+// @Tags ks
+// @Accept  json
+// @Produce  json
+// @Param item body models.KickstartLintForm true "Kickstart to check"
+// @Success 200 {object} models.KickstartLintResult
+// @Failure 400 {object} models.APIError
+// @Router /ks/lint [post]
+func LintKs(c *gin.Context) {
+	var form models.KickstartLintForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	ks := form.Content
+	if form.Ks != "" {
+		dec, err := base64.StdEncoding.DecodeString(form.Ks)
+		if err != nil {
+			Error(c, http.StatusBadRequest, fmt.Errorf("the ks is not valid base64: %w", err)) // 400
+			return
+		}
+		ks = string(dec)
+	}
+	if ks == "" {
+		Error(c, http.StatusBadRequest, fmt.Errorf("either ks or content is required")) // 400
+		return
+	}
+
+	problems := lintKickstart(ks)
+	c.JSON(http.StatusOK, models.KickstartLintResult{
+		Valid:  len(problems) == 0,
+		Errors: problems,
+	}) // 200
+}
+
+// lintKickstart returns the problems found in a kickstart. It is rendered with sample data and fails on
+// variables that are not available to kickstarts, then checked for the directives ESXi requires.
+func lintKickstart(ks string) []string {
+	t, err := parseKickstart(ks, time.Time{})
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var problems []string
+
+	// directives are looked for in the rendered kickstart, or the source if it can't be rendered
+	rendered := ks
+	data, err := kickstartData(sampleAddress, "VMware1!", &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 8443})
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if data["attributes"], err = sampleAttributes(); err != nil {
+		return []string{err.Error()}
+	}
+
+	var buf bytes.Buffer
+	if err := t.Option("missingkey=error").Execute(&buf, data); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		rendered = buf.String()
+	}
+
+	for _, v := range requiredDirectives {
+		if !regexp.MustCompile(`(?m)^\s*(` + strings.Join(v, "|") + `)\b`).MatchString(rendered) {
+			problems = append(problems, fmt.Sprintf("missing required directive %s", strings.Join(v, " or ")))
+		}
+	}
+
+	return problems
+}
+
+// validateKs rejects a base64 encoded custom kickstart of a host or group that fails the lint checks
+func validateKs(ks string) error {
+	if ks == "" {
+		return nil
+	}
+
+	dec, err := base64.StdEncoding.DecodeString(ks)
+	if err != nil {
+		return fmt.Errorf("%w: the ks is not valid base64", errInvalidKickstart)
+	}
+
+	return validateTemplate(string(dec), false)
+}
+
+// validateTemplate rejects a kickstart that fails the lint checks, snippets are only parsed as they are rendered as part of other kickstarts
+func validateTemplate(content string, snippet bool) error {
+	if snippet {
+		if _, err := parseKickstart(content, time.Time{}); err != nil {
+			return fmt.Errorf("%w: %s", errInvalidKickstart, err)
+		}
+		return nil
+	}
+
+	if problems := lintKickstart(content); len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errInvalidKickstart, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
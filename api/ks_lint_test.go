@@ -0,0 +1,29 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/maxiepax/go-via/models"
+)
+
+func TestLintKickstartInstallDirective(t *testing.T) {
+	testDB(t, &models.Template{}, &models.TemplateVersion{}, &models.Attribute{})
+
+	for directive, valid := range map[string]bool{
+		"install --firstdisk --overwritevmfs":          true,
+		"upgrade --firstdisk":                          true,
+		"installorupgrade --firstdisk --overwritevmfs": true,
+		"# install --firstdisk":                        false,
+		"installer --firstdisk":                        false,
+	} {
+		ks := "vmaccepteula\nrootpw {{ .password }}\n" + directive + "\nnetwork --bootproto=dhcp\nreboot\n"
+		problems := lintKickstart(ks)
+		if valid && len(problems) > 0 {
+			t.Errorf("%q: got %v, want it valid", directive, problems)
+		}
+		if !valid && (len(problems) != 1 || !strings.Contains(problems[0], "install or upgrade or installorupgrade")) {
+			t.Errorf("%q: got %v, want the install directive missing", directive, problems)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+)
+
+// testTemplate stores a template with its versions, each saved a minute after the previous one from the time
+func testTemplate(t *testing.T, name string, snippet bool, saved time.Time, versions ...string) models.Template {
+	t.Helper()
+
+	item := models.Template{TemplateForm: models.TemplateForm{Name: name, Snippet: snippet}, LatestVersion: len(versions)}
+	if res := db.DB.Create(&item); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	for i, content := range versions {
+		v := models.TemplateVersion{TemplateID: item.ID, Version: i + 1, TemplateVersionForm: models.TemplateVersionForm{Content: content}, CreatedAt: saved.Add(time.Duration(i) * time.Minute)}
+		if res := db.DB.Create(&v); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+	return item
+}
+
+func TestKickstartPinnedSnippets(t *testing.T) {
+	testDB(t, &models.Template{}, &models.TemplateVersion{})
+
+	start := time.Now().Add(-time.Hour)
+	testTemplate(t, "network", true, start, "network A", "network B")
+	testTemplate(t, "broken", true, start, "{{ if }}")
+	base := testTemplate(t, "base", false, start.Add(30*time.Second), `{{ template "network" . }}`, `{{ template "network" . }}!`)
+
+	for _, tt := range []struct {
+		version int
+		want    string
+	}{
+		{1, "network A"},
+		{2, "network B!"},
+		{0, "network B!"},
+	} {
+		address := models.Address{}
+		address.TemplateID.Int32, address.TemplateID.Valid = int32(base.ID), true
+		address.TemplateVersion = tt.version
+
+		ks, err := renderKickstart(address, nil)
+		if err != nil {
+			t.Errorf("version %d: %v", tt.version, err)
+			continue
+		}
+		if string(ks) != tt.want {
+			t.Errorf("version %d: got %q, want %q", tt.version, ks, tt.want)
+		}
+	}
+}
+
+func TestDeleteIncludedSnippet(t *testing.T) {
+	testDB(t, &models.Template{}, &models.TemplateVersion{}, &models.Group{}, &models.Address{})
+	gin.SetMode(gin.TestMode)
+
+	start := time.Now().Add(-time.Hour)
+	network := testTemplate(t, "network", true, start, "network A")
+	unused := testTemplate(t, "unused", true, start, "unused")
+	// only an old version of the template includes the snippet
+	testTemplate(t, "base", false, start, `{{- template "network" . }}`, "no snippets")
+
+	r := gin.New()
+	r.DELETE("/v1/templates/:id", DeleteTemplate)
+
+	for id, want := range map[int]int{network.ID: http.StatusConflict, unused.ID: http.StatusNoContent} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/v1/templates/"+strconv.Itoa(id), nil))
+		if w.Code != want {
+			t.Errorf("delete %d: got %d %s, want %d", id, w.Code, w.Body.String(), want)
+		}
+	}
+}
+
+func TestUpdateTemplateSnippet(t *testing.T) {
+	testDB(t, &models.Template{}, &models.TemplateVersion{})
+	gin.SetMode(gin.TestMode)
+
+	item := testTemplate(t, "network", true, time.Now(), "network A")
+
+	r := gin.New()
+	r.PATCH("/v1/templates/:id", UpdateTemplate)
+	patch := func(body string) models.Template {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPatch, "/v1/templates/"+strconv.Itoa(item.ID), bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s", body, w.Code, w.Body.String())
+		}
+
+		var updated models.Template
+		if res := db.DB.First(&updated, item.ID); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		return updated
+	}
+
+	if updated := patch(`{"name": "network", "description": "vlan 100"}`); !updated.Snippet || !strings.Contains(updated.Description, "vlan") {
+		t.Errorf("a patch without snippet: got snippet %v, want it kept", updated.Snippet)
+	}
+	if updated := patch(`{"name": "network", "snippet": false}`); updated.Snippet {
+		t.Errorf("a patch with snippet false: got snippet %v", updated.Snippet)
+	}
+}
+
+func TestUpdateIncludedSnippet(t *testing.T) {
+	testDB(t, &models.Template{}, &models.TemplateVersion{}, &models.Group{}, &models.Address{})
+	gin.SetMode(gin.TestMode)
+
+	start := time.Now().Add(-time.Hour)
+	network := testTemplate(t, "network", true, start, "network A")
+	unused := testTemplate(t, "unused", true, start, "unused")
+	base := testTemplate(t, "base", false, start, `{{ template "network" . }}`)
+	group := models.Group{GroupForm: models.GroupForm{Name: "esx"}}
+	group.TemplateID.Int32, group.TemplateID.Valid = int32(base.ID), true
+	if res := db.DB.Create(&group); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	r := gin.New()
+	r.PATCH("/v1/templates/:id", UpdateTemplate)
+
+	for _, tt := range []struct {
+		id   int
+		body string
+		want int
+	}{
+		{network.ID, `{"name": "net"}`, http.StatusConflict},
+		{network.ID, `{"name": "network", "snippet": false}`, http.StatusConflict},
+		{network.ID, `{"name": "network", "description": "vlan 100"}`, http.StatusOK},
+		{unused.ID, `{"name": "unused2"}`, http.StatusOK},
+		// a template used by a group can't become a snippet
+		{base.ID, `{"name": "base", "snippet": true}`, http.StatusConflict},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPatch, "/v1/templates/"+strconv.Itoa(tt.id), bytes.NewBufferString(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%d %s: got %d %s, want %d", tt.id, tt.body, w.Code, w.Body.String(), tt.want)
+		}
+	}
+}
+
+func TestValidateTemplateID(t *testing.T) {
+	testDB(t, &models.Template{}, &models.TemplateVersion{})
+
+	start := time.Now()
+	snippet := testTemplate(t, "network", true, start, "network A")
+	base := testTemplate(t, "base", false, start, "vmaccepteula")
+
+	for id, valid := range map[models.NullInt32]bool{
+		{}: true,
+		{NullInt32: sql.NullInt32{Int32: int32(base.ID), Valid: true}}:    true,
+		{NullInt32: sql.NullInt32{Int32: int32(snippet.ID), Valid: true}}: false,
+		{NullInt32: sql.NullInt32{Int32: 99, Valid: true}}:                false,
+	} {
+		if err := validateTemplateID(db.DB, id); (err == nil) != valid {
+			t.Errorf("template %v: got %v, want valid %v", id.Int32, err, valid)
+		}
+	}
+}
+
+func TestKickstartDataSecrets(t *testing.T) {
+	testDB(t, &models.Image{})
+
+	item := models.Address{RootPassword: "0a1b2c3d:ciphertext", KsTokenHash: "hash"}
+	item.Group.Password = "0a1b2c3d:ciphertext"
+
+	data, err := kickstartData(item, "VMware1!", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := data["address"].(models.Address)
+	group := data["group"].(models.Group)
+	if address.RootPassword != "" || address.KsTokenHash != "" || group.Password != "" {
+		t.Errorf("got root password %q, ks token hash %q and group password %q, want them cleared", address.RootPassword, address.KsTokenHash, group.Password)
+	}
+	if data["password"] != "VMware1!" {
+		t.Errorf("got password %q", data["password"])
+	}
+}
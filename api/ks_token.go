@@ -0,0 +1,89 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errInvalidKsToken = errors.New("invalid kickstart token")
+
+// IssueKsToken creates a new one-time token that authorizes the host to fetch its kickstart, replacing any previous one.
+// Only the hash of the token is stored.
+func IssueKsToken(item *models.Address, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	item.KsTokenHash = hashToken(token)
+	item.KsTokenExpires = time.Now().Add(ttl)
+	if res := db.DB.Model(item).Updates(map[string]interface{}{"ks_token_hash": item.KsTokenHash, "ks_token_expires": item.KsTokenExpires}); res.Error != nil {
+		return "", res.Error
+	}
+
+	return token, nil
+}
+
+// ksTokenAddress returns the address a kickstart token was issued to
+func ksTokenAddress(token string) (models.Address, error) {
+	var item models.Address
+	if token == "" {
+		return item, fmt.Errorf("%w: no token was given", errInvalidKsToken)
+	}
+
+	if res := db.DB.Preload(clause.Associations).Where("ks_token_hash = ?", hashToken(token)).First(&item); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return item, fmt.Errorf("%w: unknown or already used token", errInvalidKsToken)
+		}
+		return item, res.Error
+	}
+
+	if time.Now().After(item.KsTokenExpires) {
+		return item, fmt.Errorf("%w: the token expired at %s", errInvalidKsToken, item.KsTokenExpires.Format(time.RFC3339))
+	}
+
+	return item, nil
+}
+
+// auditKsToken records a rejected kickstart request, e.g. with an expired or unknown token
+func auditKsToken(c *gin.Context, ip string, item models.Address, err error) {
+	logrus.WithFields(logrus.Fields{
+		"audit": "ks_token",
+		"ip":    ip,
+		"id":    item.ID,
+		"host":  item.Hostname,
+		"err":   err,
+	}).Warn("ks: rejected kickstart request")
+
+	status := http.StatusForbidden
+	if !errors.Is(err, errInvalidKsToken) {
+		status = http.StatusInternalServerError
+	}
+	recordAudit(models.AuditEntry{
+		IP:         ip,
+		Method:     c.Request.Method,
+		Path:       c.Request.URL.Path,
+		Action:     "ks_rejected",
+		Resource:   "addresses",
+		ResourceID: item.ID,
+		Status:     status,
+	})
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/maxiepax/go-via/config"
+	"github.com/maxiepax/go-via/models"
+)
+
+// ldapConn is the part of ldap.Conn used to authenticate
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// LDAP authenticates users with a bind to an LDAP or Active Directory server. The role of the user is mapped from its
+// groups, and the user is created or updated in the database at every login that isn't served from the cache.
+type LDAP struct {
+	conf config.Ldap
+	dial func() (ldapConn, error)
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]ldapBind
+}
+
+type ldapBind struct {
+	user    models.User
+	expires time.Time
+}
+
+func NewLDAP(conf config.Ldap) *LDAP {
+	l := &LDAP{
+		conf:  conf,
+		cache: make(map[[sha256.Size]byte]ldapBind),
+	}
+	l.dial = l.connect
+	return l
+}
+
+func (l *LDAP) Name() string {
+	return models.ProviderLDAP
+}
+
+func (l *LDAP) Authenticate(username, password string) (models.User, error) {
+	// an empty password is an unauthenticated bind, which most servers accept
+	if password == "" {
+		return models.User{}, errInvalidCredentials
+	}
+
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	if user, ok := l.cached(key); ok {
+		return user, nil
+	}
+
+	conn, err := l.dial()
+	if err != nil {
+		return models.User{}, err
+	}
+	defer conn.Close()
+
+	if l.conf.BindDN != "" {
+		if err := conn.Bind(l.conf.BindDN, l.conf.BindPassword); err != nil {
+			return models.User{}, fmt.Errorf("bind of the search account: %w", err)
+		}
+	}
+
+	req := ldap.NewSearchRequest(
+		l.conf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, l.conf.Timeout, false,
+		fmt.Sprintf(l.conf.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"mail", l.conf.GroupAttribute}, nil,
+	)
+	res, err := conn.Search(req)
+	if err != nil {
+		return models.User{}, err
+	}
+	if len(res.Entries) == 0 {
+		return models.User{}, errUnknownUser
+	}
+	if len(res.Entries) > 1 {
+		return models.User{}, fmt.Errorf("the username matches %d entries", len(res.Entries))
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return models.User{}, errInvalidCredentials
+		}
+		return models.User{}, err
+	}
+
+	role := mapRole(entry.GetEqualFoldAttributeValues(l.conf.GroupAttribute), l.conf.AdminGroup, l.conf.OperatorGroup, l.conf.ReadOnlyGroup)
+	if role == "" {
+		return models.User{}, errNoRole
+	}
+
+	user, err := syncUser(models.ProviderLDAP, username, entry.GetEqualFoldAttributeValue("mail"), role)
+	if err != nil {
+		return user, err
+	}
+
+	if l.conf.CacheTTL > 0 {
+		l.mu.Lock()
+		l.cache[key] = ldapBind{user: user, expires: time.Now().Add(time.Duration(l.conf.CacheTTL) * time.Second)}
+		l.mu.Unlock()
+	}
+
+	return user, nil
+}
+
+// connect opens a connection to the server, upgraded with StartTLS when configured
+func (l *LDAP) connect() (ldapConn, error) {
+	u, err := url.Parse(l.conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(l.conf.Timeout) * time.Second
+	tlsConf := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: l.conf.InsecureSkipVerify,
+	}
+
+	conn, err := ldap.DialURL(l.conf.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}), ldap.DialWithTLSConfig(tlsConf))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+
+	if l.conf.StartTLS {
+		if err := conn.StartTLS(tlsConf); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (l *LDAP) cached(key [sha256.Size]byte) (models.User, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bind, ok := l.cache[key]
+	if !ok {
+		return models.User{}, false
+	}
+	if time.Now().After(bind.expires) {
+		delete(l.cache, key)
+		return models.User{}, false
+	}
+	return bind.user, true
+}
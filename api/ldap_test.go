@@ -0,0 +1,340 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/maxiepax/go-via/config"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+)
+
+type fakeLDAPUser struct {
+	dn       string
+	password string
+	groups   []string
+}
+
+// fakeLDAP is an in-process LDAP server that answers binds, searches by the value of an equality filter and StartTLS
+type fakeLDAP struct {
+	users map[string]fakeLDAPUser
+	// tls upgrades connections with StartTLS, which is refused when nil
+	tls *tls.Config
+
+	mu    sync.Mutex
+	binds int
+}
+
+func newFakeLDAP(t *testing.T, tlsConf *tls.Config) (*fakeLDAP, string) {
+	t.Helper()
+
+	f := &fakeLDAP{
+		users: map[string]fakeLDAPUser{
+			"alice": {"uid=alice,dc=example", "alice-pw", []string{"cn=Admins,dc=example"}},
+			"bob":   {"uid=bob,dc=example", "bob-pw", []string{"cn=other,dc=example", "cn=operators,dc=example"}},
+			"carol": {"uid=carol,dc=example", "carol-pw", []string{"cn=other,dc=example"}},
+		},
+		tls: tlsConf,
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+
+	return f, "ldap://" + l.Addr().String()
+}
+
+func (f *fakeLDAP) bindCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.binds
+}
+
+func (f *fakeLDAP) serve(c net.Conn) {
+	defer func() { c.Close() }()
+
+	for {
+		p, err := ber.ReadPacket(c)
+		if err != nil {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			f.mu.Lock()
+			f.binds++
+			f.mu.Unlock()
+
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if dn == "cn=search,dc=example" && password == "search-pw" {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, u := range f.users {
+				if u.dn == dn && u.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			c.Write(ldapResult(id, ldap.ApplicationBindResponse, code).Bytes())
+
+		case ldap.ApplicationUnbindRequest:
+			return
+
+		case ldap.ApplicationSearchRequest:
+			// the filter is an equality match of the user filter, with the username as value
+			if u, ok := f.users[op.Children[6].Children[1].Data.String()]; ok {
+				c.Write(ldapEntry(id, u.dn, map[string][]string{
+					"memberOf": u.groups,
+					"mail":     {strings.Split(strings.TrimPrefix(u.dn, "uid="), ",")[0] + "@example.com"},
+				}).Bytes())
+			}
+			c.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+
+		case ldap.ApplicationExtendedRequest:
+			if f.tls == nil {
+				c.Write(ldapResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError).Bytes())
+				continue
+			}
+			c.Write(ldapResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess).Bytes())
+			c = tls.Server(c, f.tls)
+		}
+	}
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	return p
+}
+
+func ldapResult(id int64, tag ber.Tag, code int64) *ber.Packet {
+	r := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	r.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return ldapMessage(id, r)
+}
+
+func ldapEntry(id int64, dn string, attributes map[string][]string) *ber.Packet {
+	e := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	e.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for k, values := range attributes {
+		a := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, k, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		a.AppendChild(set)
+		attrs.AppendChild(a)
+	}
+	e.AppendChild(attrs)
+	return ldapMessage(id, e)
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func testLDAPConf(url string) config.Ldap {
+	return config.Ldap{
+		URL:            url,
+		BindDN:         "cn=search,dc=example",
+		BindPassword:   "search-pw",
+		BaseDN:         "dc=example",
+		UserFilter:     "(uid=%s)",
+		GroupAttribute: "memberOf",
+		AdminGroup:     "cn=admins,dc=example",
+		OperatorGroup:  "cn=operators,dc=example",
+		CacheTTL:       300,
+		Timeout:        5,
+	}
+}
+
+func TestMapRole(t *testing.T) {
+	for _, tt := range []struct {
+		groups []string
+		want   string
+	}{
+		{[]string{"cn=Admins,dc=example"}, models.RoleAdmin},
+		{[]string{"cn=operators,dc=example", "cn=admins,dc=example"}, models.RoleAdmin},
+		{[]string{"cn=operators,dc=example"}, models.RoleOperator},
+		{[]string{"cn=readers,dc=example"}, models.RoleReadOnly},
+		{[]string{"cn=other,dc=example"}, ""},
+		{nil, ""},
+	} {
+		if got := mapRole(tt.groups, "cn=admins,dc=example", "cn=operators,dc=example", "cn=readers,dc=example"); got != tt.want {
+			t.Errorf("mapRole(%v) = %q, want %q", tt.groups, got, tt.want)
+		}
+	}
+
+	// a group that isn't configured grants nothing, even to users without groups
+	if got := mapRole([]string{"cn=readers,dc=example"}, "cn=admins,dc=example", "", ""); got != "" {
+		t.Errorf("mapRole without a read-only group = %q, want none", got)
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	testDB(t, &models.User{})
+	_, url := newFakeLDAP(t, nil)
+	l := NewLDAP(testLDAPConf(url))
+
+	for _, tt := range []struct {
+		username, password string
+		role               string
+		err                error
+	}{
+		{"alice", "alice-pw", models.RoleAdmin, nil},
+		{"bob", "bob-pw", models.RoleOperator, nil},
+		{"carol", "carol-pw", "", errNoRole},
+		{"alice", "wrong", "", errInvalidCredentials},
+		{"alice", "", "", errInvalidCredentials},
+		{"nobody", "secret", "", errUnknownUser},
+		{"alice)(uid=*", "alice-pw", "", errUnknownUser},
+	} {
+		user, err := l.Authenticate(tt.username, tt.password)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.username, err, tt.err)
+			continue
+		}
+		if err == nil && (user.Role != tt.role || user.Provider != models.ProviderLDAP || user.Email != tt.username+"@example.com") {
+			t.Errorf("%s: got %s %s %s, want %s", tt.username, user.Role, user.Provider, user.Email, tt.role)
+		}
+	}
+
+	// the users are stored to be managed like local users
+	var count int64
+	if res := db.DB.Model(&models.User{}).Count(&count); res.Error != nil || count != 2 {
+		t.Errorf("got %d stored users, want 2 (%v)", count, res.Error)
+	}
+}
+
+func TestLDAPCache(t *testing.T) {
+	testDB(t, &models.User{})
+	f, url := newFakeLDAP(t, nil)
+	l := NewLDAP(testLDAPConf(url))
+
+	// the search account and the user are bound the first time
+	binds := f.bindCount()
+	if _, err := l.Authenticate("alice", "alice-pw"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.bindCount() - binds; n != 2 {
+		t.Errorf("got %d binds, want 2", n)
+	}
+
+	binds = f.bindCount()
+	if user, err := l.Authenticate("alice", "alice-pw"); err != nil || user.Role != models.RoleAdmin {
+		t.Fatalf("cached login: %v", err)
+	}
+	if n := f.bindCount() - binds; n != 0 {
+		t.Errorf("got %d binds for a cached login, want 0", n)
+	}
+
+	// another password is never served from the cache
+	if _, err := l.Authenticate("alice", "wrong"); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("got %v for a wrong password, want %v", err, errInvalidCredentials)
+	}
+
+	// an expired bind is checked with the server again
+	l.mu.Lock()
+	for k, v := range l.cache {
+		v.expires = time.Now().Add(-time.Second)
+		l.cache[k] = v
+	}
+	l.mu.Unlock()
+	binds = f.bindCount()
+	if _, err := l.Authenticate("alice", "alice-pw"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.bindCount() - binds; n != 2 {
+		t.Errorf("got %d binds after the cache expired, want 2", n)
+	}
+
+	// nothing is cached without a ttl
+	conf := testLDAPConf(url)
+	conf.CacheTTL = 0
+	l = NewLDAP(conf)
+	for i := 0; i < 2; i++ {
+		binds = f.bindCount()
+		if _, err := l.Authenticate("bob", "bob-pw"); err != nil {
+			t.Fatal(err)
+		}
+		if n := f.bindCount() - binds; n != 2 {
+			t.Errorf("login %d without cache: got %d binds, want 2", i, n)
+		}
+	}
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	testDB(t, &models.User{})
+	_, url := newFakeLDAP(t, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+
+	conf := testLDAPConf(url)
+	conf.StartTLS = true
+	conf.InsecureSkipVerify = true
+	if user, err := NewLDAP(conf).Authenticate("alice", "alice-pw"); err != nil || user.Role != models.RoleAdmin {
+		t.Errorf("login with starttls: %v", err)
+	}
+
+	// the self-signed certificate of the server is rejected when it is verified
+	conf.InsecureSkipVerify = false
+	if _, err := NewLDAP(conf).Authenticate("alice", "alice-pw"); err == nil || !strings.Contains(err.Error(), "starttls") {
+		t.Errorf("got %v for an untrusted certificate, want a starttls error", err)
+	}
+
+	// a server without StartTLS fails instead of falling back to plain text
+	_, url = newFakeLDAP(t, nil)
+	conf = testLDAPConf(url)
+	conf.StartTLS = true
+	if _, err := NewLDAP(conf).Authenticate("alice", "alice-pw"); err == nil || !strings.Contains(err.Error(), "starttls") {
+		t.Errorf("got %v for a server without starttls, want a starttls error", err)
+	}
+}
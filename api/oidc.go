@@ -0,0 +1,238 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/config"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// oidcCookie carries the state and nonce of a login in progress
+const oidcCookie = "govia_oidc"
+
+// sso is the OpenID Connect provider, nil when single sign-on isn't configured
+var sso *OIDC
+
+// OIDC logs users in with the authorization code flow of an OpenID Connect provider, and validates the JWT access
+// tokens of api clients with the keys of the provider. The role of the user is mapped from the groups claim.
+type OIDC struct {
+	conf config.Oidc
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+func NewOIDC(conf config.Oidc) *OIDC {
+	return &OIDC{conf: conf}
+}
+
+// discover loads the configuration of the provider the first time it's needed, so go-via starts while the provider
+// is unavailable
+func (o *OIDC) discover() (*oidc.Provider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.provider != nil {
+		return o.provider, nil
+	}
+
+	// the context is kept to refresh the keys, so it can't be the one of a request
+	p, err := oidc.NewProvider(context.Background(), o.conf.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	o.provider = p
+	return p, nil
+}
+
+func (o *OIDC) oauth2(p *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     o.conf.ClientID,
+		ClientSecret: o.conf.ClientSecret,
+		RedirectURL:  o.conf.RedirectURL,
+		Endpoint:     p.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+// Verify returns the user of a JWT access token of an api client
+func (o *OIDC) Verify(ctx context.Context, raw string) (models.User, error) {
+	p, err := o.discover()
+	if err != nil {
+		return models.User{}, err
+	}
+
+	audience := o.conf.Audience
+	if audience == "" {
+		audience = o.conf.ClientID
+	}
+
+	token, err := p.Verifier(&oidc.Config{ClientID: audience}).Verify(ctx, raw)
+	if err != nil {
+		return models.User{}, err
+	}
+	return o.user(token)
+}
+
+// user maps the claims of a token to a user
+func (o *OIDC) user(token *oidc.IDToken) (models.User, error) {
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return models.User{}, err
+	}
+
+	username, _ := claims[o.conf.UsernameClaim].(string)
+	if username == "" {
+		return models.User{}, fmt.Errorf("the token has no %s claim", o.conf.UsernameClaim)
+	}
+	email, _ := claims["email"].(string)
+
+	// the groups are a list, or a single string for some providers
+	var groups []string
+	switch v := claims[o.conf.GroupsClaim].(type) {
+	case string:
+		groups = []string{v}
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+
+	role := mapRole(groups, o.conf.AdminGroup, o.conf.OperatorGroup, o.conf.ReadOnlyGroup)
+	if role == "" {
+		return models.User{}, errNoRole
+	}
+
+	return syncUser(models.ProviderOIDC, username, email, role)
+}
+
+// OidcLogin Log in with the OpenID Connect provider
+// @Summary Redirect to the OpenID Connect provider to log in
+// @Tags tokens
+// @Success 302
+// @Failure 404 {object} models.APIError
+// @Router /oidc/login [get]
+func OidcLogin(c *gin.Context) {
+	if sso == nil {
+		Error(c, http.StatusNotFound, fmt.Errorf("single sign-on is not configured")) // 404
+		return
+	}
+
+	p, err := sso.discover()
+	if err != nil {
+		Error(c, http.StatusBadGateway, err) // 502
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+	state, nonce := hex.EncodeToString(b[:16]), hex.EncodeToString(b[16:])
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcCookie, state+"."+nonce, int((10 * time.Minute).Seconds()), "/oidc", "", true, true)
+	c.Redirect(http.StatusFound, sso.oauth2(p).AuthCodeURL(state, oidc.Nonce(nonce)))
+}
+
+// OidcCallback Complete the login with the OpenID Connect provider
+// @Summary Exchange the authorization code for a session of the web interface
+// @Tags tokens
+// @Param state query string true "State"
+// @Param code query string true "Authorization code"
+// @Success 302
+// @Failure 401 {object} models.APIError
+// @Router /oidc/callback [get]
+func OidcCallback(conf *config.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if sso == nil {
+			Error(c, http.StatusNotFound, fmt.Errorf("single sign-on is not configured")) // 404
+			return
+		}
+
+		user, err := oidcExchange(c)
+		auditLogin(c, user, user.Username, err)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"provider": models.ProviderOIDC,
+				"err":      err,
+			}).Info("auth")
+			Error(c, http.StatusUnauthorized, err) // 401
+			return
+		}
+
+		ttl := time.Duration(conf.Session.TTL) * time.Minute
+		item, err := issueToken(user, models.TokenForm{Name: "session " + c.ClientIP()}, ttl, true)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		// lax, the browser arrives here by a redirect of the provider
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(oidcCookie, "", -1, "/oidc", "", true, true)
+		c.SetCookie(sessionCookie, item.Secret, int(ttl.Seconds()), "/", "", true, true)
+		c.Redirect(http.StatusFound, "/web/")
+
+		logrus.WithFields(logrus.Fields{
+			"username": user.Username,
+			"provider": models.ProviderOIDC,
+			"status":   "session started",
+		}).Info("auth")
+	}
+}
+
+// oidcExchange checks the state, exchanges the code and returns the user of the id token
+func oidcExchange(c *gin.Context) (models.User, error) {
+	if e := c.Query("error"); e != "" {
+		return models.User{}, fmt.Errorf("%s: %s", e, c.Query("error_description"))
+	}
+
+	cookie, err := c.Cookie(oidcCookie)
+	if err != nil {
+		return models.User{}, errors.New("no login in progress")
+	}
+	parts := strings.SplitN(cookie, ".", 2)
+	if len(parts) != 2 || parts[0] != c.Query("state") {
+		return models.User{}, errors.New("invalid state")
+	}
+
+	p, err := sso.discover()
+	if err != nil {
+		return models.User{}, err
+	}
+
+	token, err := sso.oauth2(p).Exchange(c.Request.Context(), c.Query("code"))
+	if err != nil {
+		return models.User{}, err
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return models.User{}, errors.New("the provider returned no id token")
+	}
+
+	idToken, err := p.Verifier(&oidc.Config{ClientID: sso.conf.ClientID}).Verify(c.Request.Context(), raw)
+	if err != nil {
+		return models.User{}, err
+	}
+	if idToken.Nonce != parts[1] {
+		return models.User{}, errors.New("invalid nonce")
+	}
+
+	return sso.user(idToken)
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"gorm.io/gorm"
+)
+
+// ListPoolRanges Get a list of all additional ranges and exclusions of a pool
+// @Summary Get all ranges of a pool
+// @Tags pools
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Pool ID"
+// @Success 200 {array} models.PoolRange
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /pools/{id}/ranges [get]
+func ListPoolRanges(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	var items []models.PoolRange
+	if res := db.DB.Where("pool_id = ?", id).Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// CreatePoolRange Add a range or an exclusion to a pool
+// @Summary Add a range or an exclusion to a pool
+// @Tags pools
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Pool ID"
+// @Param item body models.PoolRangeForm true "Add a range"
+// @Success 200 {object} models.PoolRange
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /pools/{id}/ranges [post]
+func CreatePoolRange(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	var form models.PoolRangeForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Make sure the pool exists
+	var pool models.Pool
+	if res := db.DB.First(&pool, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	item := models.PoolRange{PoolID: pool.ID, PoolRangeForm: form}
+
+	if res := db.DB.Create(&item); res.Error != nil {
+		Error(c, http.StatusBadRequest, res.Error) // 400
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// DeletePoolRange Remove a range or an exclusion from a pool
+// @Summary Remove a range or an exclusion from a pool
+// @Tags pools
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Pool ID"
+// @Param  range_id path int true "Range ID"
+// @Success 204
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /pools/{id}/ranges/{range_id} [delete]
+func DeletePoolRange(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	rangeID, err := strconv.Atoi(c.Param("range_id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.PoolRange
+	if res := db.DB.Where("pool_id = ?", id).First(&item, rangeID); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// Delete it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
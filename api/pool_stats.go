@@ -0,0 +1,152 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/config"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// GetPoolStats Get the utilization of a pool
+// @Summary Get the utilization of a pool
+// @Tags pools
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Pool ID"
+// @Param  since query string false "How far back to return utilization samples, eg. 24h (default)"
+// @Success 200 {object} models.PoolStats
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /pools/{id}/stats [get]
+func GetPoolStats(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	since := 24 * time.Hour
+	if v := c.Query("since"); v != "" {
+		since, err = time.ParseDuration(v)
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+	}
+
+	// Load the item
+	var item models.PoolWithAddresses
+	if res := db.DB.Table("pools").Preload("Ranges").First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	stats, err := item.Stats()
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	if res := db.DB.Where("pool_id = ? AND created_at > ?", item.ID, time.Now().Add(-since)).Order("created_at").Find(&stats.Samples); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, stats) // 200
+}
+
+// SamplePools periodically records the utilization of all pools, and warns when a pool is nearly exhausted
+func SamplePools(conf *config.Config) {
+	if conf.Pools.SampleInterval <= 0 {
+		logrus.Info("pool utilization sampling is disabled")
+		return
+	}
+
+	// remember which pools have already been warned about, to only warn when the threshold is crossed
+	warned := map[int]bool{}
+
+	for {
+		samplePools(conf, warned)
+		<-time.After(time.Duration(conf.Pools.SampleInterval) * time.Second)
+	}
+}
+
+func samplePools(conf *config.Config, warned map[int]bool) {
+	var pools []models.PoolWithAddresses
+	if res := db.DB.Table("pools").Preload("Ranges").Find(&pools); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": res.Error,
+		}).Warn("pools: could not load pools to sample")
+		return
+	}
+
+	for _, v := range pools {
+		stats, err := v.Stats()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"pool": v.Name,
+				"err":  err,
+			}).Warn("pools: could not calculate pool utilization")
+			continue
+		}
+
+		sample := models.PoolSample{
+			PoolID:      v.ID,
+			Total:       stats.Total,
+			Used:        stats.Total - stats.Free,
+			Free:        stats.Free,
+			Utilization: stats.Utilization,
+		}
+		if res := db.DB.Create(&sample); res.Error != nil {
+			logrus.WithFields(logrus.Fields{
+				"pool": v.Name,
+				"err":  res.Error,
+			}).Warn("pools: could not save utilization sample")
+		}
+
+		threshold := conf.Pools.WarningThreshold
+		if v.WarningThreshold > 0 {
+			threshold = v.WarningThreshold
+		}
+		if threshold <= 0 {
+			continue
+		}
+
+		if stats.Utilization >= float64(threshold) {
+			if !warned[v.ID] {
+				logrus.WithFields(logrus.Fields{
+					"pool":        v.Name,
+					"utilization": fmt.Sprintf("%.1f%%", stats.Utilization),
+					"threshold":   fmt.Sprintf("%d%%", threshold),
+					"free":        stats.Free,
+				}).Warn("pools: pool is nearly exhausted")
+			}
+			warned[v.ID] = true
+		} else {
+			warned[v.ID] = false
+		}
+	}
+
+	// remove samples that are past the retention
+	retention := time.Duration(conf.Pools.SampleRetention) * time.Hour
+	if retention > 0 {
+		if res := db.DB.Where("created_at < ?", time.Now().Add(-retention)).Delete(&models.PoolSample{}); res.Error != nil {
+			logrus.WithFields(logrus.Fields{
+				"err": res.Error,
+			}).Warn("pools: could not remove old utilization samples")
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/imdario/mergo"
@@ -120,6 +121,11 @@ func CreatePool(c *gin.Context) {
 		return
 	}
 
+	if err := validateAttributes(form.Attributes); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
 	item := models.Pool{PoolForm: form}
 
 	if res := db.DB.Create(&item); res.Error != nil {
@@ -165,7 +171,7 @@ func GetNextFreeIP(c *gin.Context) {
 
 	// Load the item
 	var item models.PoolWithAddresses
-	if res := db.DB.Table("pools").Preload("Addresses", "reimage OR expires > NOW()").First(&item, id); res.Error != nil {
+	if res := db.DB.Table("pools").Preload("Ranges").First(&item, id); res.Error != nil {
 		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
 			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
 		} else {
@@ -215,6 +221,11 @@ func GetPoolByRelay(c *gin.Context) {
 		return
 	}
 
+	if res := db.DB.Where("pool_id = ?", item.ID).Find(&item.Addresses); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
 	/*
 		var item models.Pool
 		if res := db.DB.Where("INET_ATON(net_address) = INET_ATON(?) & ((POWER(2, netmask)-1) <<(32-netmask))", relay).First(&item); res.Error != nil {
@@ -256,6 +267,11 @@ func UpdatePool(c *gin.Context) {
 		return
 	}
 
+	if err := validateAttributes(form.Attributes); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
 	// Load the item
 	var item models.Pool
 	if res := db.DB.First(&item, id); res.Error != nil {
@@ -273,6 +289,12 @@ func UpdatePool(c *gin.Context) {
 	}
 
 	item.OnlyServeReimage = form.OnlyServeReimage
+	item.Discovery = form.Discovery
+	item.DiscoveryImageID = form.DiscoveryImageID
+
+	// mergo skips empty values, always overwrite so the pool can leave its shared network and use the default threshold again
+	item.SharedNetwork = form.SharedNetwork
+	item.WarningThreshold = form.WarningThreshold
 
 	// Save it
 	if res := db.DB.Save(&item); res.Error != nil {
@@ -311,12 +333,14 @@ func DeletePool(c *gin.Context) {
 		return
 	}
 
-	//check if a group is using the pool
-	var group models.Group
-	db.DB.First(&group, "pool_id = ?", item.ID)
+	conflict, err := poolInUse(db.DB, item.ID)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
 
-	if group.Name != "" {
-		c.JSON(http.StatusConflict, "the pool is being used by groups, please re-assign the groups to another pool and then delete the pool")
+	if conflict != "" {
+		c.JSON(http.StatusConflict, conflict)
 	} else {
 		// Delete it
 		if res := db.DB.Delete(&item); res.Error != nil {
@@ -324,20 +348,65 @@ func DeletePool(c *gin.Context) {
 			return
 		}
 
+		// Delete the ranges that belonged to the pool
+		if res := db.DB.Where("pool_id = ?", item.ID).Delete(&models.PoolRange{}); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
 		c.JSON(http.StatusNoContent, gin.H{}) //204
 	}
 
 }
 
+// poolInUse returns why the pool can't be deleted, while groups or active leases would be left without it
+func poolInUse(tx *gorm.DB, id int) (string, error) {
+	//check if a group is using the pool
+	var groups int64
+	if res := tx.Model(&models.Group{}).Where("pool_id = ?", id).Count(&groups); res.Error != nil {
+		return "", res.Error
+	}
+	if groups > 0 {
+		return "the pool is being used by groups, please re-assign the groups to another pool and then delete the pool", nil
+	}
+
+	var leases int64
+	if res := tx.Model(&models.Address{}).Where("pool_id = ? AND expires > ?", id, time.Now()).Count(&leases); res.Error != nil {
+		return "", res.Error
+	}
+	if leases > 0 {
+		return fmt.Sprintf("the pool has %d active leases, please delete the pool once they have expired", leases), nil
+	}
+
+	return "", nil
+}
+
+// ErrNoPool is returned when no pool is serving the network of an ip
+var ErrNoPool = errors.New("no matching pool found")
+
+// FindPool returns the first pool serving the network of the ip
 func FindPool(ip string) (*models.PoolWithAddresses, error) {
+	pools, err := FindPools(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	return pools[0], nil
+}
+
+// FindPools returns all pools serving the network of the ip, together with the pools sharing a network with them
+func FindPools(ip string) (models.SharedNetwork, error) {
 	var pools []models.Pool
-	if res := db.DB.Table("pools").Find(&pools); res.Error != nil {
+	if res := db.DB.Table("pools").Order("id").Find(&pools); res.Error != nil {
 		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
-			return nil, fmt.Errorf("no matching pool found")
+			return nil, ErrNoPool
 		}
 		return nil, res.Error
 	}
-	var pool models.PoolWithAddresses
+
+	// find the pools matching the network, and the shared networks they are part of
+	matched := map[int]struct{}{}
+	sharedNetworks := map[string]struct{}{}
 	for _, v := range pools {
 		_, ipv4Net, err := net.ParseCIDR(ip + "/" + strconv.Itoa(v.Netmask))
 		if err != nil {
@@ -345,20 +414,35 @@ func FindPool(ip string) (*models.PoolWithAddresses, error) {
 		}
 
 		if ipv4Net.IP.String() == v.NetAddress {
-			pool.Pool = v
-			break
+			matched[v.ID] = struct{}{}
+			if v.SharedNetwork != "" {
+				sharedNetworks[v.SharedNetwork] = struct{}{}
+			}
 		}
 	}
 
-	if pool.ID == 0 {
-		return nil, fmt.Errorf("no matching pool found")
+	var ids []int
+	for _, v := range pools {
+		_, isMatched := matched[v.ID]
+		_, isShared := sharedNetworks[v.SharedNetwork]
+		if isMatched || (v.SharedNetwork != "" && isShared) {
+			ids = append(ids, v.ID)
+		}
 	}
 
-	if res := db.DB.Table("pools").Preload("Addresses").First(&pool, pool.ID); res.Error != nil {
-		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
-			return nil, fmt.Errorf("no matching pool found")
-		}
+	if len(ids) == 0 {
+		return nil, ErrNoPool
+	}
+
+	var items []*models.PoolWithAddresses
+	// addresses are not preloaded, they are looked up on demand to keep large pools fast
+	if res := db.DB.Table("pools").Preload("Ranges").Order("id").Find(&items, ids); res.Error != nil {
 		return nil, res.Error
 	}
-	return &pool, nil
+
+	if len(items) == 0 {
+		return nil, ErrNoPool
+	}
+
+	return models.SharedNetwork(items), nil
 }
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+)
+
+func TestUpdatePoolClearsFields(t *testing.T) {
+	testDB(t, &models.Pool{}, &models.PoolRange{})
+	gin.SetMode(gin.TestMode)
+
+	pool := models.Pool{PoolForm: models.PoolForm{Name: "pool", StartAddress: "10.0.0.10", EndAddress: "10.0.0.250", Netmask: 24, LeaseTime: 3600, Gateway: "10.0.0.1", SharedNetwork: "rack1", WarningThreshold: 80}, NetAddress: "10.0.0.0"}
+	if res := db.DB.Create(&pool); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	r := gin.New()
+	r.PATCH("/v1/pools/:id", UpdatePool)
+
+	body := `{"name": "pool", "start_address": "10.0.0.10", "end_address": "10.0.0.250", "netmask": 24, "lease_time": 3600, "gateway": "10.0.0.1", "shared_network": "", "warning_threshold": 0}`
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPatch, "/v1/pools/"+strconv.Itoa(pool.ID), bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body.String())
+	}
+
+	var item models.Pool
+	if res := db.DB.First(&item, pool.ID); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if item.SharedNetwork != "" || item.WarningThreshold != 0 {
+		t.Errorf("got shared network %q and warning threshold %d, want them cleared", item.SharedNetwork, item.WarningThreshold)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -17,6 +18,7 @@ import (
 	"github.com/gin-gonic/gin"
 	ca "github.com/maxiepax/go-via/crypto"
 	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/metrics"
 	"github.com/maxiepax/go-via/models"
 	"github.com/maxiepax/go-via/secrets"
 	"github.com/sirupsen/logrus"
@@ -24,7 +26,11 @@ import (
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/govc/host/esxcli"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/crypto/ssh"
 	"gorm.io/gorm/clause"
 )
 
@@ -38,6 +44,10 @@ func PostConfig(key string) func(c *gin.Context) {
 			return
 		}
 
+		if !inScope(c, item.GroupID) {
+			return
+		}
+
 		c.JSON(http.StatusOK, item) // 200
 
 		logrus.Info("ks config done!")
@@ -61,6 +71,10 @@ func PostConfigID(key string) func(c *gin.Context) {
 			return
 		}
 
+		if !inScope(c, item.GroupID) {
+			return
+		}
+
 		c.JSON(http.StatusOK, item) // 200
 
 		logrus.Info("Manual PostConfig of host" + item.Hostname + "started!")
@@ -78,8 +92,15 @@ func ProvisioningWorker(item models.Address, key string) {
 		"Started worker for ": item.Hostname,
 	}).Debug("host")
 
-	// decrypt login password
-	decryptedPassword := secrets.Decrypt(item.Group.Password, key)
+	// decrypt login password, the one generated for the host or the one of the group
+	decryptedPassword, _, err := rootPassword(item, key)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"IP":  item.IP,
+			"err": err,
+		}).Error("postconfig failed to decrypt the root password")
+		return
+	}
 
 	// connection info
 	url := &url.URL{
@@ -100,10 +121,10 @@ func ProvisioningWorker(item models.Address, key string) {
 
 	// ensure that host has enough time to boot, and for SOAP API to respond
 	var c *govmomi.Client
-	var err error
 	ctx := context.Background()
 	i := 1
 	timeout := 360
+	start := time.Now()
 
 	for {
 		if i > timeout {
@@ -111,6 +132,7 @@ func ProvisioningWorker(item models.Address, key string) {
 				"IP":     item.IP,
 				"status": "timeout exceeded, failing postconfig",
 			}).Info("postconfig")
+			metrics.PostConfigStep("connect", start, fmt.Errorf("timeout exceeded"))
 			return
 		}
 
@@ -150,6 +172,7 @@ func ProvisioningWorker(item models.Address, key string) {
 		}
 		break
 	}
+	metrics.PostConfigStep("connect", start, nil)
 
 	// since we're always going to be talking directly to the host, dont asume connection through vCenter.
 	host, err := find.NewFinder(c.Client).DefaultHostSystem(ctx)
@@ -167,7 +190,9 @@ func ProvisioningWorker(item models.Address, key string) {
 
 	//domain
 	if item.Domain != "" {
+		start := time.Now()
 		err := PostConfigDomain(e, item)
+		metrics.PostConfigStep("domain", start, err)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"postconfig-domain": err,
@@ -182,7 +207,9 @@ func ProvisioningWorker(item models.Address, key string) {
 
 	//ntpd
 	if item.Group.NTP != "" {
+		start := time.Now()
 		err := PostConfigNTP(e, item, host, ctx)
+		metrics.PostConfigStep("ntp", start, err)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"postconfig-ntp": err,
@@ -197,7 +224,9 @@ func ProvisioningWorker(item models.Address, key string) {
 
 	//syslog
 	if item.Group.Syslog != "" {
+		start := time.Now()
 		err := PostConfigSyslog(e, item)
+		metrics.PostConfigStep("syslog", start, err)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"postconfig-syslog": err,
@@ -212,7 +241,9 @@ func ProvisioningWorker(item models.Address, key string) {
 
 	//ssh
 	if options.SSH {
+		start := time.Now()
 		err := PostConfigSSH(e, item, host, ctx)
+		metrics.PostConfigStep("ssh", start, err)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"postconfig-ssh": err,
@@ -226,7 +257,9 @@ func ProvisioningWorker(item models.Address, key string) {
 	}
 
 	if item.Group.Vlan != "" {
+		start := time.Now()
 		err := PostConfigVlan(e, item)
+		metrics.PostConfigStep("vlan", start, err)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"postconfig-vlan": err,
@@ -239,9 +272,71 @@ func ProvisioningWorker(item models.Address, key string) {
 		}
 	}
 
+	//attributes that set advanced options
+	if len(item.Pool.Attributes) > 0 || len(item.Group.Attributes) > 0 || len(item.Attributes) > 0 {
+		start := time.Now()
+		err := PostConfigAttributes(e, item)
+		metrics.PostConfigStep("attributes", start, err)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"postconfig-attributes": err,
+			}).Info(item.IP)
+		} else {
+			logrus.WithFields(logrus.Fields{
+				"IP":         item.IP,
+				"attributes": "advanced options configured",
+			}).Info("postconfig")
+		}
+	}
+
+	//local users of the group
+	var accounts []models.Account
+	if res := db.DB.Where("group_id = ?", item.GroupID.Int32).Order("username").Find(&accounts); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"postconfig-accounts": res.Error,
+		}).Info(item.IP)
+	}
+	if len(accounts) > 0 {
+		start := time.Now()
+		err := PostConfigAccounts(ctx, c, host, item, accounts, key)
+		if err == nil {
+			err = PostConfigSSHKeys(ctx, host, item, accounts, decryptedPassword)
+		}
+		metrics.PostConfigStep("accounts", start, err)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"postconfig-accounts": err,
+			}).Info(item.IP)
+		} else {
+			logrus.WithFields(logrus.Fields{
+				"IP":       item.IP,
+				"accounts": "local users configured",
+			}).Info("postconfig")
+		}
+	}
+
+	//account lockout policy
+	if options.AccountLockFailures > 0 || options.AccountUnlockTime > 0 {
+		start := time.Now()
+		err := PostConfigLockout(e, item, options)
+		metrics.PostConfigStep("lockout", start, err)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"postconfig-lockout": err,
+			}).Info(item.IP)
+		} else {
+			logrus.WithFields(logrus.Fields{
+				"IP":      item.IP,
+				"lockout": "account lockout policy configured",
+			}).Info("postconfig")
+		}
+	}
+
 	//certificate
 	if options.Certificate {
+		start := time.Now()
 		err := PostConfigCertificate(e, item, decryptedPassword, ctx, timeout, i, c, url)
+		metrics.PostConfigStep("certificate", start, err)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"postconfig-certificate": err,
@@ -254,6 +349,23 @@ func ProvisioningWorker(item models.Address, key string) {
 		}
 	}
 
+	//lockdown mode, last as root may lose access to the host
+	if options.Lockdown != "" {
+		start := time.Now()
+		err := PostConfigLockdown(ctx, c, host, item, options.Lockdown, accounts)
+		metrics.PostConfigStep("lockdown", start, err)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"postconfig-lockdown": err,
+			}).Info(item.IP)
+		} else {
+			logrus.WithFields(logrus.Fields{
+				"IP":       item.IP,
+				"lockdown": "lockdown mode " + options.Lockdown,
+			}).Info("postconfig")
+		}
+	}
+
 	//postconfig completed
 	logrus.WithFields(logrus.Fields{
 		"IP":         item.IP,
@@ -304,8 +416,22 @@ func putRequest(url string, data io.Reader, username string, password string) {
 func callback(url string, data models.Address) error {
 	//remove password
 	data.Group.Password = ""
+
+	//include the attributes inherited from the pool and group
+	attributes, err := data.EffectiveAttributes()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"postconfig": err,
+		}).Info("")
+		return err
+	}
+	payload := struct {
+		models.Address
+		EffectiveAttributes map[string]interface{} `json:"effective_attributes"`
+	}{data, attributes}
+
 	//convert model to json
-	json_data, err := json.Marshal(data)
+	json_data, err := json.Marshal(payload)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"postconfig": err,
@@ -642,3 +768,261 @@ func PostConfigCertificate(e *esxcli.Executor, item models.Address, decryptedPas
 
 	return nil
 }
+
+func PostConfigAttributes(e *esxcli.Executor, item models.Address) error {
+	attributes, err := item.EffectiveAttributes()
+	if err != nil {
+		return err
+	}
+
+	definitions, err := attributeDefinitions()
+	if err != nil {
+		return err
+	}
+
+	//set the advanced option of every attribute that has one, integer options are set with -i and others with -s
+	for k, v := range attributes {
+		definition, ok := definitions[k]
+		if !ok || definition.AdvancedOption == "" {
+			continue
+		}
+
+		cmd := []string{"system", "settings", "advanced", "set", "-o", definition.AdvancedOption}
+		switch v := v.(type) {
+		case bool:
+			value := "0"
+			if v {
+				value = "1"
+			}
+			cmd = append(cmd, "-i", value)
+		case float64:
+			cmd = append(cmd, "-i", strconv.FormatInt(int64(v), 10))
+		default:
+			cmd = append(cmd, "-s", fmt.Sprint(v))
+		}
+
+		if _, err := e.Run(cmd); err != nil {
+			return fmt.Errorf("%s: %w", definition.AdvancedOption, err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"IP":     item.IP,
+			"option": definition.AdvancedOption,
+			"value":  v,
+		}).Debug("postconfig")
+	}
+
+	return nil
+}
+
+// PostConfigAccounts creates the local users of the group on the host, or updates them when they exist, and gives
+// them their role on the host
+func PostConfigAccounts(ctx context.Context, c *govmomi.Client, host *object.HostSystem, item models.Address, accounts []models.Account, key string) error {
+	m, err := host.ConfigManager().AccountManager(ctx)
+	if err != nil {
+		return err
+	}
+	auth := object.NewAuthorizationManager(c.Client)
+	roles, err := auth.RoleList(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, account := range accounts {
+		role := roles.ByName(account.Role)
+		if role == nil {
+			return fmt.Errorf("%s: the role %s doesn't exist on the host", account.Username, account.Role)
+		}
+
+		password := ""
+		if account.Password != "" {
+			password, err = secrets.Decrypt(account.Password, key)
+			if err != nil {
+				return fmt.Errorf("%s: the password can't be decrypted: %w", account.Username, err)
+			}
+		}
+
+		shell := account.ShellAccess
+		spec := &types.HostPosixAccountSpec{
+			HostAccountSpec: types.HostAccountSpec{
+				Id:          account.Username,
+				Password:    password,
+				Description: account.Description,
+			},
+			ShellAccess: &shell,
+		}
+
+		_, err := methods.CreateUser(ctx, c.Client, &types.CreateUser{This: m.Reference(), User: spec})
+		if alreadyExists(err) {
+			_, err = methods.UpdateUser(ctx, c.Client, &types.UpdateUser{This: m.Reference(), User: spec})
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", account.Username, err)
+		}
+
+		permission := types.Permission{
+			Principal: account.Username,
+			RoleId:    role.RoleId,
+			Propagate: true,
+		}
+		if err := auth.SetEntityPermissions(ctx, c.ServiceContent.RootFolder, []types.Permission{permission}); err != nil {
+			return fmt.Errorf("%s: %w", account.Username, err)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"IP":       item.IP,
+			"username": account.Username,
+			"role":     account.Role,
+		}).Debug("postconfig")
+	}
+
+	return nil
+}
+
+// alreadyExists returns true when a user could not be created because it exists
+func alreadyExists(err error) bool {
+	if err == nil || !soap.IsSoapFault(err) {
+		return false
+	}
+	_, ok := soap.ToSoapFault(err).VimFault().(types.AlreadyExists)
+	return ok
+}
+
+// PostConfigSSHKeys writes the authorized keys of the users, there is no api for them, so they are written as root
+// over ssh. The ssh service is started for this when it isn't running, and stopped again afterwards.
+func PostConfigSSHKeys(ctx context.Context, host *object.HostSystem, item models.Address, accounts []models.Account, rootPassword string) error {
+	s, err := host.ConfigManager().ServiceSystem(ctx)
+	if err != nil {
+		return err
+	}
+	services, err := s.Service(ctx)
+	if err != nil {
+		return err
+	}
+	running := false
+	for _, service := range services {
+		if service.Key == "TSM-SSH" {
+			running = service.Running
+		}
+	}
+	if !running {
+		if err := s.Start(ctx, "TSM-SSH"); err != nil {
+			return err
+		}
+		defer s.Stop(ctx, "TSM-SSH")
+	}
+
+	password := func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range answers {
+			answers[i] = rootPassword
+		}
+		return answers, nil
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(item.IP, "22"), &ssh.ClientConfig{
+		User: "root",
+		Auth: []ssh.AuthMethod{ssh.Password(rootPassword), ssh.KeyboardInteractive(password)},
+		// the host has just been installed, its key is as unknown as its certificate for the api
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for _, account := range accounts {
+		keys := account.AuthorizedKeys()
+		if len(keys) == 0 {
+			continue
+		}
+
+		session, err := client.NewSession()
+		if err != nil {
+			return err
+		}
+		// the username only contains letters, numbers, dots, dashes and underscores
+		dir := "/etc/ssh/keys-" + account.Username
+		session.Stdin = strings.NewReader(strings.Join(keys, "\n") + "\n")
+		err = session.Run("mkdir -p " + dir + " && cat > " + dir + "/authorized_keys && chmod 600 " + dir + "/authorized_keys")
+		session.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", account.Username, err)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"IP":       item.IP,
+			"username": account.Username,
+			"keys":     len(keys),
+		}).Debug("postconfig")
+	}
+
+	return nil
+}
+
+// PostConfigLockout sets the account lockout policy of the host
+func PostConfigLockout(e *esxcli.Executor, item models.Address, options models.GroupOptions) error {
+	for option, value := range map[string]int{
+		"/Security/AccountLockFailures": options.AccountLockFailures,
+		"/Security/AccountUnlockTime":   options.AccountUnlockTime,
+	} {
+		if value == 0 {
+			continue
+		}
+		cmd := []string{"system", "settings", "advanced", "set", "-o", option, "-i", strconv.Itoa(value)}
+		if _, err := e.Run(cmd); err != nil {
+			return fmt.Errorf("%s: %w", option, err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"IP":     item.IP,
+			"option": option,
+			"value":  value,
+		}).Debug("postconfig")
+	}
+	return nil
+}
+
+// lockdownModes are the lockdown modes of the group options
+var lockdownModes = map[string]types.HostLockdownMode{
+	"disabled": types.HostLockdownModeLockdownDisabled,
+	"normal":   types.HostLockdownModeLockdownNormal,
+	"strict":   types.HostLockdownModeLockdownStrict,
+}
+
+// PostConfigLockdown sets the lockdown mode of the host, the users of the group with a lockdown exception keep their
+// access. Root loses access to the api unless lockdown is disabled, so postconfig can't be repeated afterwards.
+func PostConfigLockdown(ctx context.Context, c *govmomi.Client, host *object.HostSystem, item models.Address, lockdown string, accounts []models.Account) error {
+	mode, ok := lockdownModes[lockdown]
+	if !ok {
+		return fmt.Errorf("unknown lockdown mode %q, use normal, strict or disabled", lockdown)
+	}
+
+	var h mo.HostSystem
+	if err := host.Properties(ctx, host.Reference(), []string{"configManager.hostAccessManager"}, &h); err != nil {
+		return err
+	}
+	if h.ConfigManager.HostAccessManager == nil {
+		return fmt.Errorf("the host doesn't support lockdown mode")
+	}
+	ref := *h.ConfigManager.HostAccessManager
+
+	var users []string
+	for _, account := range accounts {
+		if account.LockdownException {
+			users = append(users, account.Username)
+		}
+	}
+	if _, err := methods.UpdateLockdownExceptions(ctx, c.Client, &types.UpdateLockdownExceptions{This: ref, Users: users}); err != nil {
+		return err
+	}
+
+	if _, err := methods.ChangeLockdownMode(ctx, c.Client, &types.ChangeLockdownMode{This: ref, Mode: mode}); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"IP":         item.IP,
+		"lockdown":   lockdown,
+		"exceptions": users,
+	}).Debug("postconfig")
+	return nil
+}
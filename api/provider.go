@@ -0,0 +1,198 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/maxiepax/go-via/config"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	errUnknownUser        = errors.New("supplied username does not exist")
+	errInvalidCredentials = errors.New("invalid password supplied")
+	errNoRole             = errors.New("the user is not a member of any of the groups that grant a role")
+	errLocked             = errors.New("the user is locked after too many failed logins")
+)
+
+// Provider authenticates users with a username and password
+type Provider interface {
+	Name() string
+	// Authenticate returns the user, errUnknownUser lets the next provider try
+	Authenticate(username, password string) (models.User, error)
+}
+
+// providers are tried in order, local users always come first so the default admin can log in when the directory is
+// unavailable
+var providers = []Provider{Local{}}
+
+// SetupProviders enables the configured authentication providers
+func SetupProviders(conf *config.Config) {
+	if conf.Security.BcryptCost >= bcrypt.MinCost && conf.Security.BcryptCost <= bcrypt.MaxCost {
+		bcryptCost = conf.Security.BcryptCost
+	}
+
+	providers = []Provider{Local{policy: conf.Security}}
+	if conf.Ldap.URL != "" {
+		providers = append(providers, NewLDAP(conf.Ldap))
+		logrus.WithFields(logrus.Fields{
+			"url": conf.Ldap.URL,
+		}).Info("auth: ldap enabled")
+	}
+
+	sso = nil
+	if conf.Oidc.Issuer != "" {
+		sso = NewOIDC(conf.Oidc)
+		logrus.WithFields(logrus.Fields{
+			"issuer": conf.Oidc.Issuer,
+		}).Info("auth: oidc enabled")
+	}
+}
+
+// authenticate checks the credentials with each of the providers
+func authenticate(username, password string) (models.User, error) {
+	for _, p := range providers {
+		user, err := p.Authenticate(username, password)
+		if errors.Is(err, errUnknownUser) {
+			continue
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"username": username,
+				"provider": p.Name(),
+				"err":      err,
+			}).Info("auth")
+		}
+		return user, err
+	}
+	return models.User{}, errUnknownUser
+}
+
+// Local authenticates the users of the database with their bcrypt hash, and locks users after repeated failed logins
+type Local struct {
+	policy config.Security
+}
+
+func (Local) Name() string {
+	return models.ProviderLocal
+}
+
+func (l Local) Authenticate(username, password string) (models.User, error) {
+	var user models.User
+	if res := db.DB.Where("username = ?", username).First(&user); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return user, errUnknownUser
+		}
+		return user, res.Error
+	}
+
+	// users of other providers have no password
+	if user.Provider != "" && user.Provider != models.ProviderLocal {
+		return models.User{}, errUnknownUser
+	}
+
+	if user.Locked() {
+		return models.User{}, errLocked
+	}
+
+	if !ComparePasswords(user.Password, []byte(password), username) {
+		l.failed(user)
+		return models.User{}, errInvalidCredentials
+	}
+
+	updates := map[string]interface{}{}
+	if user.FailedLogins > 0 || user.LockedUntil != nil {
+		updates["failed_logins"] = 0
+		updates["locked_until"] = nil
+	}
+	// hashes of another cost can only be replaced while the password is known
+	if cost, err := bcrypt.Cost([]byte(user.Password)); err == nil && cost != bcryptCost {
+		updates["password"] = HashAndSalt([]byte(password))
+	}
+	if len(updates) > 0 {
+		if res := db.DB.Model(&user).UpdateColumns(updates); res.Error != nil {
+			return models.User{}, res.Error
+		}
+	}
+
+	return user, nil
+}
+
+// failed counts a failed login, and locks the user when it reaches the threshold
+func (l Local) failed(user models.User) {
+	updates := map[string]interface{}{"failed_logins": gorm.Expr("failed_logins + 1")}
+	if l.policy.LockoutThreshold > 0 && user.FailedLogins+1 >= l.policy.LockoutThreshold {
+		updates["failed_logins"] = 0
+		updates["locked_until"] = time.Now().Add(time.Duration(l.policy.LockoutDuration) * time.Minute)
+
+		logrus.WithFields(logrus.Fields{
+			"username": user.Username,
+			"minutes":  l.policy.LockoutDuration,
+		}).Warning("auth: user locked after too many failed logins")
+		recordAudit(models.AuditEntry{
+			UserID:     user.ID,
+			Username:   user.Username,
+			Action:     "locked",
+			Resource:   "users",
+			ResourceID: user.ID,
+			Status:     http.StatusUnauthorized,
+		})
+	}
+
+	if res := db.DB.Model(&user).UpdateColumns(updates); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"username": user.Username,
+			"err":      res.Error,
+		}).Error("auth")
+	}
+}
+
+// mapRole returns the highest role granted by the groups of a directory or identity provider user
+func mapRole(groups []string, adminGroup, operatorGroup, readOnlyGroup string) string {
+	for _, m := range []struct{ group, role string }{
+		{adminGroup, models.RoleAdmin},
+		{operatorGroup, models.RoleOperator},
+		{readOnlyGroup, models.RoleReadOnly},
+	} {
+		if m.group == "" {
+			continue
+		}
+		for _, g := range groups {
+			if strings.EqualFold(g, m.group) {
+				return m.role
+			}
+		}
+	}
+	return ""
+}
+
+// syncUser creates or updates the local record of a user of another provider, the group scope set by an admin is kept
+func syncUser(provider, username, email, role string) (models.User, error) {
+	var user models.User
+	res := db.DB.Where("username = ?", username).First(&user)
+	if res.Error != nil && !errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return user, res.Error
+	}
+
+	// never take over a user of another provider, e.g. the local admin
+	if res.Error == nil && user.Provider != provider {
+		return models.User{}, fmt.Errorf("the username already exists for provider %s", user.Provider)
+	}
+
+	user.Username = username
+	user.Email = email
+	user.Role = role
+	user.Provider = provider
+	if res := db.DB.Save(&user); res.Error != nil {
+		return user, res.Error
+	}
+
+	return user, nil
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+	"gorm.io/gorm"
+)
+
+// encryptedColumns are the columns with secrets encrypted with the secrets key, they are re-encrypted when the key is
+// rotated
+var encryptedColumns = []struct{ table, column string }{
+	{"groups", "password"},
+	{"addresses", "root_password"},
+	{"accounts", "password"},
+}
+
+// RotateKey re-encrypts all secrets with the new key in one transaction, nothing changes when a secret can't be
+// decrypted with the old key. The rotation is recorded in the audit log as done by the actor.
+func RotateKey(oldKey, newKey string, actor models.AuditEntry) (int, error) {
+	count := 0
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		for _, col := range encryptedColumns {
+			var rows []struct {
+				ID    int
+				Value string
+			}
+			if res := tx.Table(col.table).Select("id, " + col.column + " AS value").Where(col.column + " <> ''").Scan(&rows); res.Error != nil {
+				return res.Error
+			}
+
+			for _, row := range rows {
+				plaintext, err := secrets.Decrypt(row.Value, oldKey)
+				if err != nil {
+					return fmt.Errorf("%s %d: %w", col.table, row.ID, err)
+				}
+				ciphertext, err := secrets.Encrypt(plaintext, newKey)
+				if err != nil {
+					return err
+				}
+				if res := tx.Table(col.table).Where("id = ?", row.ID).UpdateColumn(col.column, ciphertext); res.Error != nil {
+					return res.Error
+				}
+				count++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	entry := actor
+	entry.Action = "rotate_key"
+	entry.Resource = "secrets"
+	entry.Changes, _ = json.Marshal(map[string]models.AuditChange{
+		"key_id": {Old: secrets.KeyID(oldKey), New: secrets.KeyID(newKey)},
+	})
+	recordAudit(entry)
+
+	return count, nil
+}
@@ -0,0 +1,592 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/imdario/mergo"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ListTemplates Get a list of all kickstart templates
+// @Summary Get all templates
+// @Tags templates
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.Template
+// @Failure 500 {object} models.APIError
+// @Router /templates [get]
+func ListTemplates(c *gin.Context) {
+	var items []models.Template
+	if res := db.DB.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetTemplate Get an existing template
+// @Summary Get an existing template
+// @Tags templates
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Template ID"
+// @Success 200 {object} models.Template
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /templates/{id} [get]
+func GetTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Template
+	if res := db.DB.Preload("Versions", func(db *gorm.DB) *gorm.DB {
+		return db.Order("version")
+	}).First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CreateTemplate Create a new template
+// @Summary Create a new template
+// @Tags templates
+// @Accept  json
+// @Produce  json
+// @Param item body models.NewTemplateForm true "Add a template and its first version"
+// @Success 200 {object} models.Template
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /templates [post]
+func CreateTemplate(c *gin.Context) {
+	var form models.NewTemplateForm
+
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// reject a kickstart that would fail when hosts are installed
+	if err := validateTemplate(form.Content, form.Snippet); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item := models.Template{TemplateForm: form.TemplateForm, LatestVersion: 1}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Create(&item); res.Error != nil {
+			return res.Error
+		}
+
+		version := models.TemplateVersion{TemplateID: item.ID, Version: 1, TemplateVersionForm: form.TemplateVersionForm}
+		return tx.Create(&version).Error
+	})
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	// Load a new version with relations
+	if res := db.DB.Preload("Versions").First(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+
+	logrus.WithFields(logrus.Fields{
+		"Name":    item.Name,
+		"Snippet": item.Snippet,
+	}).Debug("template")
+}
+
+// UpdateTemplate Update the name and description of an existing template
+// @Summary Update an existing template
+// @Tags templates
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Template ID"
+// @Param  item body models.TemplateForm true "Update a template"
+// @Success 200 {object} models.Template
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /templates/{id} [patch]
+func UpdateTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the form data, and which of the fields that mergo can't tell from empty values were sent
+	var form models.TemplateForm
+	if err := c.ShouldBindBodyWith(&form, binding.JSON); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+	var present struct {
+		Snippet *bool `json:"snippet"`
+	}
+	if err := c.ShouldBindBodyWith(&present, binding.JSON); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Template
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// Merge the item and the form data
+	original := item
+	if err := mergo.Merge(&item, models.Template{TemplateForm: form}, mergo.WithOverride); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+	}
+
+	// Mergo doesn't overwrite false values, force set when it was sent
+	if present.Snippet != nil {
+		item.Snippet = *present.Snippet
+	}
+
+	// templates include a snippet by its name, renaming it or turning it into a template would fail their kickstarts
+	if original.Snippet && (item.Name != original.Name || !item.Snippet) {
+		including, err := includedBy(original)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+		if len(including) > 0 {
+			Error(c, http.StatusConflict, fmt.Errorf("the snippet is included by the templates %s, please remove it from them first", strings.Join(including, ", "))) // 409
+			return
+		}
+	}
+
+	// a snippet can't be the kickstart of a group or a host
+	if !original.Snippet && item.Snippet {
+		var groups, addresses int64
+		db.DB.Model(&models.Group{}).Where("template_id = ?", item.ID).Count(&groups)
+		db.DB.Model(&models.Address{}).Where("template_id = ?", item.ID).Count(&addresses)
+		if groups > 0 || addresses > 0 {
+			Error(c, http.StatusConflict, fmt.Errorf("the template is used by %d groups and %d hosts, please re-assign them first", groups, addresses)) // 409
+			return
+		}
+	}
+
+	// Save it
+	if res := db.DB.Save(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// DeleteTemplate Remove an existing template and all its versions
+// @Summary Remove an existing template
+// @Tags templates
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Template ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /templates/{id} [delete]
+func DeleteTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Template
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// check if a group or an address is using the template
+	var groups, addresses int64
+	db.DB.Model(&models.Group{}).Where("template_id = ?", item.ID).Count(&groups)
+	db.DB.Model(&models.Address{}).Where("template_id = ?", item.ID).Count(&addresses)
+	if groups > 0 || addresses > 0 {
+		Error(c, http.StatusConflict, fmt.Errorf("the template is used by %d groups and %d hosts, please re-assign them first", groups, addresses)) // 409
+		return
+	}
+
+	// a snippet can't be removed from kickstarts that include it, not even from their older versions
+	if item.Snippet {
+		including, err := includedBy(item)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+		if len(including) > 0 {
+			Error(c, http.StatusConflict, fmt.Errorf("the snippet is included by the templates %s, please remove it from them first", strings.Join(including, ", "))) // 409
+			return
+		}
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Where("template_id = ?", item.ID).Delete(&models.TemplateVersion{}); res.Error != nil {
+			return res.Error
+		}
+		return tx.Delete(&item).Error
+	})
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+// ListTemplateVersions Get all versions of a template
+// @Summary Get all versions of a template
+// @Tags templates
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Template ID"
+// @Success 200 {array} models.TemplateVersion
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /templates/{id}/versions [get]
+func ListTemplateVersions(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	var items []models.TemplateVersion
+	if res := db.DB.Where("template_id = ?", id).Order("version").Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetTemplateVersion Get a version of a template
+// @Summary Get a version of a template
+// @Tags templates
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Template ID"
+// @Param  version path int true "Version, 0 is the latest version"
+// @Success 200 {object} models.TemplateVersion
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /templates/{id}/versions/{version} [get]
+func GetTemplateVersion(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item, err := findTemplateVersion(id, version)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, err) // 500
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CreateTemplateVersion Add a new version to a template
+// @Summary Add a new version to a template
+// @Tags templates
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Template ID"
+// @Param item body models.TemplateVersionForm true "Add a version"
+// @Success 200 {object} models.TemplateVersion
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /templates/{id}/versions [post]
+func CreateTemplateVersion(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	var form models.TemplateVersionForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	var item models.TemplateVersion
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		var t models.Template
+		if res := tx.First(&t, id); res.Error != nil {
+			return res.Error
+		}
+
+		// reject a kickstart that would fail when hosts are installed
+		if err := validateTemplate(form.Content, t.Snippet); err != nil {
+			return err
+		}
+
+		t.LatestVersion++
+		item = models.TemplateVersion{TemplateID: t.ID, Version: t.LatestVersion, TemplateVersionForm: form}
+		if res := tx.Create(&item); res.Error != nil {
+			return res.Error
+		}
+
+		return tx.Model(&t).Update("latest_version", t.LatestVersion).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else if errors.Is(err, errInvalidKickstart) {
+			Error(c, http.StatusBadRequest, err) // 400
+		} else {
+			Error(c, http.StatusInternalServerError, err) // 500
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// DiffTemplateVersions Get the difference between two versions of a template
+// @Summary Get the difference between two versions of a template
+// @Tags templates
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Template ID"
+// @Param  from query int true "Version to compare from"
+// @Param  to query int false "Version to compare to, defaults to the latest version"
+// @Success 200 {object} models.TemplateDiff
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /templates/{id}/diff [get]
+func DiffTemplateVersions(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	from, err := strconv.Atoi(c.Query("from"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, fmt.Errorf("invalid from version: %w", err)) // 400
+		return
+	}
+
+	to := 0
+	if v := c.Query("to"); v != "" {
+		to, err = strconv.Atoi(v)
+		if err != nil {
+			Error(c, http.StatusBadRequest, fmt.Errorf("invalid to version: %w", err)) // 400
+			return
+		}
+	}
+
+	a, err := findTemplateVersion(id, from)
+	if err == nil {
+		var b models.TemplateVersion
+		b, err = findTemplateVersion(id, to)
+		if err == nil {
+			c.JSON(http.StatusOK, models.TemplateDiff{From: a.Version, To: b.Version, Diff: diffLines(a.Content, b.Content)}) // 200
+			return
+		}
+	}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+	} else {
+		Error(c, http.StatusInternalServerError, err) // 500
+	}
+}
+
+// includedBy returns the names of the other templates that include a snippet in any of their versions
+func includedBy(snippet models.Template) ([]string, error) {
+	var rows []struct {
+		Name    string
+		Content string
+	}
+	if res := db.DB.Table("template_versions").Select("templates.name, template_versions.content").
+		Joins("JOIN templates ON templates.id = template_versions.template_id").
+		Where("template_versions.template_id <> ? AND template_versions.content LIKE ?", snippet.ID, "%"+snippet.Name+"%").
+		Scan(&rows); res.Error != nil {
+		return nil, res.Error
+	}
+
+	include := regexp.MustCompile(`\{\{-?\s*(template|block)\s+"` + regexp.QuoteMeta(snippet.Name) + `"`)
+	var names []string
+	seen := make(map[string]bool)
+	for _, v := range rows {
+		if !seen[v.Name] && include.MatchString(v.Content) {
+			seen[v.Name] = true
+			names = append(names, v.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// validateTemplateID checks that the template of a group or an address exists, and is not a snippet that can't be
+// installed on its own
+func validateTemplateID(tx *gorm.DB, id models.NullInt32) error {
+	if !id.Valid {
+		return nil
+	}
+
+	var item models.Template
+	if res := tx.First(&item, id.Int32); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("the template %d does not exist", id.Int32)
+		}
+		return res.Error
+	}
+	if item.Snippet {
+		return fmt.Errorf("the template %s is a snippet, it can only be included by other templates", item.Name)
+	}
+	return nil
+}
+
+// findTemplateVersion loads a version of a template, version 0 is the latest version
+func findTemplateVersion(id int, version int) (models.TemplateVersion, error) {
+	var item models.TemplateVersion
+
+	query := db.DB.Where("template_id = ?", id)
+	if version > 0 {
+		query = query.Where("version = ?", version)
+	}
+
+	res := query.Order("version desc").First(&item)
+	return item, res.Error
+}
+
+// CreateDefaultTemplate adds the built-in kickstart to the template library, if there is no default template yet
+func CreateDefaultTemplate() error {
+	var count int64
+	if res := db.DB.Model(&models.Template{}).Where("name = ?", defaultTemplateName).Count(&count); res.Error != nil {
+		return res.Error
+	}
+	if count > 0 {
+		return nil
+	}
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		item := models.Template{
+			TemplateForm: models.TemplateForm{
+				Name:        defaultTemplateName,
+				Description: "Kickstart used for hosts that have no custom kickstart or template",
+			},
+			LatestVersion: 1,
+		}
+		if res := tx.Create(&item); res.Error != nil {
+			return res.Error
+		}
+
+		version := models.TemplateVersion{
+			TemplateID: item.ID,
+			Version:    1,
+			TemplateVersionForm: models.TemplateVersionForm{
+				Content: defaultks,
+				Comment: "built-in kickstart",
+			},
+		}
+		return tx.Create(&version).Error
+	})
+}
+
+// diffLines returns a line by line diff of two texts, prefixing removed lines with "-", added lines with "+" and unchanged lines with " "
+func diffLines(a string, b string) string {
+	x := strings.Split(a, "\n")
+	y := strings.Split(b, "\n")
+
+	// longest common subsequence table, lcs[i][j] is the lcs of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			sb.WriteString(" " + x[i] + "\n")
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			sb.WriteString("-" + x[i] + "\n")
+			i++
+		default:
+			sb.WriteString("+" + y[j] + "\n")
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		sb.WriteString("-" + x[i] + "\n")
+	}
+	for ; j < len(y); j++ {
+		sb.WriteString("+" + y[j] + "\n")
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,256 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/config"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// sessionCookie carries the session token of the web interface
+const sessionCookie = "govia_session"
+
+// tokenPrefix makes the tokens of go-via recognizable, e.g. by secret scanners
+const tokenPrefix = "gvia_"
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// ListTokens Get the tokens and sessions of the authenticated user
+// @Summary Get the tokens and sessions of the authenticated user
+// @Tags tokens
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.Token
+// @Failure 500 {object} models.APIError
+// @Router /tokens [get]
+func ListTokens(c *gin.Context) {
+	var items []models.Token
+	if res := db.DB.Where("user_id = ?", CurrentUser(c).ID).Order("id").Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// CreateToken Create a personal api token
+// @Summary Create a personal api token, the secret is only returned once
+// @Tags tokens
+// @Accept  json
+// @Produce  json
+// @Param item body models.TokenForm true "Add a token"
+// @Success 200 {object} models.TokenCreated
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /tokens [post]
+func CreateToken(c *gin.Context) {
+	var form models.TokenForm
+
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	user := CurrentUser(c)
+	if form.Scope != "" && !user.HasRole(form.Scope) {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the scope can't exceed the %s role of the user", user.Role)) // 400
+		return
+	}
+
+	var ttl time.Duration
+	if form.ExpiresIn > 0 {
+		ttl = time.Duration(form.ExpiresIn) * 24 * time.Hour
+	}
+
+	item, err := issueToken(user, form, ttl, false)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+
+	logrus.WithFields(logrus.Fields{
+		"username": user.Username,
+		"token":    item.Prefix,
+		"scope":    item.Scope,
+	}).Info("auth: token created")
+}
+
+// DeleteToken Revoke a token
+// @Summary Revoke a token or session, admins can revoke the tokens of every user
+// @Tags tokens
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Token ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /tokens/{id} [delete]
+func DeleteToken(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item, other users tokens are not found unless the user is an admin
+	user := CurrentUser(c)
+	query := db.DB
+	if !user.HasRole(models.RoleAdmin) {
+		query = query.Where("user_id = ?", user.ID)
+	}
+
+	var item models.Token
+	if res := query.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// Delete it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+
+	logrus.WithFields(logrus.Fields{
+		"username": user.Username,
+		"token":    item.Prefix,
+	}).Info("auth: token revoked")
+}
+
+// Login Start a session of the web interface
+// @Summary Start a session, the token is set as a cookie and returned for use as bearer token
+// @Tags tokens
+// @Accept  json
+// @Produce  json
+// @Param item body models.LoginForm true "Credentials"
+// @Success 200 {object} models.TokenCreated
+// @Failure 400 {object} models.APIError
+// @Failure 401 {object} models.APIError
+// @Router /login [post]
+func Login(conf *config.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var form models.LoginForm
+		if err := c.ShouldBind(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		user, err := authenticate(form.Username, form.Password)
+		auditLogin(c, user, form.Username, err)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"username": form.Username,
+				"status":   "login failed",
+			}).Info("auth")
+			Error(c, http.StatusUnauthorized, fmt.Errorf("invalid username or password")) // 401
+			return
+		}
+
+		// clean up the sessions that can no longer be used
+		db.DB.Where("session AND expires_at < ?", time.Now()).Delete(&models.Token{})
+
+		ttl := time.Duration(conf.Session.TTL) * time.Minute
+		item, err := issueToken(user, models.TokenForm{Name: "session " + c.ClientIP()}, ttl, true)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		c.SetSameSite(http.SameSiteStrictMode)
+		c.SetCookie(sessionCookie, item.Secret, int(ttl.Seconds()), "/", "", true, true)
+		c.JSON(http.StatusOK, item) // 200
+
+		logrus.WithFields(logrus.Fields{
+			"username": user.Username,
+			"status":   "session started",
+		}).Info("auth")
+	}
+}
+
+// Logout End the current session
+// @Summary End the session of the request, personal tokens are revoked with DELETE /tokens/{id}
+// @Tags tokens
+// @Accept  json
+// @Produce  json
+// @Success 204
+// @Router /logout [post]
+func Logout(c *gin.Context) {
+	if token, ok := c.Get("token"); ok && token.(models.Token).Session {
+		db.DB.Delete(&models.Token{}, token.(models.Token).ID)
+	}
+
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(sessionCookie, "", -1, "/", "", true, true)
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+// issueToken creates a token with a new secret, a ttl of 0 never expires
+func issueToken(user models.User, form models.TokenForm, ttl time.Duration, session bool) (models.TokenCreated, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return models.TokenCreated{}, err
+	}
+	secret := tokenPrefix + hex.EncodeToString(b)
+
+	item := models.Token{
+		UserID:    user.ID,
+		TokenForm: form,
+		Prefix:    prefix(secret),
+		Hash:      hashToken(secret),
+		Session:   session,
+	}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl)
+		item.ExpiresAt = &expires
+	}
+
+	if res := db.DB.Create(&item); res.Error != nil {
+		return models.TokenCreated{}, res.Error
+	}
+
+	return models.TokenCreated{Token: item, Secret: secret}, nil
+}
+
+// tokenUser returns the user of a token, with the role limited to the scope of the token
+func tokenUser(secret string) (models.User, models.Token, error) {
+	var token models.Token
+	if res := db.DB.Where("hash = ?", hashToken(secret)).First(&token); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return models.User{}, token, errInvalidToken
+		}
+		return models.User{}, token, res.Error
+	}
+	if token.Expired() {
+		return models.User{}, token, errInvalidToken
+	}
+
+	var user models.User
+	if res := db.DB.First(&user, token.UserID); res.Error != nil {
+		return models.User{}, token, errInvalidToken
+	}
+
+	// only record the use once a minute, to not write on every request
+	now := time.Now()
+	if token.LastUsed == nil || now.Sub(*token.LastUsed) > time.Minute {
+		db.DB.Model(&token).UpdateColumn("last_used", now)
+	}
+
+	return token.Limit(user), token, nil
+}
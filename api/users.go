@@ -64,6 +64,82 @@ func GetUser(c *gin.Context) {
 	c.JSON(http.StatusOK, item) // 200
 }
 
+// GetCurrentUser Get the authenticated user
+// @Summary Get the authenticated user, including its role and group
+// @Tags users
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.User
+// @Router /users/me [get]
+func GetCurrentUser(c *gin.Context) {
+	user := CurrentUser(c)
+	user.Password = ""
+	c.JSON(http.StatusOK, user) // 200
+}
+
+// ChangePassword Change the password of the authenticated user
+// @Summary Change the password of the authenticated user, which ends its other sessions
+// @Tags users
+// @Accept  json
+// @Produce  json
+// @Param item body models.PasswordForm true "Current and new password"
+// @Success 200 {object} models.User
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /users/me/password [post]
+func ChangePassword(c *gin.Context) {
+	var form models.PasswordForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// load the stored user, the current one may be limited by the scope of a token
+	var item models.User
+	if res := db.DB.First(&item, CurrentUser(c).ID); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	if item.Provider != "" && item.Provider != models.ProviderLocal {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the password of %s users is managed by their provider", item.Provider)) // 400
+		return
+	}
+	if !ComparePasswords(item.Password, []byte(form.Current), item.Username) {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the current password is wrong")) // 400
+		return
+	}
+	if form.Password == form.Current {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the new password must differ from the current one")) // 400
+		return
+	}
+	if err := verifyPassword(form.Password); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item.Password = HashAndSalt([]byte(form.Password))
+	item.PasswordChange = false
+	if res := db.DB.Model(&item).UpdateColumns(map[string]interface{}{"password": item.Password, "password_change": false}); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	// end the other sessions, they were started with the old password
+	query := db.DB.Where("user_id = ? AND session", item.ID)
+	if token, ok := c.Get("token"); ok {
+		query = query.Where("id <> ?", token.(models.Token).ID)
+	}
+	query.Delete(&models.Token{})
+
+	item.Password = ""
+	c.JSON(http.StatusOK, item) // 200
+
+	logrus.WithFields(logrus.Fields{
+		"username": item.Username,
+	}).Info("auth: password changed")
+}
+
 // SearchUser Search for a user
 // @Summary Search for a user
 // @Tags users
@@ -121,7 +197,20 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
-	item := models.User{UserForm: form}
+	if err := verifyPassword(form.Password); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item := models.User{UserForm: form, Provider: models.ProviderLocal}
+
+	// new users can only view, unless another role is given
+	if item.Role == "" {
+		item.Role = models.RoleReadOnly
+	}
+	if item.GroupID.Valid && item.GroupID.Int32 == 0 {
+		item.GroupID = models.NullInt32{}
+	}
 
 	// hash and salt the plaintext password
 	hp := HashAndSalt([]byte(item.Password))
@@ -160,6 +249,13 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
+	if form.Password != "" {
+		if err := verifyPassword(form.Password); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+	}
+
 	// Load the item
 	var item models.User
 	if res := db.DB.First(&item, id); res.Error != nil {
@@ -171,14 +267,28 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
+	// there must always be an admin left to manage the users
+	if item.Role == models.RoleAdmin && form.Role != "" && form.Role != models.RoleAdmin && lastAdmin(item) {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the last admin can't be given another role")) // 400
+		return
+	}
+
 	// Merge the item and the form data
 	if err := mergo.Merge(&item, models.User{UserForm: form}, mergo.WithOverride); err != nil {
 		Error(c, http.StatusInternalServerError, err) // 500
 	}
 
-	// hash and salt the plaintext password
-	hp := HashAndSalt([]byte(item.Password))
-	item.Password = hp
+	// a group id of 0 removes the group of an operator
+	if form.GroupID.Valid && form.GroupID.Int32 == 0 {
+		item.GroupID = models.NullInt32{}
+	}
+
+	// hash and salt a new plaintext password, the stored hash is kept otherwise. A new password also unlocks the user.
+	if form.Password != "" {
+		item.Password = HashAndSalt([]byte(form.Password))
+		item.FailedLogins = 0
+		item.LockedUntil = nil
+	}
 
 	// Save it
 	if res := db.DB.Save(&item); res.Error != nil {
@@ -217,6 +327,11 @@ func DeleteUser(c *gin.Context) {
 		return
 	}
 
+	if item.Role == models.RoleAdmin && lastAdmin(item) {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the last admin can't be deleted")) // 400
+		return
+	}
+
 	// Save it
 	if res := db.DB.Delete(&item); res.Error != nil {
 		Error(c, http.StatusInternalServerError, res.Error) // 500
@@ -226,11 +341,24 @@ func DeleteUser(c *gin.Context) {
 	c.JSON(http.StatusNoContent, gin.H{}) //204
 }
 
+// lastAdmin returns true when no other user has the admin role
+func lastAdmin(item models.User) bool {
+	var admins int64
+	db.DB.Model(&models.User{}).Where("role = ? AND id <> ?", models.RoleAdmin, item.ID).Count(&admins)
+	return admins == 0
+}
+
 // functions to hash and compare passwords
 
+// DefaultAdminPassword is the password of the admin of a new database, which has to be changed at the first login
+const DefaultAdminPassword = "VMware1!"
+
+// bcryptCost is the cost of new password hashes
+var bcryptCost = bcrypt.DefaultCost
+
 func HashAndSalt(pwd []byte) string {
 	// Generate hashed and salted password
-	hash, err := bcrypt.GenerateFromPassword(pwd, bcrypt.MinCost)
+	hash, err := bcrypt.GenerateFromPassword(pwd, bcryptCost)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err,
@@ -251,3 +379,8 @@ func ComparePasswords(hashedPwd string, plainPwd []byte, username string) bool {
 	}
 	return true
 }
+
+// IsDefaultPassword returns true when the hash is of the default admin password
+func IsDefaultPassword(hashedPwd string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hashedPwd), []byte(DefaultAdminPassword)) == nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/maxiepax/go-via/api"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+	"github.com/sirupsen/logrus"
+)
+
+// runApply reconciles the database in the working directory with a site file, e.g. go-via apply -f site.yaml -plan
+func runApply(args []string) int {
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	file := flags.String("f", "", "site file in yaml or json")
+	plan := flags.Bool("plan", false, "only show the changes that would be made")
+	prune := flags.Bool("prune", false, "delete pools, groups, hosts, options and device classes that are not in the site")
+	debug := flags.Bool("debug", false, "enable debug logging")
+	flags.Parse(args)
+
+	if *file == "" {
+		flags.Usage()
+		return 2
+	}
+	if !*debug {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+
+	body, err := ioutil.ReadFile(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	site, err := api.DecodeSite(body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *file, err)
+		return 1
+	}
+
+	key := secrets.Init()
+	db.Connect(*debug)
+	if err := migrate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	result, err := api.ApplySite(site, key, *plan, *prune, models.AuditEntry{Username: "cli", Method: "CLI", Path: "apply -f " + *file})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, v := range result.Changes {
+		fmt.Println(v)
+	}
+	switch {
+	case len(result.Changes) == 0:
+		fmt.Println("no changes, the database matches the site")
+	case *plan:
+		fmt.Printf("%d changes planned, run without -plan to apply them\n", len(result.Changes))
+	default:
+		fmt.Printf("%d changes applied\n", len(result.Changes))
+	}
+
+	return 0
+}
+
+// runEncrypt prints a secret encrypted with the secrets key, to be used as a password in a site file
+func runEncrypt(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: go-via encrypt <secret>")
+		return 2
+	}
+
+	logrus.SetLevel(logrus.WarnLevel)
+	ciphertext, err := secrets.Encrypt(args[0], secrets.Init())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(ciphertext)
+	return 0
+}
+
+// runRotateKey re-encrypts all secrets with a new secrets key, and stores the key where the current one came from
+func runRotateKey(args []string) int {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	debug := flags.Bool("debug", false, "log the sql queries")
+	flags.Parse(args)
+
+	logrus.SetLevel(logrus.WarnLevel)
+
+	// a running server would keep using the old key, and lose the secrets saved with it after the rotation
+	if err := db.Lock(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s, stop go-via before rotating the key\n", err)
+		return 1
+	}
+
+	oldKey, source, err := secrets.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	newKey, err := secrets.GenerateKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	commit, err := secrets.Stage(source, newKey)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	db.Connect(*debug)
+	if err := migrate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	count, err := api.RotateKey(oldKey, newKey, models.AuditEntry{Username: "cli", Method: "CLI", Path: "rotate-key"})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s, nothing was changed\n", err)
+		return 1
+	}
+
+	// the secrets are encrypted with the new key now, it must not get lost
+	if err := commit(); err != nil {
+		fmt.Fprintf(os.Stderr, "the secrets are encrypted with the new key, but it can't be stored: %s\n", err)
+		fmt.Println(newKey)
+		return 1
+	}
+
+	fmt.Printf("%d secrets re-encrypted with key %s, replacing key %s\n", count, secrets.KeyID(newKey), secrets.KeyID(oldKey))
+	if source == secrets.SourceEnv || source == secrets.SourceFD {
+		fmt.Fprintf(os.Stderr, "the key comes from the %s, replace it with the new key before go-via is started:\n", source)
+		fmt.Println(newKey)
+	} else {
+		fmt.Println("start go-via again to use the new key")
+	}
+	return 0
+}
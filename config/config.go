@@ -6,8 +6,96 @@ type Config struct {
 	File    string
 	Network Network
 	DisableDhcp bool
+	Pools   Pools
+	Kickstart Kickstart
+	Session Session
+	Ldap    Ldap
+	Oidc    Oidc
+	Security Security
+	Audit   Audit
 }
 
 type Network struct {
 	Interfaces []string
 }
+
+type Pools struct {
+	// How often the utilization of the pools is sampled, in seconds. 0 disables sampling
+	SampleInterval int `default:"60"`
+	// How long utilization samples are kept, in hours
+	SampleRetention int `default:"168"`
+	// Utilization in percent at which a warning is emitted, can be overridden per pool
+	WarningThreshold int `default:"90"`
+}
+
+type Kickstart struct {
+	// How long the one-time token in the kickstart url of boot.cfg is valid, in seconds
+	TokenTTL int `default:"3600"`
+}
+
+type Session struct {
+	// How long a session of the web interface is valid after login, in minutes
+	TTL int `default:"480"`
+}
+
+// Ldap authenticates users that don't exist locally with an LDAP or Active Directory server, enabled when URL is set
+type Ldap struct {
+	// ldap://host:389 or ldaps://host:636
+	URL string
+	// Upgrade an ldap:// connection with StartTLS
+	StartTLS bool
+	// Don't verify the certificate of the server
+	InsecureSkipVerify bool
+	// Account used to search for users, anonymous when empty
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// Filter to find a user, %s is replaced by the escaped username. Use (uid=%s) for OpenLDAP
+	UserFilter string `default:"(sAMAccountName=%s)"`
+	// Attribute of the user that lists the DNs of its groups
+	GroupAttribute string `default:"memberOf"`
+	// DNs of the groups that grant a role, users in none of them can't log in
+	AdminGroup    string
+	OperatorGroup string
+	ReadOnlyGroup string
+	// How long a successful bind is cached, in seconds. 0 disables caching
+	CacheTTL int `default:"300"`
+	// Timeout of the connection and requests, in seconds
+	Timeout int `default:"10"`
+}
+
+// Oidc enables single sign-on with an OpenID Connect provider, when Issuer is set
+type Oidc struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// URL the provider redirects to after login, https://<go-via>:8443/oidc/callback
+	RedirectURL string
+	// Claim with the name of the user
+	UsernameClaim string `default:"preferred_username"`
+	// Claim with the groups of the user
+	GroupsClaim string `default:"groups"`
+	// Names of the groups that grant a role, users in none of them can't log in
+	AdminGroup    string
+	OperatorGroup string
+	ReadOnlyGroup string
+	// Audience of the access tokens of api clients, the ClientID when empty
+	Audience string
+}
+
+type Security struct {
+	// Password of the admin user created on a new database, e.g. from CONFIG_SECURITY_ADMINPASSWORD. When empty the
+	// admin has to choose a new password at the first login
+	AdminPassword string
+	// Cost of the bcrypt password hashes, existing hashes are upgraded at the next login
+	BcryptCost int `default:"12"`
+	// Failed logins after which a user is locked, 0 never locks
+	LockoutThreshold int `default:"5"`
+	// How long a locked user can't log in, in minutes
+	LockoutDuration int `default:"15"`
+}
+
+type Audit struct {
+	// Forward the audit log to syslog: local for the syslog daemon of the host, or udp://host:514 or tcp://host:514
+	Syslog string
+}
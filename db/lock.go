@@ -0,0 +1,25 @@
+package db
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrLocked is returned by Lock when another go-via process holds the database
+var ErrLocked = errors.New("the database is in use by another go-via process")
+
+const lockPath = "database/go-via.lock"
+
+// held is the lock file of this process, it is kept open until the process exits as closing it releases the lock
+var held *os.File
+
+// Lock keeps other go-via processes from using the database until this process exits, e.g. rotate-key can't change the
+// secrets while the server uses the old key. The os releases the lock when the process ends, also when it crashes.
+func Lock() error {
+	f, err := lockFile(lockPath)
+	if err != nil {
+		return err
+	}
+	held = f
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package db
+
+import (
+	"os"
+)
+
+// the database is not locked on this platform
+func lockFile(name string) (*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,30 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package db
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "database", "go-via.lock")
+
+	f, err := lockFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockFile(name); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second lock: got %v, want %v", err, ErrLocked)
+	}
+
+	// the lock is released with the file, e.g. when the server exits
+	f.Close()
+	f, err = lockFile(name)
+	if err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+	f.Close()
+}
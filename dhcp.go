@@ -13,12 +13,24 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/maxiepax/go-via/api"
 	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/metrics"
 	"github.com/maxiepax/go-via/models"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
+// errIgnored is returned for message types that a server does not answer
+var errIgnored = errors.New("ignored")
+
 func processPacket(t layers.DHCPMsgType, req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (resp *layers.DHCPv4, err error) {
+	// the packets of all interfaces are processed one at a time, so two clients can never be handed the same address
+	models.AllocationMu.Lock()
+	defer models.AllocationMu.Unlock()
+
+	defer func() {
+		countPacket(t, resp, err)
+	}()
+
 	switch t {
 	case layers.DHCPMsgTypeDiscover:
 		return processDiscover(req, sourceNet, ip)
@@ -27,70 +39,117 @@ func processPacket(t layers.DHCPMsgType, req *layers.DHCPv4, sourceNet net.IP, i
 	case layers.DHCPMsgTypeRelease:
 		//return "Release"
 	case layers.DHCPMsgTypeInform:
-		return nil, fmt.Errorf("ignored, inform type")
+		return nil, fmt.Errorf("%w, inform type", errIgnored)
 	case layers.DHCPMsgTypeDecline:
 		return processDecline(req, sourceNet, ip)
 
 	case layers.DHCPMsgTypeUnspecified:
-		return nil, fmt.Errorf("ignored, unspecified type")
+		return nil, fmt.Errorf("%w, unspecified type", errIgnored)
 	case layers.DHCPMsgTypeOffer:
-		return nil, fmt.Errorf("ignored, offer type")
+		return nil, fmt.Errorf("%w, offer type", errIgnored)
 	case layers.DHCPMsgTypeAck:
-		return nil, fmt.Errorf("ignored, ack type")
+		return nil, fmt.Errorf("%w, ack type", errIgnored)
 	case layers.DHCPMsgTypeNak:
-		return nil, fmt.Errorf("ignored, nak type")
+		return nil, fmt.Errorf("%w, nak type", errIgnored)
 	}
 
 	return nil, fmt.Errorf("unknown dhcp request type")
 }
 
-func processDiscover(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (resp *layers.DHCPv4, err error) {
-	// Find all reimage addresses that is not yet assigned a pool
-	var reimageAddresses []models.Address
-	if res := db.DB.Where("pool_id IS NULL").Where("reimage = 1").Find(&reimageAddresses); res.Error != nil {
-		if !errors.Is(res.Error, gorm.ErrRecordNotFound) {
-			return nil, res.Error
+// countPacket records the outcome of a processed packet, ignored packets are labeled with a short reason
+func countPacket(t layers.DHCPMsgType, resp *layers.DHCPv4, err error) {
+	result := "none"
+	reason := ""
+
+	switch {
+	case err != nil:
+		result = "ignored"
+		switch {
+		case errors.Is(err, errIgnored):
+			reason = "message_type"
+		case errors.Is(err, api.ErrNoPool):
+			reason = "no_pool"
+		case errors.Is(err, models.ErrPoolExhausted):
+			reason = "pool_exhausted"
+		case errors.Is(err, models.ErrNotFlaggedForReimage):
+			reason = "not_flagged_for_reimage"
+		default:
+			reason = "error"
 		}
+	case resp != nil:
+		result = strings.ToLower(findMsgType(resp).String())
 	}
 
-	pool, err := api.FindPool(sourceNet.String())
+	metrics.DHCPPackets.WithLabelValues(strings.ToLower(t.String()), result, reason).Inc()
+}
+
+func processDiscover(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (resp *layers.DHCPv4, err error) {
+	pools, err := api.FindPools(sourceNet.String())
 	if err != nil {
 		return nil, err
 	}
 
-	// Make a list of all reimage and pool addresses
-	addresses := append(reimageAddresses, pool.Addresses...)
+	// Make a list of all reimage and pool addresses for our mac address and other identifiers
+	id := identify(req)
+	addresses, err := findAddresses(pools, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// A host found by another identifier is handled as the mac it is registered with
+	mac := id.registeredMac(addresses)
 
 	// Search in the list for our mac address
 	var leaseIP net.IP
 	var lease *models.Address
+	var pool *models.PoolWithAddresses
 	for _, v := range addresses {
-		// Make sure the reimage IP is within the pool
+		if v.Mac != mac {
+			continue
+		}
+
+		// Make sure the reimage IP is within one of the pools
 		parsedIp := net.ParseIP(v.IP)
-		ok, _ := pool.Contains(parsedIp)
+		p := pools.PoolFor(parsedIp)
+		if p == nil {
+			continue
+		}
 
 		// Check so we havent given someone else this IP
-		err := pool.IsAvailableExcept(parsedIp, req.ClientHWAddr.String())
-
-		if v.Mac == req.ClientHWAddr.String() && ok && err == nil {
+		if err := p.IsAvailableExcept(parsedIp, mac); err == nil {
 			leaseIP = parsedIp
 			lease = &v
+			pool = p
 			break
 		}
 	}
 
 	// Dont answer pools with "only serve requested" flag set
-	if pool.OnlyServeReimage && (lease == nil || !lease.Reimage) {
-		return nil, fmt.Errorf("ignored because mac address is not flagged for re-imaging")
+	if pool != nil && pool.OnlyServeReimage && !lease.Reimage {
+		return nil, models.ErrNotFlaggedForReimage
 	}
 
+	// Offer the same address again if the client already has a pending offer
 	if leaseIP == nil {
-		leaseIP, err = pool.Next()
+		if offered := models.Offers.Lookup(mac); offered != nil {
+			if p := pools.PoolFor(offered); p != nil && !p.OnlyServeReimage && p.IsAvailableExcept(offered, mac) == nil {
+				leaseIP = offered
+				pool = p
+			}
+		}
+	}
+
+	// Try the pools of the shared network in order until one has a free address
+	if leaseIP == nil {
+		pool, leaseIP, err = pools.Next()
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	// Hold the address for this client until it is requested or the offer times out
+	models.Offers.Add(leaseIP, mac)
+
 	resp = &layers.DHCPv4{
 		Operation:    layers.DHCPOpReply,
 		HardwareType: layers.LinkTypeEthernet,
@@ -115,22 +174,21 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 		spew.Dump(opt82)
 	}*/
 
-	// Find all reimage addresses that is not yet assigned a pool
-	var reimageAddresses []models.Address
-	if res := db.DB.Where("pool_id IS NULL").Where("reimage = 1").Find(&reimageAddresses); res.Error != nil {
-		if !errors.Is(res.Error, gorm.ErrRecordNotFound) {
-			return nil, res.Error
-		}
+	// Figure out and get the pools
+	pools, err := api.FindPools(sourceNet.String())
+	if err != nil {
+		return nil, err
 	}
 
-	// Figure out and get the pool
-	pool, err := api.FindPool(sourceNet.String())
+	// Make a list of all reimage and pool addresses for our mac address and other identifiers
+	id := identify(req)
+	addresses, err := findAddresses(pools, id)
 	if err != nil {
 		return nil, err
 	}
 
-	// Make a list of all reimage and pool addresses
-	addresses := append(reimageAddresses, pool.Addresses...)
+	// A host found by another identifier is handled as the mac it is registered with
+	mac := id.registeredMac(addresses)
 
 	// Extract the requested IP
 	var requestedIP net.IP = req.ClientIP
@@ -150,19 +208,28 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 		NextServerIP: ip.To4(),
 	}
 
+	// Figure out which pool of the shared network the requested IP belongs to
+	pool := pools.PoolFor(requestedIP)
+	if pool == nil {
+		logrus.WithFields(logrus.Fields{
+			"pool":      pools[0].ID,
+			"requested": requestedIP.String(),
+		}).Warnf("dhcp: the requested ip does not belong to any pool")
+		resp.Options = append(resp.Options, layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeNak)}))
+		return resp, nil
+	}
+
 	// Try to find the lease in our address list
 	var lease *models.Address
 	for _, v := range addresses {
-		// Check so the IP is part of the pool
+		// Check so the IP is part of one of the pools, and that we havent given someone else this IP
 		parsedIp := net.ParseIP(v.IP)
-		ok, _ := pool.Contains(parsedIp)
-
-		// Check so we havent given someone else this IP
-		err := pool.IsAvailableExcept(parsedIp, req.ClientHWAddr.String())
+		p := pools.PoolFor(parsedIp)
+		ok := p != nil && p.IsAvailableExcept(parsedIp, mac) == nil
 
-		if v.Mac == req.ClientHWAddr.String() && v.IP != requestedIP.String() && v.Expires.After(time.Now()) && ok && err == nil {
+		if v.Mac == mac && v.IP != requestedIP.String() && v.Expires.After(time.Now()) && ok {
 			logrus.WithFields(logrus.Fields{
-				"pool":      pool.ID,
+				"pool":      p.ID,
 				"expected":  v.IP,
 				"requested": requestedIP.String(),
 			}).Warn("dhcp: wrong ip requested")
@@ -170,7 +237,7 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 			return resp, nil
 		}
 
-		if v.Mac == req.ClientHWAddr.String() {
+		if v.Mac == mac {
 			foundLease := models.Address(v)
 			lease = &foundLease
 		}
@@ -178,7 +245,11 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 
 	// Check if the requested IP is available
 	if lease == nil || lease.IP != requestedIP.String() {
-		if err := pool.IsAvailable(requestedIP); err != nil {
+		err := pool.IsAvailableExcept(requestedIP, mac)
+		if err == nil && pool.Excluded(requestedIP) {
+			err = fmt.Errorf("excluded from the pool")
+		}
+		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"pool":      pool.ID,
 				"requested": requestedIP.String(),
@@ -191,7 +262,7 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 
 	// Make sure the address isnt already used
 	if lease != nil {
-		if err := pool.IsAvailableExcept(requestedIP, req.ClientHWAddr.String()); err != nil {
+		if err := pool.IsAvailableExcept(requestedIP, mac); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"pool":      pool.ID,
 				"requested": requestedIP.String(),
@@ -204,14 +275,14 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 
 	// Dont answer pools with "only serve requested" flag set
 	if pool.OnlyServeReimage && (lease == nil || !lease.Reimage) {
-		return nil, fmt.Errorf("ignored because mac address is not flagged for reimaging")
+		return nil, models.ErrNotFlaggedForReimage
 	}
 
 	// Its a new lease!
 	if lease == nil {
 		lease = &models.Address{
 			AddressForm: models.AddressForm{
-				Mac:      req.ClientHWAddr.String(),
+				Mac:      mac,
 				Hostname: "-",
 				Reimage:  false,
 			},
@@ -233,6 +304,7 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 	lease.IP = requestedIP.String()
 	lease.PoolID = models.NullInt32{sql.NullInt32{int32(pool.ID), true}}
 	lease.LastSeenRelay = req.RelayAgentIP.String()
+	lease.BootMac = req.ClientHWAddr.String()
 	if (lease.FirstSeen == time.Time{}) {
 		lease.FirstSeen = time.Now()
 	}
@@ -240,17 +312,73 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 	lease.Expires = time.Now().Add(3600 * time.Second)
 	lease.MissingOptions = listMissingOptions(req, resp)
 
-	if lease.ID == 0 {
-		db.DB.Create(lease)
-	} else {
+	// Unknown clients of a discovery pool are recorded, and registered to a group when one of the rules matches
+	var discovered *models.DiscoveredHost
+	var rule *models.GroupRule
+	if pool.Discovery && !lease.GroupID.Valid {
+		host, err := discoverClient(req, pool, requestedIP)
+		if err == nil {
+			discovered = &host
+			rule, err = api.AssignGroupRules(db.DB, lease, host)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"mac": req.ClientHWAddr.String(),
+				"err": err,
+			}).Warn("dhcp: could not assign the discovered client")
+		}
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if lease.ID == 0 {
+			return tx.Create(lease).Error
+		}
+
 		// Remove the previous record if there is any
-		db.DB.Exec("DELETE FROM addresses WHERE ip=? AND reimage=0 AND expires <= datetime('now', 'utc')", lease.IP)
-		db.DB.Save(lease)
+		if res := tx.Exec("DELETE FROM addresses WHERE ip=? AND reimage=0 AND expires <= datetime('now', 'utc')", lease.IP); res.Error != nil {
+			return res.Error
+		}
+		return tx.Save(lease).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The address is leased now, so the offer is no longer needed
+	models.Offers.Remove(requestedIP)
+
+	if rule != nil {
+		api.AuditGroupRule(models.AuditEntry{Username: "dhcp", IP: requestedIP.String()}, rule, *lease)
+	}
+
+	// Keep an inventory of the discovered clients, and which address they were assigned
+	if discovered != nil {
+		if lease.GroupID.Valid {
+			discovered.AddressID.Int32, discovered.AddressID.Valid = int32(lease.ID), true
+		}
+		if res := db.DB.Save(discovered); res.Error != nil {
+			logrus.WithFields(logrus.Fields{
+				"mac": req.ClientHWAddr.String(),
+				"err": res.Error,
+			}).Warn("dhcp: could not record the discovered client")
+		}
 	}
 
 	return resp, nil
 }
 
+// findAddresses returns all addresses of a client that are either part of the pools, or reserved for re-imaging but not yet assigned a pool
+func findAddresses(pools models.SharedNetwork, id client) ([]models.Address, error) {
+	var addresses []models.Address
+	if res := db.DB.Where("mac = ? OR (client_id <> '' AND client_id = ?) OR (uuid <> '' AND uuid = ?)", id.mac, id.clientID, id.uuid).Where("pool_id IN ? OR (pool_id IS NULL AND reimage = 1)", pools.IDs()).Find(&addresses); res.Error != nil {
+		if !errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, res.Error
+		}
+	}
+
+	return addresses, nil
+}
+
 func listMissingOptions(req *layers.DHCPv4, resp *layers.DHCPv4) string {
 	requested := map[byte]struct{}{}
 	for _, v := range req.Options {
@@ -278,7 +406,7 @@ func listMissingOptions(req *layers.DHCPv4, resp *layers.DHCPv4) string {
 // a IP address conflict was detected, add/update the address table to block that address from being used for a while (lease time)
 func processDecline(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DHCPv4, error) {
 
-	pool, err := api.FindPool(sourceNet.String())
+	pools, err := api.FindPools(sourceNet.String())
 	if err != nil {
 		return nil, err
 	}
@@ -290,12 +418,19 @@ func processDecline(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 		}
 	}
 
+	pool := pools.PoolFor(requestedIP)
+	if pool == nil {
+		return nil, fmt.Errorf("declined ip %s does not belong to any pool", requestedIP)
+	}
+
 	// Try to find the lease in our address history
 	var lease *models.Address
-	for _, v := range pool.Addresses {
-		if v.IP == requestedIP.To4().String() {
-			lease = &v
-		}
+	var history []models.Address
+	if res := db.DB.Where("pool_id = ? AND ip = ?", pool.ID, requestedIP.To4().String()).Limit(1).Find(&history); res.Error != nil {
+		return nil, res.Error
+	}
+	if len(history) > 0 {
+		lease = &history[0]
 	}
 
 	// Its an unknown device
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/gopacket/layers"
+	"github.com/maxiepax/go-via/api"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB replaces the database with an empty, migrated one in a temporary directory
+func testDB(tb testing.TB) {
+	tb.Helper()
+
+	conn, err := gorm.Open(sqlite.Open(filepath.Join(tb.TempDir(), "test.db")+"?_busy_timeout=5000"), &gorm.Config{
+		SkipDefaultTransaction:                   true,
+		DisableForeignKeyConstraintWhenMigrating: true,
+		Logger:                                   logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	previous := db.DB
+	db.DB = conn
+	tb.Cleanup(func() {
+		db.DB = previous
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	if err := migrate(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// dhcpClient runs a discover and a request for the mac, and returns the acknowledged address
+func dhcpClient(mac net.HardwareAddr, xid uint32) (net.IP, error) {
+	sourceNet, server := net.ParseIP("10.0.0.0"), net.ParseIP("10.0.0.2")
+
+	discover := &layers.DHCPv4{Operation: layers.DHCPOpRequest, Xid: xid, ClientHWAddr: mac}
+	discover.Options = append(discover.Options, layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeDiscover)}))
+	offer, err := processPacket(layers.DHCPMsgTypeDiscover, discover, sourceNet, server)
+	if err != nil {
+		return nil, fmt.Errorf("discover: %w", err)
+	}
+
+	request := &layers.DHCPv4{Operation: layers.DHCPOpRequest, Xid: xid, ClientHWAddr: mac}
+	request.Options = append(request.Options,
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeRequest)}),
+		layers.NewDHCPOption(layers.DHCPOptRequestIP, offer.YourClientIP.To4()),
+	)
+	ack, err := processPacket(layers.DHCPMsgTypeRequest, request, sourceNet, server)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	for _, v := range ack.Options {
+		if v.Type == layers.DHCPOptMessageType && layers.DHCPMsgType(v.Data[0]) != layers.DHCPMsgTypeAck {
+			return nil, fmt.Errorf("request of %s: got %s", offer.YourClientIP, layers.DHCPMsgType(v.Data[0]))
+		}
+	}
+
+	return ack.YourClientIP, nil
+}
+
+// createHost adds a host to the group without an ip through the api, so its address is assigned from the pool
+func createHost(groupID int, mac string) (net.IP, error) {
+	body, _ := json.Marshal(map[string]interface{}{"mac": mac, "hostname": "host", "domain": "example.com", "group_id": groupID})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/addresses", bytes.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	api.CreateAddress(c)
+
+	if w.Code != http.StatusOK {
+		return nil, fmt.Errorf("create host: %d %s", w.Code, w.Body.String())
+	}
+
+	var item models.Address
+	if err := json.Unmarshal(w.Body.Bytes(), &item); err != nil {
+		return nil, err
+	}
+	return net.ParseIP(item.IP), nil
+}
+
+func TestConcurrentAllocation(t *testing.T) {
+	testDB(t)
+	gin.SetMode(gin.TestMode)
+
+	pool := models.Pool{PoolForm: models.PoolForm{Name: "pool", StartAddress: "10.0.0.10", EndAddress: "10.0.0.250", Netmask: 24, LeaseTime: 3600, Gateway: "10.0.0.1"}}
+	if res := db.DB.Create(&pool); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	group := models.Group{GroupForm: models.GroupForm{PoolID: pool.ID, Name: "esx"}}
+	if res := db.DB.Create(&group); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	const clients, hosts = 60, 20
+
+	var wg sync.WaitGroup
+	ips := make(chan net.IP, clients+hosts)
+	errs := make(chan error, clients+hosts)
+
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip, err := dhcpClient(net.HardwareAddr{0x00, 0x50, 0x56, 0x00, 0x00, byte(i)}, uint32(i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			ips <- ip
+		}(i)
+	}
+	for i := 0; i < hosts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip, err := createHost(group.ID, fmt.Sprintf("00:50:56:00:01:%02x", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			ips <- ip
+		}(i)
+	}
+	wg.Wait()
+	close(ips)
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	seen := make(map[string]struct{})
+	for ip := range ips {
+		if _, ok := seen[ip.String()]; ok {
+			t.Errorf("%s was handed out twice", ip)
+		}
+		seen[ip.String()] = struct{}{}
+	}
+	if len(seen) != clients+hosts {
+		t.Errorf("got %d unique addresses, want %d", len(seen), clients+hosts)
+	}
+
+	// every stored address is unique too
+	var duplicates []string
+	if res := db.DB.Model(&models.Address{}).Group("ip").Having("COUNT(*) > 1").Pluck("ip", &duplicates); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if len(duplicates) > 0 {
+		t.Errorf("addresses stored more than once: %v", duplicates)
+	}
+}
+
+func TestReportedSerialDoesNotIdentify(t *testing.T) {
+	testDB(t)
+	gin.SetMode(gin.TestMode)
+
+	pool := models.Pool{PoolForm: models.PoolForm{Name: "pool", StartAddress: "10.0.0.10", EndAddress: "10.0.0.250", Netmask: 24, LeaseTime: 3600, Gateway: "10.0.0.1"}}
+	if res := db.DB.Create(&pool); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	group := models.Group{GroupForm: models.GroupForm{PoolID: pool.ID, Name: "esx"}}
+	if res := db.DB.Create(&group); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	registered, err := createHost(group.ID, "00:50:56:00:00:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := db.DB.Model(&models.Address{}).Where("mac = ?", "00:50:56:00:00:01").Update("serial", "SN1"); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	// another machine posts the serial of the registered host from discovery
+	spoofer := net.HardwareAddr{0x00, 0x50, 0x56, 0x00, 0x00, 0x02}
+	if res := db.DB.Create(&models.DiscoveredHost{Mac: spoofer.String(), Facts: []byte(`{"serial": "SN1"}`)}); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	ip, err := dhcpClient(spoofer, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.Equal(registered) {
+		t.Fatalf("the machine reporting the serial was handed the address %s of the registered host", ip)
+	}
+
+	var item models.Address
+	if res := db.DB.Where("ip = ?", registered.String()).First(&item); res.Error != nil || item.Mac != "00:50:56:00:00:01" || !item.GroupID.Valid {
+		t.Fatalf("the registered host changed: %+v, %v", item, res.Error)
+	}
+}
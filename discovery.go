@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// DHCP options that identify a client, see RFC 4578 and RFC 3046
+const (
+	dhcpOptClientArch  layers.DHCPOpt = 93
+	dhcpOptClientUUID  layers.DHCPOpt = 97
+	dhcpOptRelayAgent  layers.DHCPOpt = 82
+	relayAgentCircuit  byte           = 1
+	relayAgentRemoteID byte           = 2
+)
+
+// discoverClient returns the discovered host of a client that is not registered as an address, updated with the
+// details of the request. It is not saved, as it is assigned an address when one of the group rules matches.
+func discoverClient(req *layers.DHCPv4, pool *models.PoolWithAddresses, ip net.IP) (models.DiscoveredHost, error) {
+	mac := req.ClientHWAddr.String()
+
+	var item models.DiscoveredHost
+	if res := db.DB.Where("mac = ?", mac).First(&item); res.Error != nil {
+		if !errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return item, res.Error
+		}
+		item = models.DiscoveredHost{Mac: mac, FirstSeen: time.Now()}
+	}
+
+	item.IP = ip.String()
+	item.PoolID = models.NullInt32{NullInt32: sql.NullInt32{Int32: int32(pool.ID), Valid: true}}
+	item.Relay = req.RelayAgentIP.String()
+	item.LastSeen = time.Now()
+
+	for _, v := range req.Options {
+		switch v.Type {
+		case layers.DHCPOptClassID:
+			item.VendorClass = string(v.Data)
+		case dhcpOptClientArch:
+			if len(v.Data) >= 2 {
+				item.ClientArch = int(binary.BigEndian.Uint16(v.Data))
+			}
+		case dhcpOptClientUUID:
+			if uuid, ok := decodeClientUUID(v.Data); ok {
+				item.UUID = uuid
+			}
+		case dhcpOptRelayAgent:
+			circuit, remote := decodeRelayAgent(v.Data)
+			item.CircuitID = circuit
+			item.RemoteID = remote
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"mac":          item.Mac,
+		"ip":           item.IP,
+		"vendor_class": item.VendorClass,
+		"uuid":         item.UUID,
+	}).Debug("discovery")
+
+	return item, nil
+}
+
+// decodeClientUUID formats the client machine identifier, which is a type byte of 0 followed by a 16 byte uuid
+func decodeClientUUID(data []byte) (string, bool) {
+	if len(data) != 17 || data[0] != 0 {
+		return "", false
+	}
+	b := data[1:]
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), true
+}
+
+// decodeRelayAgent returns the circuit id and remote id sub-options of the relay agent information
+func decodeRelayAgent(data []byte) (circuit string, remote string) {
+	for len(data) >= 2 {
+		code, length := data[0], int(data[1])
+		if len(data) < 2+length {
+			break
+		}
+		value := data[2 : 2+length]
+		switch code {
+		case relayAgentCircuit:
+			circuit = printable(value)
+		case relayAgentRemoteID:
+			remote = printable(value)
+		}
+		data = data[2+length:]
+	}
+	return circuit, remote
+}
+
+// printable returns the value as text, or as hex when switches encode it as binary
+func printable(b []byte) string {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Sprintf("%x", b)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"github.com/maxiepax/go-via/models"
+)
+
+// client are the identifiers a dhcp client can be registered with
+type client struct {
+	mac      string
+	clientID string
+	uuid     string
+}
+
+// identify returns the identifiers of the client of a request. The serial number reported from discovery is not one of
+// them, as any host can post the facts of its address without authentication.
+func identify(req *layers.DHCPv4) client {
+	c := client{mac: req.ClientHWAddr.String()}
+
+	for _, v := range req.Options {
+		switch v.Type {
+		case layers.DHCPOptClientID:
+			c.clientID = formatClientID(v.Data)
+		case dhcpOptClientUUID:
+			c.uuid, _ = decodeClientUUID(v.Data)
+		}
+	}
+
+	return c
+}
+
+// identifies returns true when the address is registered with one of the identifiers of the client
+func (c client) identifies(a models.Address) bool {
+	switch {
+	case a.Mac == c.mac:
+		return true
+	case a.ClientID != "" && a.ClientID == c.clientID:
+		return true
+	case a.UUID != "" && a.UUID == c.uuid:
+		return true
+	}
+	return false
+}
+
+// registeredMac returns the mac address the client is registered with. It is the mac of the booting nic, unless the
+// client was only found by one of its other identifiers.
+func (c client) registeredMac(addresses []models.Address) string {
+	for _, v := range addresses {
+		if v.Mac == c.mac {
+			return c.mac
+		}
+	}
+	for _, v := range addresses {
+		if c.identifies(v) {
+			return v.Mac
+		}
+	}
+	return c.mac
+}
+
+// formatClientID formats a client identifier as lower case colon separated hex, e.g. 01:00:50:56:00:00:01
+func formatClientID(data []byte) string {
+	parts := make([]string, len(data))
+	for i, b := range data {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
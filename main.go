@@ -22,6 +22,8 @@ import (
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/koding/multiconfig"
@@ -45,6 +47,17 @@ var (
 // @BasePath /v1
 
 func main() {
+	// subcommands work on the database directly and exit
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "apply":
+			os.Exit(runApply(os.Args[2:]))
+		case "encrypt":
+			os.Exit(runEncrypt(os.Args[2:]))
+		case "rotate-key":
+			os.Exit(runRotateKey(os.Args[2:]))
+		}
+	}
 
 	logServer := websockets.NewLogServer()
 	logrus.AddHook(logServer.Hook)
@@ -123,6 +136,11 @@ func main() {
 	// load secrets key
 	key := secrets.Init()
 
+	//hold the database, rotate-key must not re-encrypt the secrets while the server uses the old key
+	if err := db.Lock(); err != nil {
+		logrus.Fatal(err)
+	}
+
 	//connect to database
 	//db.Connect(true)
 	if conf.Debug {
@@ -134,7 +152,7 @@ func main() {
 	}
 
 	//migrate all models
-	err = db.DB.AutoMigrate(&models.Pool{}, &models.Address{}, &models.Option{}, &models.DeviceClass{}, &models.Group{}, &models.Image{}, &models.User{})
+	err = migrate()
 	if err != nil {
 		logrus.Fatal(err)
 	}
@@ -152,10 +170,40 @@ func main() {
 		logrus.Warning(res.Error)
 	}
 
-	//create admin user if it doesn't exist
+	//create the default kickstart template
+	if err := api.CreateDefaultTemplate(); err != nil {
+		logrus.Warning(err)
+	}
+
+	//the bcrypt cost applies to the admin password
+	api.SetupProviders(conf)
+	api.SetupAudit(conf)
+
+	//create admin user if it doesn't exist, with the configured password or the default one that has to be changed
 	var adm models.User
-	hp := api.HashAndSalt([]byte("VMware1!"))
-	if res := db.DB.Where(models.User{UserForm: models.UserForm{Username: "admin"}}).Attrs(models.User{UserForm: models.UserForm{Password: hp}}).FirstOrCreate(&adm); res.Error != nil {
+	attrs := models.User{UserForm: models.UserForm{Role: models.RoleAdmin}, Provider: models.ProviderLocal, PasswordChange: true}
+	if conf.Security.AdminPassword != "" {
+		attrs.Password = api.HashAndSalt([]byte(conf.Security.AdminPassword))
+		attrs.PasswordChange = false
+	} else {
+		attrs.Password = api.HashAndSalt([]byte(api.DefaultAdminPassword))
+	}
+	if res := db.DB.Where(models.User{UserForm: models.UserForm{Username: "admin"}}).Attrs(attrs).FirstOrCreate(&adm); res.Error != nil {
+		logrus.Warning(res.Error)
+	}
+
+	//an admin that still has the default password from before it had to be changed
+	if !adm.PasswordChange && api.IsDefaultPassword(adm.Password) {
+		if conf.Security.AdminPassword != "" {
+			db.DB.Model(&adm).UpdateColumn("password", api.HashAndSalt([]byte(conf.Security.AdminPassword)))
+		} else {
+			db.DB.Model(&adm).UpdateColumn("password_change", true)
+			logrus.Warning("the admin user has the default password, it has to be changed at the next login")
+		}
+	}
+
+	//users from before roles were introduced could do everything
+	if res := db.DB.Model(&models.User{}).Where("role IS NULL OR role = ''").Update("role", models.RoleAdmin); res.Error != nil {
 		logrus.Warning(res.Error)
 	}
 
@@ -169,6 +217,9 @@ func main() {
 	// TFTPd
 	go TFTPd(conf)
 
+	// record the pool utilization
+	go api.SamplePools(conf)
+
 	//REST API
 	r := gin.New()
 	r.Use(cors.Default())
@@ -181,47 +232,23 @@ func main() {
 	// ks.cfg is served at top to not place it behind BasicAuth
 	r.GET("ks.cfg", api.Ks(key))
 
-	// middleware to check if user is logged in
-	r.Use(func(c *gin.Context) {
-		username, password, hasAuth := c.Request.BasicAuth()
-		if !hasAuth {
-			logrus.WithFields(logrus.Fields{
-				"login": "unauthorized request",
-			}).Info("auth")
-			c.Writer.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
-		}
+	// unregistered hosts in discovery report their hardware without credentials
+	discovery := r.Group("/discovery")
+	{
+		discovery.GET("ks.cfg", api.DiscoveryKs)
+		discovery.POST("facts", api.DiscoveryFacts)
+	}
 
-		//get the user that is trying to authenticate
-		var user models.User
-		if res := db.DB.Select("username", "password").Where("username = ?", username).First(&user); res.Error != nil {
-			logrus.WithFields(logrus.Fields{
-				"username": username,
-				"status":   "supplied username does not exist",
-			}).Info("auth")
-			c.Writer.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
-		}
+	// the web interface exchanges the credentials for a session cookie
+	r.POST("login", api.Login(conf))
+	r.GET("oidc/login", api.OidcLogin)
+	r.GET("oidc/callback", api.OidcCallback(conf))
 
-		//check if passwords match
-		if api.ComparePasswords(user.Password, []byte(password), username) {
-			logrus.WithFields(logrus.Fields{
-				"username": username,
-				"status":   "successfully authenticated",
-			}).Debug("auth")
-		} else {
-			logrus.WithFields(logrus.Fields{
-				"username": username,
-				"status":   "invalid password supplied",
-			}).Info("auth")
-			c.Writer.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
-		}
-		c.Next()
-	})
+	// middleware to check if user is logged in
+	r.Use(api.Authenticate())
+
+	// record the changes and sensitive actions of the users
+	r.Use(api.Audit())
 
 	r.NoRoute(func(c *gin.Context) {
 		c.Request.URL.Path = "/web/" // force us to always return index.html and not the requested page to be compatible with HTML5 routing
@@ -239,7 +266,7 @@ func main() {
 	{
 		//v1.GET("log", logServer.Handle)
 
-		pools := v1.Group("/pools")
+		pools := v1.Group("/pools", api.Permit(models.RoleAdmin))
 		{
 			pools.GET("", api.ListPools)
 			pools.GET(":id", api.GetPool)
@@ -249,23 +276,78 @@ func main() {
 			pools.DELETE(":id", api.DeletePool)
 
 			pools.GET(":id/next", api.GetNextFreeIP)
+			pools.GET(":id/stats", api.GetPoolStats)
+
+			pools.GET(":id/ranges", api.ListPoolRanges)
+			pools.POST(":id/ranges", api.CreatePoolRange)
+			pools.DELETE(":id/ranges/:range_id", api.DeletePoolRange)
 		}
-		relay := v1.Group("/relay")
+		relay := v1.Group("/relay", api.Permit(models.RoleAdmin))
 		{
 			relay.GET(":relay", api.GetPoolByRelay)
 		}
 
-		addresses := v1.Group("/addresses")
+		addresses := v1.Group("/addresses", api.Permit(models.RoleOperator))
 		{
 			addresses.GET("", api.ListAddresses)
 			addresses.GET(":id", api.GetAddress)
 			addresses.POST("/search", api.SearchAddress)
+			addresses.POST("/import", api.ImportAddresses)
+			addresses.GET("/export", api.ExportAddresses)
 			addresses.POST("", api.CreateAddress)
 			addresses.PATCH(":id", api.UpdateAddress)
 			addresses.DELETE(":id", api.DeleteAddress)
+
+			addresses.GET(":id/ks/preview", api.PreviewKs)
+			addresses.GET(":id/attributes", api.GetAddressAttributes)
+			addresses.GET(":id/credentials", api.Require(models.RoleAdmin), api.GetAddressCredentials(key))
+		}
+
+		attributes := v1.Group("/attributes", api.Permit(models.RoleAdmin))
+		{
+			attributes.GET("", api.ListAttributes)
+			attributes.GET(":id", api.GetAttribute)
+			attributes.POST("", api.CreateAttribute)
+			attributes.PATCH(":id", api.UpdateAttribute)
+			attributes.DELETE(":id", api.DeleteAttribute)
+		}
+
+		discovered := v1.Group("/discovered", api.Permit(models.RoleOperator))
+		{
+			discovered.GET("", api.ListDiscoveredHosts)
+			discovered.GET(":id", api.GetDiscoveredHost)
+			discovered.DELETE(":id", api.DeleteDiscoveredHost)
+			discovered.POST(":id/claim", api.ClaimDiscoveredHost)
+		}
+
+		accounts := v1.Group("/accounts", api.Permit(models.RoleAdmin))
+		{
+			accounts.GET("", api.ListAccounts)
+			accounts.GET(":id", api.GetAccount)
+			accounts.POST("", api.CreateAccount(key))
+			accounts.PATCH(":id", api.UpdateAccount(key))
+			accounts.DELETE(":id", api.DeleteAccount)
+		}
+
+		groupRules := v1.Group("/group_rules", api.Permit(models.RoleAdmin))
+		{
+			groupRules.GET("", api.ListGroupRules)
+			groupRules.GET(":id", api.GetGroupRule)
+			groupRules.POST("", api.CreateGroupRule)
+			groupRules.PATCH(":id", api.UpdateGroupRule)
+			groupRules.DELETE(":id", api.DeleteGroupRule)
+		}
+
+		v1.POST("/apply", api.Require(models.RoleAdmin), api.Apply(key))
+
+		v1.GET("/audit", api.Require(models.RoleAdmin), api.ListAudit)
+
+		ks := v1.Group("/ks")
+		{
+			ks.POST("/lint", api.LintKs)
 		}
 
-		options := v1.Group("/options")
+		options := v1.Group("/options", api.Permit(models.RoleAdmin))
 		{
 			options.GET("", api.ListOptions)
 			options.GET(":id", api.GetOption)
@@ -275,7 +357,7 @@ func main() {
 			options.DELETE(":id", api.DeleteOption)
 		}
 
-		deviceClass := v1.Group("/device_classes")
+		deviceClass := v1.Group("/device_classes", api.Permit(models.RoleAdmin))
 		{
 			deviceClass.GET("", api.ListDeviceClasses)
 			deviceClass.GET(":id", api.GetDeviceClass)
@@ -285,7 +367,7 @@ func main() {
 			deviceClass.DELETE(":id", api.DeleteDeviceClass)
 		}
 
-		groups := v1.Group("/groups")
+		groups := v1.Group("/groups", api.Permit(models.RoleAdmin))
 		{
 			groups.GET("", api.ListGroups)
 			groups.GET(":id", api.GetGroup)
@@ -294,7 +376,7 @@ func main() {
 			groups.DELETE(":id", api.DeleteGroup)
 		}
 
-		images := v1.Group("/images")
+		images := v1.Group("/images", api.Permit(models.RoleAdmin))
 		{
 			images.GET("", api.ListImages)
 			images.GET(":id", api.GetImage)
@@ -303,7 +385,32 @@ func main() {
 			images.DELETE(":id", api.DeleteImage)
 		}
 
-		users := v1.Group("/users")
+		templates := v1.Group("/templates", api.Permit(models.RoleAdmin))
+		{
+			templates.GET("", api.ListTemplates)
+			templates.GET(":id", api.GetTemplate)
+			templates.POST("", api.CreateTemplate)
+			templates.PATCH(":id", api.UpdateTemplate)
+			templates.DELETE(":id", api.DeleteTemplate)
+
+			templates.GET(":id/versions", api.ListTemplateVersions)
+			templates.GET(":id/versions/:version", api.GetTemplateVersion)
+			templates.POST(":id/versions", api.CreateTemplateVersion)
+			templates.GET(":id/diff", api.DiffTemplateVersions)
+		}
+
+		v1.GET("/users/me", api.GetCurrentUser)
+		v1.POST("/users/me/password", api.ChangePassword)
+		v1.POST("/logout", api.Logout)
+
+		tokens := v1.Group("/tokens")
+		{
+			tokens.GET("", api.ListTokens)
+			tokens.POST("", api.CreateToken)
+			tokens.DELETE(":id", api.DeleteToken)
+		}
+
+		users := v1.Group("/users", api.Require(models.RoleAdmin))
 		{
 			users.GET("", api.ListUsers)
 			users.GET(":id", api.GetUser)
@@ -312,7 +419,7 @@ func main() {
 			users.DELETE(":id", api.DeleteUser)
 		}
 
-		postconfig := v1.Group("/postconfig")
+		postconfig := v1.Group("/postconfig", api.Require(models.RoleOperator))
 		{
 			postconfig.GET("", api.PostConfig(key))
 			postconfig.GET(":id", api.PostConfigID(key))
@@ -323,6 +430,8 @@ func main() {
 		v1.GET("version", api.Version(version, commit, date))
 	}
 
+	r.GET("metrics", gin.WrapH(promhttp.Handler()))
+
 	/*	r.GET("postconfig", api.PostConfig) */
 
 	// check if ./cert/server.crt exists, if not we will create the folder, and initiate a new CA and a self-signed certificate
@@ -352,3 +461,13 @@ func main() {
 	}).Error("Webserver")
 
 }
+
+// migrate creates or updates the database tables of all models
+func migrate() error {
+	if err := db.DB.AutoMigrate(&models.Pool{}, &models.PoolRange{}, &models.PoolSample{}, &models.Address{}, &models.Option{}, &models.DeviceClass{}, &models.Group{}, &models.Image{}, &models.User{}, &models.Template{}, &models.TemplateVersion{}, &models.Attribute{}, &models.DiscoveredHost{}, &models.GroupRule{}, &models.Token{}, &models.AuditEntry{}, &models.Account{}); err != nil {
+		return err
+	}
+
+	// addresses stored before the ip was indexed as a number
+	return models.MigrateIPNum(db.DB)
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"strings"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// DHCPPackets counts the processed dhcp packets by message type, the result that was sent back, and why a packet was ignored
+	DHCPPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "govia_dhcp_packets_total",
+		Help: "Number of processed DHCP packets by message type and result.",
+	}, []string{"type", "result", "reason"})
+
+	// TFTPTransfers counts the files served over tftp
+	TFTPTransfers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "govia_tftp_transfers_total",
+		Help: "Number of TFTP transfers by file (mboot.efi, crypto64.efi, boot.cfg or other) and result.",
+	}, []string{"file", "result"})
+
+	// TFTPBytes counts the bytes sent over tftp
+	TFTPBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "govia_tftp_bytes_total",
+		Help: "Number of bytes sent over TFTP by file (mboot.efi, crypto64.efi, boot.cfg or other).",
+	}, []string{"file"})
+
+	// KickstartRenders counts the rendered kickstart files
+	KickstartRenders = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "govia_kickstart_renders_total",
+		Help: "Number of kickstart renders by result.",
+	}, []string{"result"})
+
+	// PostConfigDuration measures how long each postconfig step takes
+	PostConfigDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "govia_postconfig_step_duration_seconds",
+		Help:    "Duration of the postconfig steps.",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"step"})
+
+	// PostConfigFailures counts the failed postconfig steps
+	PostConfigFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "govia_postconfig_step_failures_total",
+		Help: "Number of failed postconfig steps.",
+	}, []string{"step"})
+)
+
+func init() {
+	prometheus.MustRegister(poolCollector{})
+}
+
+// Result returns the label value for an error
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// tftpFiles are the files that are counted by name, the filename is chosen by the client so all other files are
+// counted as "other" to keep the number of series bounded
+var tftpFiles = map[string]bool{
+	"mboot.efi":    true,
+	"crypto64.efi": true,
+	"boot.cfg":     true,
+}
+
+// TFTPTransfer records a finished tftp transfer of the requested file
+func TFTPTransfer(file string, n int64, err error) {
+	file = strings.TrimPrefix(file, "/")
+	if !tftpFiles[file] {
+		file = "other"
+	}
+	TFTPTransfers.WithLabelValues(file, Result(err)).Inc()
+	if n > 0 {
+		TFTPBytes.WithLabelValues(file).Add(float64(n))
+	}
+}
+
+// PostConfigStep records the duration and the outcome of a postconfig step
+func PostConfigStep(step string, start time.Time, err error) {
+	PostConfigDuration.WithLabelValues(step).Observe(time.Since(start).Seconds())
+	if err != nil {
+		PostConfigFailures.WithLabelValues(step).Inc()
+	}
+}
+
+var (
+	poolSizeDesc = prometheus.NewDesc("govia_pool_addresses", "Number of addresses a pool can hand out.", []string{"pool"}, nil)
+	poolUsedDesc = prometheus.NewDesc("govia_pool_addresses_used", "Number of addresses in a pool that are leased, offered or reserved.", []string{"pool"}, nil)
+)
+
+// poolCollector calculates the pool utilization every time the metrics are scraped
+type poolCollector struct{}
+
+func (poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolSizeDesc
+	ch <- poolUsedDesc
+}
+
+func (poolCollector) Collect(ch chan<- prometheus.Metric) {
+	if db.DB == nil {
+		return
+	}
+
+	var pools []models.PoolWithAddresses
+	if res := db.DB.Table("pools").Preload("Ranges").Find(&pools); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": res.Error,
+		}).Warn("metrics: could not load pools")
+		return
+	}
+
+	for _, v := range pools {
+		size, used, err := v.Utilization()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"pool": v.Name,
+				"err":  err,
+			}).Warn("metrics: could not calculate pool utilization")
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(poolSizeDesc, prometheus.GaugeValue, float64(size), v.Name)
+		ch <- prometheus.MustNewConstMetric(poolUsedDesc, prometheus.GaugeValue, float64(used), v.Name)
+	}
+}
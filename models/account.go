@@ -0,0 +1,79 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// accountName are the characters of the name of a local ESXi user
+var accountName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// AccountForm is a local user that postconfig creates on every host of a group
+type AccountForm struct {
+	GroupID  int    `json:"group_id" gorm:"type:BIGINT;not null;index:uniqAccount,unique" binding:"required"`
+	Username string `json:"username" gorm:"type:varchar(255);not null;index:uniqAccount,unique" binding:"required"`
+	// Password is encrypted with the secrets key, and never returned
+	Password    string `json:"password,omitempty" gorm:"type:varchar(255)"`
+	Description string `json:"description" gorm:"type:varchar(255)"`
+	// Role is the role of the user on the host, e.g. Admin, ReadOnly or NoAccess, or a custom role that exists on the
+	// host. ReadOnly is used when it's empty.
+	Role        string `json:"role" gorm:"type:varchar(255)"`
+	ShellAccess bool   `json:"shell_access" gorm:"type:boolean"`
+	// SSHKeys are the authorized ssh keys of the user, one per line, they require shell access
+	SSHKeys string `json:"ssh_keys" gorm:"type:text"`
+	// LockdownException keeps the access of the user when the host is in lockdown mode
+	LockdownException bool `json:"lockdown_exception" gorm:"type:boolean"`
+}
+
+type Account struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	Group Group `json:"-" gorm:"foreignkey:GroupID"`
+
+	AccountForm
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+func (a *Account) BeforeSave(tx *gorm.DB) error {
+	if !accountName.MatchString(a.Username) {
+		return fmt.Errorf("the username %q may only contain letters, numbers, dots, dashes and underscores", a.Username)
+	}
+	if a.Username == "root" {
+		return fmt.Errorf("root is installed with the password of the group or host and can't be an account")
+	}
+
+	if a.Role == "" {
+		a.Role = "ReadOnly"
+	}
+
+	keys := a.AuthorizedKeys()
+	for i, key := range keys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+			return fmt.Errorf("ssh key %d: %w", i+1, err)
+		}
+	}
+	if len(keys) > 0 && !a.ShellAccess {
+		return fmt.Errorf("ssh keys require shell access")
+	}
+
+	return nil
+}
+
+// AuthorizedKeys returns the ssh keys of the user without empty lines
+func (a Account) AuthorizedKeys() []string {
+	var keys []string
+	for _, line := range strings.Split(a.SSHKeys, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
@@ -1,20 +1,41 @@
 package models
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
 	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
 )
 
 type AddressForm struct {
 	IP           string    `json:"ip" gorm:"type:varchar(15);not null;index:uniqIp,unique"`
-	Mac          string    `json:"mac" gorm:"type:varchar(17);not null"`
+	Mac          string    `json:"mac" gorm:"type:varchar(17);not null;index"`
 	Hostname     string    `json:"hostname" gorm:"type:varchar(255)"`
 	Domain       string    `json:"domain" gorm:"type:varchar(255)"`
-	Reimage      bool      `json:"reimage" gorm:"type:bool;index:uniqIp,unique"`
-	PoolID       NullInt32 `json:"pool_id" gorm:"type:BIGINT" swaggertype:"integer"`
-	GroupID      NullInt32 `json:"group_id" gorm:"type:BIGINT" swaggertype:"integer"`
+	Reimage      bool      `json:"reimage" gorm:"type:bool;index:uniqIp,unique;index:idx_addresses_allocation,priority:4"`
+	PoolID       NullInt32 `json:"pool_id" gorm:"type:BIGINT;index;index:idx_addresses_allocation,priority:2" swaggertype:"integer"`
+	GroupID      NullInt32 `json:"group_id" gorm:"type:BIGINT;index:idx_addresses_allocation,priority:5" swaggertype:"integer"`
 	Progress     int       `json:"progress" gorm:"type:INT"`
 	Progresstext string    `json:"progresstext" gorm:"type:varchar(255)"`
 	Ks           string    `json:"ks" gorm:"type:text"`
+	// TemplateID overrides the kickstart of the group with a template from the library, version 0 always uses the latest version
+	TemplateID      NullInt32 `json:"template_id" gorm:"type:BIGINT" swaggertype:"integer"`
+	TemplateVersion int       `json:"template_version" gorm:"type:integer"`
+	// SecondaryIPs is a comma separated list of additional addresses of the host, available to kickstart templates
+	SecondaryIPs string `json:"secondary_ips" gorm:"type:varchar(255)"`
+	// Attributes are custom key/value pairs available to kickstart templates, they override the attributes of the group
+	Attributes datatypes.JSON `json:"attributes" sql:"type:JSONB" swaggertype:"object,string"`
+
+	// Alternative identifiers resolve the host when it boots from another nic, e.g. after a nic has been replaced.
+	// ClientID is dhcp option 61 as colon separated hex and UUID is the SMBIOS uuid of option 97. Serial is not used
+	// to resolve the host, a discovered host that reports it is only pointed out to the operator.
+	ClientID string `json:"client_id" gorm:"type:varchar(255);index"`
+	UUID     string `json:"uuid" gorm:"type:varchar(36);index"`
+	Serial   string `json:"serial" gorm:"type:varchar(255);index"`
 }
 
 type Address struct {
@@ -30,10 +51,133 @@ type Address struct {
 
 	// DHCP parameters
 	LastSeenRelay  string    `json:"last_seen_relay" gorm:"type:varchar(15)"`
+	BootMac        string    `json:"boot_mac" gorm:"type:varchar(17)"`
 	MissingOptions string    `json:"missing_options" gorm:"type:varchar(255)"`
-	Expires        time.Time `json:"expires_at"`
+	Expires        time.Time `json:"expires_at" gorm:"index;index:idx_addresses_allocation,priority:3"`
+
+	// IPNum is the ip as a number, it's indexed together with the state of the address to find free addresses
+	// without loading the addresses of a pool
+	IPNum int64 `json:"-" gorm:"index:idx_addresses_allocation,priority:1"`
+
+	// KsTokenHash is the sha256 of the one-time token that authorizes the host to fetch its kickstart
+	KsTokenHash    string    `json:"-" gorm:"type:varchar(64);index"`
+	KsTokenExpires time.Time `json:"-"`
+
+	// RootPassword is the encrypted root password generated for the host when its group has unique passwords, the
+	// password of the group is used when it's empty
+	RootPassword string `json:"-" gorm:"type:varchar(255)"`
 
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
+
+// Sources of the root credentials of a host
+const (
+	CredentialsHost  = "host"
+	CredentialsGroup = "group"
+)
+
+// Credentials are the root credentials of a host
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Source is host when the password was generated for the host, or group when it's the password of the group
+	Source string `json:"source"`
+}
+
+func (a *Address) BeforeSave(tx *gorm.DB) error {
+	a.IPNum = ipNum(a.IP)
+	return nil
+}
+
+// MigrateIPNum fills in the ip as a number of the addresses that were stored before it was indexed
+func MigrateIPNum(tx *gorm.DB) error {
+	var addresses []Address
+	if res := tx.Select("id", "ip").Where("ip_num IS NULL OR ip_num = 0").Find(&addresses); res.Error != nil {
+		return res.Error
+	}
+	for _, v := range addresses {
+		if n := ipNum(v.IP); n != 0 {
+			if res := tx.Model(&Address{}).Where("id = ?", v.ID).UpdateColumn("ip_num", n); res.Error != nil {
+				return res.Error
+			}
+		}
+	}
+	return nil
+}
+
+// ipNum returns an ipv4 address as a number, or 0 when it isn't one
+func ipNum(s string) int64 {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint32(ip))
+}
+
+// DeviceMac returns the mac address of the nic the host last booted from, which is used to install the host
+func (a Address) DeviceMac() string {
+	if a.BootMac != "" {
+		return a.BootMac
+	}
+	return a.Mac
+}
+
+// EffectiveAttributes returns the attributes of the pool, overridden by the attributes of the group and then the host
+func (a Address) EffectiveAttributes() (map[string]interface{}, error) {
+	sources, err := a.AttributeSources()
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]interface{}{}
+	for _, v := range sources {
+		for k, value := range v.Values {
+			attributes[k] = value
+		}
+	}
+
+	return attributes, nil
+}
+
+// AttributeSource are the attributes set on one level of the inheritance
+type AttributeSource struct {
+	Name   string
+	Values map[string]interface{}
+}
+
+// AttributeSources returns the decoded attributes of the pool, group and host in order of inheritance
+func (a Address) AttributeSources() ([]AttributeSource, error) {
+	levels := []struct {
+		name string
+		raw  datatypes.JSON
+	}{
+		{"pool", a.Pool.Attributes},
+		{"group", a.Group.Attributes},
+		{"host", a.Attributes},
+	}
+
+	var sources []AttributeSource
+	for _, v := range levels {
+		values, err := DecodeAttributes(v.raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s attributes: %w", v.name, err)
+		}
+		sources = append(sources, AttributeSource{Name: v.name, Values: values})
+	}
+
+	return sources, nil
+}
+
+// DecodeAttributes decodes the attributes of a pool, group or host
+func DecodeAttributes(raw datatypes.JSON) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if len(raw) == 0 || string(raw) == "null" {
+		return values, nil
+	}
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
@@ -0,0 +1,27 @@
+package models
+
+// AddressImportRow is a host in a csv or yaml import or export, the group is referenced by name and the pool is the pool of the group.
+// The ip and hostname are optional, they are assigned from the pool and the hostname pattern of the group.
+type AddressImportRow struct {
+	Hostname string `json:"hostname" yaml:"hostname"`
+	Mac      string `json:"mac" yaml:"mac"`
+	IP       string `json:"ip" yaml:"ip"`
+	Group    string `json:"group" yaml:"group"`
+	Domain   string `json:"domain" yaml:"domain"`
+}
+
+// AddressImportColumns are the columns of a csv import or export, in the order they are exported
+var AddressImportColumns = []string{"hostname", "mac", "ip", "group", "domain"}
+
+type AddressImportError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// AddressImportResult is the outcome of an import, nothing is imported when there are errors or in a dry run
+type AddressImportResult struct {
+	DryRun   bool                 `json:"dry_run"`
+	Rows     int                  `json:"rows"`
+	Imported int                  `json:"imported"`
+	Errors   []AddressImportError `json:"errors"`
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// attributeKey allows attributes to be used as {{ .attributes.key }} in kickstart templates
+var attributeKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type AttributeForm struct {
+	Key         string `json:"key" gorm:"type:varchar(255);not null;uniqueIndex" binding:"required" `
+	Type        string `json:"type" gorm:"type:varchar(16);not null" binding:"required,oneof=string int bool ip" `
+	Description string `json:"description" gorm:"type:text"`
+	// AdvancedOption is an ESXi advanced option, e.g. /UserVars/HostClientCEIPOptIn, that postconfig sets to the value of the attribute
+	AdvancedOption string `json:"advanced_option" gorm:"type:varchar(255)"`
+}
+
+// Attribute defines a custom key/value attribute that can be set on pools, groups and hosts
+type Attribute struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	AttributeForm
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// EffectiveAttribute is the value of an attribute for a host, and where it was inherited from
+type EffectiveAttribute struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+func (a *Attribute) BeforeSave(tx *gorm.DB) error {
+	if !attributeKey.MatchString(a.Key) {
+		return fmt.Errorf("the key %q may only contain letters, digits and underscores", a.Key)
+	}
+	return nil
+}
+
+// Validate checks that a value decoded from json matches the type of the attribute
+func (a Attribute) Validate(v interface{}) error {
+	ok := false
+	switch a.Type {
+	case "string":
+		_, ok = v.(string)
+	case "int":
+		f, isNumber := v.(float64)
+		ok = isNumber && f == math.Trunc(f)
+	case "bool":
+		_, ok = v.(bool)
+	case "ip":
+		s, isString := v.(string)
+		ok = isString && net.ParseIP(s) != nil
+	}
+	if !ok {
+		return fmt.Errorf("the value of attribute %s must be of type %s", a.Key, a.Type)
+	}
+	return nil
+}
+
+// Sample returns a value of the type of the attribute, used to lint kickstart templates
+func (a Attribute) Sample() interface{} {
+	switch a.Type {
+	case "int":
+		return 1
+	case "bool":
+		return true
+	case "ip":
+		return "192.168.1.20"
+	}
+	return "sample"
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var errAppendOnly = errors.New("audit entries can't be changed or deleted")
+
+// AuditEntry records a change of the configuration or a sensitive action, e.g. a postconfig run or a login
+type AuditEntry struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	UserID   int    `json:"user_id" gorm:"type:BIGINT;index"`
+	Username string `json:"username" gorm:"type:varchar(255);index"`
+	IP       string `json:"ip" gorm:"type:varchar(64)"`
+
+	Method string `json:"method" gorm:"type:varchar(16)"`
+	Path   string `json:"path" gorm:"type:varchar(255)"`
+	// Action is create, update, delete or read, or the action of the path, e.g. claim, import or login
+	Action     string `json:"action" gorm:"type:varchar(32);index"`
+	Resource   string `json:"resource" gorm:"type:varchar(64);index"`
+	ResourceID int    `json:"resource_id" gorm:"type:BIGINT;index"`
+	Status     int    `json:"status" gorm:"type:INT"`
+
+	// Changes maps each changed field to its old and new value, secrets are redacted
+	Changes datatypes.JSON `json:"changes,omitempty" sql:"type:JSONB" swaggertype:"object,string"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
+
+// AuditChange is the old and new value of a field
+type AuditChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// BeforeUpdate keeps the audit log append-only
+func (AuditEntry) BeforeUpdate(tx *gorm.DB) error {
+	return errAppendOnly
+}
+
+// BeforeDelete keeps the audit log append-only
+func (AuditEntry) BeforeDelete(tx *gorm.DB) error {
+	return errAppendOnly
+}
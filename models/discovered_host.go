@@ -0,0 +1,85 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// DiscoveredHost is a client that PXE booted from a discovery enabled pool without being registered as an address
+type DiscoveredHost struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	Mac    string    `json:"mac" gorm:"type:varchar(17);not null;uniqueIndex"`
+	IP     string    `json:"ip" gorm:"type:varchar(15)"`
+	PoolID NullInt32 `json:"pool_id" gorm:"type:BIGINT;index" swaggertype:"integer"`
+
+	// DHCP parameters of the last request
+	VendorClass string `json:"vendor_class" gorm:"type:varchar(255)"`
+	ClientArch  int    `json:"client_arch" gorm:"type:integer"`
+	UUID        string `json:"uuid" gorm:"type:varchar(36)"`
+	Relay       string `json:"relay" gorm:"type:varchar(15)"`
+	CircuitID   string `json:"circuit_id" gorm:"type:varchar(255)"`
+	RemoteID    string `json:"remote_id" gorm:"type:varchar(255)"`
+
+	// Facts are the hardware details posted by the discovery kickstart
+	Facts datatypes.JSON `json:"facts" sql:"type:JSONB" swaggertype:"object,string"`
+
+	// AddressID is set when the host has been claimed into a group
+	AddressID NullInt32 `json:"address_id" gorm:"type:BIGINT" swaggertype:"integer"`
+
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  time.Time  `json:"last_seen"`
+	FactsAt   *time.Time `json:"facts_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DiscoveryFacts are the hardware details reported by a host booted into discovery
+type DiscoveryFacts struct {
+	Mac    string `json:"mac"`
+	Serial string `json:"serial"`
+	Vendor string `json:"vendor"`
+	Model  string `json:"model"`
+
+	CPU struct {
+		Model    string `json:"model"`
+		Packages int    `json:"packages"`
+		Cores    int    `json:"cores"`
+		Threads  int    `json:"threads"`
+	} `json:"cpu"`
+	// Memory in bytes
+	Memory int64 `json:"memory"`
+
+	NICs  []DiscoveryNIC  `json:"nics"`
+	Disks []DiscoveryDisk `json:"disks"`
+}
+
+type DiscoveryNIC struct {
+	Name   string `json:"name"`
+	Mac    string `json:"mac"`
+	Driver string `json:"driver"`
+	Link   string `json:"link"`
+	// Speed in Mbit/s
+	Speed int `json:"speed"`
+}
+
+type DiscoveryDisk struct {
+	Device string `json:"device"`
+	Vendor string `json:"vendor"`
+	Model  string `json:"model"`
+	// Size in MB
+	Size  int64 `json:"size"`
+	SSD   bool  `json:"ssd"`
+	Local bool  `json:"local"`
+}
+
+// DiscoveredHostClaimForm registers a discovered host as an address of a group, the ip and hostname are assigned by the group when empty
+type DiscoveredHostClaimForm struct {
+	GroupID  int    `json:"group_id" binding:"required"`
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	Domain   string `json:"domain"`
+	Reimage  bool   `json:"reimage"`
+}
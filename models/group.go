@@ -19,6 +19,13 @@ type GroupForm struct {
 	CallbackURL string         `json:"callbackurl"`
 	BootDisk    string         `json:"bootdisk" gorm:"type:varchar(255)"`
 	Options     datatypes.JSON `json:"options" sql:"type:JSONB" swaggertype:"object,string"`
+	// TemplateID replaces the default kickstart with a template from the library, version 0 always uses the latest version
+	TemplateID      NullInt32 `json:"template_id" gorm:"type:BIGINT" swaggertype:"integer"`
+	TemplateVersion int       `json:"template_version" gorm:"type:integer"`
+	// Attributes are custom key/value pairs available to the kickstart templates of all hosts in the group
+	Attributes datatypes.JSON `json:"attributes" sql:"type:JSONB" swaggertype:"object,string"`
+	// HostnamePattern generates the hostname of new hosts without one, e.g. esx-{rack}-{seq:02} where rack is an attribute
+	HostnamePattern string `json:"hostname_pattern" gorm:"type:varchar(255)"`
 }
 
 type NoPWGroupForm struct {
@@ -33,6 +40,13 @@ type NoPWGroupForm struct {
 	CallbackURL string         `json:"callbackurl"`
 	BootDisk    string         `json:"bootdisk" gorm:"type:varchar(255)"`
 	Options     datatypes.JSON `json:"options" sql:"type:JSONB" swaggertype:"object,string"`
+	// TemplateID replaces the default kickstart with a template from the library, version 0 always uses the latest version
+	TemplateID      NullInt32 `json:"template_id" gorm:"type:BIGINT" swaggertype:"integer"`
+	TemplateVersion int       `json:"template_version" gorm:"type:integer"`
+	// Attributes are custom key/value pairs available to the kickstart templates of all hosts in the group
+	Attributes datatypes.JSON `json:"attributes" sql:"type:JSONB" swaggertype:"object,string"`
+	// HostnamePattern generates the hostname of new hosts without one, e.g. esx-{rack}-{seq:02} where rack is an attribute
+	HostnamePattern string `json:"hostname_pattern" gorm:"type:varchar(255)"`
 }
 
 type Group struct {
@@ -74,4 +88,14 @@ type GroupOptions struct {
 	AllowLegacyCPU       bool `json:"allowlegacycpu"`
 	Certificate          bool `json:"certificate"`
 	CreateVMFS           bool `json:"createvmfs"`
+	// UniquePasswords generates a random root password for every host each time it's installed, instead of using the
+	// password of the group
+	UniquePasswords bool `json:"uniquepasswords"`
+	// Lockdown is the lockdown mode postconfig sets as its last step, normal, strict or disabled. The mode is left
+	// unchanged when it's empty.
+	Lockdown string `json:"lockdown"`
+	// AccountLockFailures and AccountUnlockTime set the account lockout policy of the host, they're left unchanged
+	// when 0
+	AccountLockFailures int `json:"accountlockfailures"`
+	AccountUnlockTime   int `json:"accountunlocktime"`
 }
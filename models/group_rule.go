@@ -0,0 +1,107 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type GroupRuleForm struct {
+	Name string `json:"name" gorm:"type:varchar(255);not null" binding:"required" `
+	// Priority orders the rules, the first matching rule with the lowest priority is used
+	Priority int `json:"priority" gorm:"type:integer;index"`
+
+	// DHCP criteria, empty criteria match every host
+	VendorClass string `json:"vendor_class" gorm:"type:varchar(255)"`
+	MacPrefix   string `json:"mac_prefix" gorm:"type:varchar(17)"`
+	Relay       string `json:"relay" gorm:"type:varchar(18)"`
+	CircuitID   string `json:"circuit_id" gorm:"type:varchar(255)"`
+
+	// Hardware criteria, only matched once the discovery kickstart has reported the facts of the host
+	SerialPrefix string `json:"serial_prefix" gorm:"type:varchar(255)"`
+	Model        string `json:"model" gorm:"type:varchar(255)"`
+
+	GroupID int `json:"group_id" gorm:"type:BIGINT;not null" binding:"required" `
+	// HostnamePattern overrides the hostname pattern of the group
+	HostnamePattern string `json:"hostname_pattern" gorm:"type:varchar(255)"`
+	Reimage         bool   `json:"reimage" gorm:"type:boolean"`
+}
+
+// GroupRule assigns discovered hosts to a group
+type GroupRule struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	Group Group `json:"group" gorm:"foreignkey:GroupID"`
+
+	GroupRuleForm
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+func (r *GroupRule) BeforeSave(tx *gorm.DB) error {
+	if r.VendorClass == "" && r.MacPrefix == "" && r.Relay == "" && r.CircuitID == "" && r.SerialPrefix == "" && r.Model == "" {
+		return fmt.Errorf("the rule needs at least one criteria")
+	}
+
+	// accept both 00:50:56 and 00-50-56
+	r.MacPrefix = strings.ToLower(strings.ReplaceAll(r.MacPrefix, "-", ":"))
+
+	if r.Relay != "" && net.ParseIP(r.Relay) == nil {
+		if _, _, err := net.ParseCIDR(r.Relay); err != nil {
+			return fmt.Errorf("the relay %q is not an ip address or network", r.Relay)
+		}
+	}
+
+	return ValidateHostnamePattern(r.HostnamePattern)
+}
+
+// Matches returns true when all criteria of the rule match the host
+func (r GroupRule) Matches(host DiscoveredHost) bool {
+	if r.VendorClass != "" && !strings.Contains(host.VendorClass, r.VendorClass) {
+		return false
+	}
+	if r.MacPrefix != "" && !strings.HasPrefix(strings.ToLower(host.Mac), r.MacPrefix) {
+		return false
+	}
+	if r.Relay != "" && !matchRelay(r.Relay, host.Relay) {
+		return false
+	}
+	if r.CircuitID != "" && r.CircuitID != host.CircuitID {
+		return false
+	}
+
+	if r.SerialPrefix == "" && r.Model == "" {
+		return true
+	}
+
+	var facts DiscoveryFacts
+	if len(host.Facts) == 0 || json.Unmarshal(host.Facts, &facts) != nil {
+		return false
+	}
+	if r.SerialPrefix != "" && !strings.HasPrefix(facts.Serial, r.SerialPrefix) {
+		return false
+	}
+	if r.Model != "" && !strings.Contains(strings.ToLower(facts.Model), strings.ToLower(r.Model)) {
+		return false
+	}
+
+	return true
+}
+
+// matchRelay compares the relay of a host with an ip address or network
+func matchRelay(relay string, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	if _, network, err := net.ParseCIDR(relay); err == nil {
+		return network.Contains(addr)
+	}
+	return net.ParseIP(relay).Equal(addr)
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// hostnameToken matches {seq}, {seq:02} and {attribute} in a hostname pattern
+var hostnameToken = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(?::([0-9]+))?\}`)
+
+var validHostname = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+
+// ExpandHostname generates a hostname from a pattern such as esx-{rack}-{seq:02}. {seq} is replaced by the sequence
+// number, zero padded to the optional width, and any other name by the attribute of the host with that key.
+func ExpandHostname(pattern string, attributes map[string]interface{}, seq int) (string, error) {
+	var err error
+	hostname := hostnameToken.ReplaceAllStringFunc(pattern, func(token string) string {
+		m := hostnameToken.FindStringSubmatch(token)
+		width, _ := strconv.Atoi(m[2])
+
+		if m[1] == "seq" {
+			return fmt.Sprintf("%0*d", width, seq)
+		}
+
+		v, ok := attributes[m[1]]
+		if !ok {
+			err = fmt.Errorf("the hostname pattern uses attribute %s, which is not set", m[1])
+			return ""
+		}
+		return fmt.Sprint(v)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if !validHostname.MatchString(hostname) {
+		return "", fmt.Errorf("the hostname pattern %q generates the invalid hostname %q", pattern, hostname)
+	}
+
+	return hostname, nil
+}
+
+// ValidateHostnamePattern checks a hostname pattern with sample values for the attributes it uses
+func ValidateHostnamePattern(pattern string) error {
+	if pattern == "" {
+		return nil
+	}
+
+	attributes := make(map[string]interface{})
+	for _, m := range hostnameToken.FindAllStringSubmatch(pattern, -1) {
+		attributes[m[1]] = "a"
+	}
+	if strings.ContainsAny(hostnameToken.ReplaceAllString(pattern, ""), "{}") {
+		return fmt.Errorf("the hostname pattern %q has an invalid token", pattern)
+	}
+
+	_, err := ExpandHostname(pattern, attributes, 1)
+	return err
+}
+
+// UsesSequence returns if a hostname pattern contains {seq}, without it a pattern generates one hostname per set of attributes
+func UsesSequence(pattern string) bool {
+	for _, m := range hostnameToken.FindAllStringSubmatch(pattern, -1) {
+		if m[1] == "seq" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,12 @@
+package models
+
+// KickstartLintForm is a kickstart to check, either base64 encoded like the ks of hosts and groups or as plain text like the template library
+type KickstartLintForm struct {
+	Ks      string `json:"ks"`
+	Content string `json:"content"`
+}
+
+type KickstartLintResult struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors"`
+}
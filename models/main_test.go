@@ -0,0 +1,37 @@
+package models
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/maxiepax/go-via/db"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB replaces the database with an empty one in a temporary directory
+func testDB(tb testing.TB) {
+	tb.Helper()
+
+	conn, err := gorm.Open(sqlite.Open(filepath.Join(tb.TempDir(), "test.db")+"?_busy_timeout=5000"), &gorm.Config{
+		SkipDefaultTransaction:                   true,
+		DisableForeignKeyConstraintWhenMigrating: true,
+		Logger:                                   logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&Pool{}, &PoolRange{}, &Address{}, &Group{}); err != nil {
+		tb.Fatal(err)
+	}
+
+	previous := db.DB
+	db.DB = conn
+	tb.Cleanup(func() {
+		db.DB = previous
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Offers keeps track of the addresses that have been offered to clients, but not yet requested
+var Offers = NewOfferCache(60 * time.Second)
+
+type offer struct {
+	mac     string
+	expires time.Time
+}
+
+// OfferCache holds pending offers for a while, so the same address is never offered to two clients at once
+type OfferCache struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	offers map[string]offer
+}
+
+func NewOfferCache(ttl time.Duration) *OfferCache {
+	return &OfferCache{
+		ttl:    ttl,
+		offers: make(map[string]offer),
+	}
+}
+
+// Add reserves the ip for the mac address until the offer times out
+func (o *OfferCache) Add(ip net.IP, mac string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Clean up offers that were never requested
+	now := time.Now()
+	for k, v := range o.offers {
+		if v.expires.Before(now) {
+			delete(o.offers, k)
+		}
+	}
+
+	o.offers[ip.String()] = offer{mac: mac, expires: now.Add(o.ttl)}
+}
+
+// Remove releases the pending offer of an ip, typically when it has been acknowledged
+func (o *OfferCache) Remove(ip net.IP) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.offers, ip.String())
+}
+
+// Holder returns the mac address an ip has been offered to
+func (o *OfferCache) Holder(ip net.IP) (string, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	v, ok := o.offers[ip.String()]
+	if !ok || v.expires.Before(time.Now()) {
+		return "", false
+	}
+
+	return v.mac, true
+}
+
+// Lookup returns the ip that has been offered to a mac address
+func (o *OfferCache) Lookup(mac string) net.IP {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range o.offers {
+		if v.mac == mac && v.expires.After(now) {
+			return net.ParseIP(k)
+		}
+	}
+
+	return nil
+}
+
+// pending returns all offered ips that have not timed out yet
+func (o *OfferCache) pending() []net.IP {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var ips []net.IP
+	now := time.Now()
+	for k, v := range o.offers {
+		if v.expires.After(now) {
+			ips = append(ips, net.ParseIP(k))
+		}
+	}
+
+	return ips
+}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/maxiepax/go-via/db"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
@@ -22,6 +24,20 @@ type PoolForm struct {
 
 	AuthorizedVlan int    `json:"authorized_vlan" gorm:"type:bigint"`
 	ManagedRef     string `json:"managed_reference"`
+
+	// Pools with the same shared network name serve the same broadcast domain and are tried in order
+	SharedNetwork string `json:"shared_network" gorm:"type:varchar(255)"`
+
+	// Utilization in percent at which a warning is emitted, 0 uses the configured default
+	WarningThreshold int `json:"warning_threshold" gorm:"type:integer"`
+
+	// Attributes are custom key/value pairs inherited by the groups and hosts of the pool
+	Attributes datatypes.JSON `json:"attributes" sql:"type:JSONB" swaggertype:"object,string"`
+
+	// Discovery records the clients that are not registered as an address
+	Discovery bool `json:"discovery" gorm:"type:boolean"`
+	// DiscoveryImageID is booted by unregistered clients to report their hardware, 0 only records the dhcp details
+	DiscoveryImageID int `json:"discovery_image_id" gorm:"type:BIGINT"`
 }
 
 type Pool struct {
@@ -37,7 +53,8 @@ type Pool struct {
 
 type PoolWithAddresses struct {
 	Pool
-	Addresses []Address `json:"address,omitempty" gorm:"foreignkey:PoolID"`
+	Addresses []Address   `json:"address,omitempty" gorm:"foreignkey:PoolID"`
+	Ranges    []PoolRange `json:"ranges,omitempty" gorm:"foreignkey:PoolID"`
 }
 
 func (p *Pool) BeforeCreate(tx *gorm.DB) error {
@@ -66,41 +83,322 @@ func (p *Pool) BeforeSave(tx *gorm.DB) error {
 
 	p.NetAddress = startNet.IP.String()
 
+	// the additional ranges of an existing pool may not overlap its primary range
+	if p.ID != 0 {
+		primary, err := newAddressRange(p.StartAddress, p.EndAddress)
+		if err != nil {
+			return err
+		}
+
+		var ranges []PoolRange
+		if res := tx.Session(&gorm.Session{NewDB: true}).Where("pool_id = ? AND NOT exclude", p.ID).Find(&ranges); res.Error != nil {
+			return res.Error
+		}
+		for _, v := range ranges {
+			r, err := newAddressRange(v.StartAddress, v.EndAddress)
+			if err == nil && r.overlaps(primary) {
+				return fmt.Errorf("the range of the pool overlaps the range %s-%s (%d)", v.StartAddress, v.EndAddress, v.ID)
+			}
+		}
+	}
+
 	return nil
 }
 
+// leasedCondition matches the addresses that are leased or assigned to a host in the pool, or reserved for re-imaging,
+// %[1]s is the alias of the addresses table
+const leasedCondition = "(%[1]s.pool_id = ? AND (%[1]s.expires > ? OR %[1]s.group_id IS NOT NULL)) OR %[1]s.reimage"
+
+// AllocationMu serializes every allocation of addresses, by the dhcp server and the api alike, so the same free address
+// is never handed out twice. It must be held until the allocated address is stored.
+var AllocationMu sync.Mutex
+
+// cursors remember after which address the last free address of a pool was found. The next search continues from
+// there, so consecutive allocations don't walk over the same used addresses again. Addresses before the cursor are
+// used again once the search wraps around.
+var cursors = struct {
+	sync.Mutex
+	next map[int]uint32
+}{next: make(map[int]uint32)}
+
 // Next returns the next free address in the pool (that is not reserved nor already leased)
 func (p *PoolWithAddresses) Next() (ip net.IP, err error) {
-	cidrMask := "/" + strconv.Itoa(p.Netmask)
-	startIP, startNet, err := net.ParseCIDR(p.StartAddress + cidrMask)
+	cursors.Lock()
+	from := cursors.next[p.ID]
+	cursors.Unlock()
+
+	ip, err = p.next(db.DB, from, leasedCondition, p.ID, time.Now())
 	if err != nil {
 		return nil, err
 	}
 
-	endIP, _, err := net.ParseCIDR(p.EndAddress + cidrMask)
+	cursors.Lock()
+	cursors.next[p.ID] = binary.BigEndian.Uint32(ip.To4()) + 1
+	cursors.Unlock()
+
+	return ip, nil
+}
+
+// NextUnassigned returns the next free address in the pool that is also not assigned to any host, to assign it to a new host.
+// Hosts are read with tx, so hosts created earlier in the same transaction are taken into account.
+func (p *PoolWithAddresses) NextUnassigned(tx *gorm.DB) (net.IP, error) {
+	// every address that is stored is taken, whatever its state
+	return p.next(tx, 0, "%[1]s.id IS NOT NULL")
+}
+
+// next returns the first address of the ranges from the address from that is not used by an address matching the
+// condition, not offered, excluded or otherwise unusable. Free addresses are found with the index on ip_num, so the
+// addresses of the pool are never loaded.
+func (p *PoolWithAddresses) next(tx *gorm.DB, from uint32, used string, args ...interface{}) (net.IP, error) {
+	ranges, err := p.dynamicRanges()
 	if err != nil {
 		return nil, err
 	}
+	ranges = ranges.rotate(from)
+
+	exclusions := p.exclusions()
+	gateway := net.ParseIP(p.Gateway)
+
+	// Addresses offered to other clients are not free either
+	offered := make(map[uint32]struct{})
+	for _, v := range Offers.pending() {
+		if ip := v.To4(); ip != nil {
+			offered[binary.BigEndian.Uint32(ip)] = struct{}{}
+		}
+	}
+
+	for _, r := range ranges {
+		from := r.start
+		for {
+			i, ok, err := firstFree(tx, from, r.end, used, args...)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+
+			ip := uint32ToIP(i)
+			_, isOffered := offered[i]
+			excluded, isExcluded := exclusions.find(i)
+			if !isOffered && !isExcluded && !ip.IsMulticast() && !ip.IsLoopback() && !ip.IsUnspecified() && !ip.Equal(gateway) {
+				return ip, nil
+			}
+
+			// continue after the unusable address, or after the whole exclusion
+			if isExcluded {
+				i = excluded.end
+			}
+			if i >= r.end {
+				break
+			}
+			from = i + 1
+		}
+	}
 
-	if startIP.IsUnspecified() {
+	return nil, fmt.Errorf("could not find a free address")
+}
+
+// firstFree returns the lowest address from from to end that is not used by an address matching the condition. When
+// from is used, the first used address that isn't followed by another used address ends the run of used addresses.
+func firstFree(tx *gorm.DB, from uint32, end uint32, used string, args ...interface{}) (uint32, bool, error) {
+	var taken int64
+	query := "SELECT COUNT(*) FROM addresses a WHERE a.ip_num = ? AND (" + fmt.Sprintf(used, "a") + ")"
+	if res := tx.Raw(query, append([]interface{}{int64(from)}, args...)...).Scan(&taken); res.Error != nil {
+		return 0, false, res.Error
+	}
+	if taken == 0 {
+		return from, true, nil
+	}
+
+	var last []int64
+	query = "SELECT a.ip_num FROM addresses a WHERE a.ip_num BETWEEN ? AND ? AND (" + fmt.Sprintf(used, "a") + ") " +
+		"AND NOT EXISTS (SELECT 1 FROM addresses b WHERE b.ip_num = a.ip_num + 1 AND (" + fmt.Sprintf(used, "b") + ")) " +
+		"ORDER BY a.ip_num LIMIT 1"
+	queryArgs := append([]interface{}{int64(from), int64(end)}, args...)
+	queryArgs = append(queryArgs, args...)
+	if res := tx.Raw(query, queryArgs...).Scan(&last); res.Error != nil {
+		return 0, false, res.Error
+	}
+	if len(last) == 0 || last[0] >= int64(end) {
+		return 0, false, nil
+	}
+
+	return uint32(last[0]) + 1, true, nil
+}
+
+// Utilization returns the number of addresses the pool can hand out, and how many of those are currently in use
+func (p *PoolWithAddresses) Utilization() (size int, used int, err error) {
+	stats, err := p.Stats()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return stats.Total, stats.Total - stats.Free, nil
+}
+
+// Stats counts the addresses of the pool by state. Every address is only counted once, reservations take precedence over declines, leases and offers
+func (p *PoolWithAddresses) Stats() (PoolStats, error) {
+	var stats PoolStats
+
+	ranges, err := p.dynamicRanges()
+	if err != nil {
+		return stats, err
+	}
+
+	// Only load the columns needed to figure out the state of each address. Whether an address is used is decided by
+	// the same condition as the allocation, so an address is only counted as free when Next can hand it out.
+	now := time.Now()
+	var addresses []struct {
+		IP      string
+		Mac     string
+		Reimage bool
+		Expires time.Time
+		Used    bool
+	}
+	if res := db.DB.Model(&Address{}).Select("ip, mac, reimage, expires, ("+fmt.Sprintf(leasedCondition, "addresses")+") AS used", p.ID, now).
+		Where("pool_id = ? OR reimage", p.ID).Find(&addresses); res.Error != nil {
+		return stats, res.Error
+	}
+
+	states := make(map[uint32]string, len(addresses))
+	for _, v := range addresses {
+		ip := net.ParseIP(v.IP).To4()
+		if ip == nil {
+			continue
+		}
+		i := binary.BigEndian.Uint32(ip)
+
+		var state string
+		switch {
+		case !v.Used:
+			state = "expired"
+		case v.Reimage:
+			state = "reserved"
+		case v.Expires.After(now) && v.Mac == "":
+			state = "declined"
+		case v.Expires.After(now):
+			state = "leased"
+		default:
+			// a host registered to a group keeps its address without a lease
+			state = "reserved"
+		}
+
+		if previous, ok := states[i]; !ok || statePrecedence[state] > statePrecedence[previous] {
+			states[i] = state
+		}
+	}
+
+	for _, v := range Offers.pending() {
+		if ip := v.To4(); ip != nil {
+			i := binary.BigEndian.Uint32(ip)
+			if previous, ok := states[i]; !ok || statePrecedence["offered"] > statePrecedence[previous] {
+				states[i] = "offered"
+			}
+		}
+	}
+
+	exclusions := p.exclusions()
+	gateway := net.ParseIP(p.Gateway)
+
+	for _, r := range ranges {
+		for i := r.start; i >= r.start && i <= r.end; i++ {
+			ip := uint32ToIP(i)
+			if ip.IsMulticast() || ip.IsLoopback() || ip.IsUnspecified() || ip.Equal(gateway) || exclusions.contains(ip) {
+				continue
+			}
+
+			stats.Total++
+			switch states[i] {
+			case "reserved":
+				stats.Reserved++
+			case "declined":
+				stats.Declined++
+			case "leased":
+				stats.Leased++
+			case "offered":
+				stats.Offered++
+			case "expired":
+				stats.Expired++
+				stats.Free++
+			default:
+				stats.Free++
+			}
+		}
+	}
+
+	if stats.Total > 0 {
+		stats.Utilization = float64(stats.Total-stats.Free) / float64(stats.Total) * 100
+	}
+
+	return stats, nil
+}
+
+var statePrecedence = map[string]int{
+	"expired":  1,
+	"offered":  2,
+	"leased":   3,
+	"declined": 4,
+	"reserved": 5,
+}
+
+// dynamicRanges returns the primary range of the pool followed by all additional ranges that are not exclusions
+func (p *PoolWithAddresses) dynamicRanges() (addressRanges, error) {
+	primary, err := newAddressRange(p.StartAddress, p.EndAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint32ToIP(primary.start).IsUnspecified() {
 		return nil, fmt.Errorf("start address is unspecified")
 	}
 
-	for ip := startIP; startNet.Contains(ip); next(ip) {
-		if ip.IsMulticast() || ip.IsLoopback() {
+	ranges := addressRanges{primary}
+	for _, v := range p.Ranges {
+		if v.Exclude {
 			continue
 		}
 
-		if err := p.IsAvailable(ip); err == nil {
-			return ip, nil
+		r, err := newAddressRange(v.StartAddress, v.EndAddress)
+		if err != nil {
+			return nil, err
 		}
+		ranges = append(ranges, r)
+	}
 
-		if ip.Equal(endIP) {
-			break
+	return ranges, nil
+}
+
+// InRange checks if the ip is part of any of the ranges handed out by the pool, exclusions are not taken into account
+func (p *PoolWithAddresses) InRange(ip net.IP) bool {
+	ranges, err := p.dynamicRanges()
+	if err != nil {
+		return false
+	}
+
+	return ranges.contains(ip)
+}
+
+// Excluded checks if the ip is part of an exclusion range, and should never be handed out dynamically
+func (p *PoolWithAddresses) Excluded(ip net.IP) bool {
+	return p.exclusions().contains(ip)
+}
+
+func (p *PoolWithAddresses) exclusions() addressRanges {
+	var exclusions addressRanges
+	for _, v := range p.Ranges {
+		if !v.Exclude {
+			continue
 		}
+
+		r, err := newAddressRange(v.StartAddress, v.EndAddress)
+		if err != nil {
+			continue
+		}
+		exclusions = append(exclusions, r)
 	}
 
-	return nil, fmt.Errorf("could not find a free address")
+	return exclusions
 }
 
 func (p *PoolWithAddresses) IsAvailable(ip net.IP) error {
@@ -131,20 +429,24 @@ func (p *PoolWithAddresses) IsAvailableExcept(ip net.IP, exclude string) error {
 		return fmt.Errorf("cant use the gateway address")
 	}
 
-	// Check all loaded addresses
-	for _, v := range p.Addresses {
-		if v.IP == s && v.Expires.After(time.Now()) && v.Mac != exclude {
-			return fmt.Errorf("already leased (%d)", v.ID)
-		}
+	// Check pending offers
+	if mac, ok := Offers.Holder(ip); ok && mac != exclude {
+		return fmt.Errorf("already offered")
 	}
 
-	// Check reservations as well
-	var reservations []Address
-	db.DB.Where("ip = ? AND reimage", s).Find(&reservations)
-	for _, v := range reservations {
-		if v.IP == s && v.Mac != exclude {
+	// Check leases and hosts in the pool as well as reservations
+	var conflicts []Address
+	if res := db.DB.Where("ip = ? AND mac <> ?", s, exclude).Where(fmt.Sprintf(leasedCondition, "addresses"), p.ID, time.Now()).Limit(1).Find(&conflicts); res.Error != nil {
+		return res.Error
+	}
+	for _, v := range conflicts {
+		if v.Reimage {
 			return fmt.Errorf("already reserved")
 		}
+		if v.GroupID.Valid {
+			return fmt.Errorf("already assigned to host %d", v.ID)
+		}
+		return fmt.Errorf("already leased (%d)", v.ID)
 	}
 
 	return nil
@@ -166,11 +468,88 @@ func (p *Pool) LastAddr() (net.IP, error) {
 	return ip, nil
 }
 
-func next(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
+type addressRange struct {
+	start uint32
+	end   uint32
+}
+
+func newAddressRange(start string, end string) (addressRange, error) {
+	s := net.ParseIP(start).To4()
+	if s == nil {
+		return addressRange{}, fmt.Errorf("invalid start address %q", start)
+	}
+
+	e := net.ParseIP(end).To4()
+	if e == nil {
+		return addressRange{}, fmt.Errorf("invalid end address %q", end)
+	}
+
+	r := addressRange{binary.BigEndian.Uint32(s), binary.BigEndian.Uint32(e)}
+	if r.start > r.end {
+		return addressRange{}, fmt.Errorf("start address is after the end address")
+	}
+
+	return r, nil
+}
+
+type addressRanges []addressRange
+
+// rotate returns the ranges starting at the address, the ranges and the part of its range before it come last
+func (a addressRanges) rotate(i uint32) addressRanges {
+	for n, r := range a {
+		if i < r.start || i > r.end {
+			continue
+		}
+
+		rotated := addressRanges{{i, r.end}}
+		rotated = append(rotated, a[n+1:]...)
+		rotated = append(rotated, a[:n]...)
+		if i > r.start {
+			rotated = append(rotated, addressRange{r.start, i - 1})
 		}
+		return rotated
 	}
+
+	return a
+}
+
+// find returns the range that contains the address
+func (a addressRanges) find(i uint32) (addressRange, bool) {
+	for _, r := range a {
+		if i >= r.start && i <= r.end {
+			return r, true
+		}
+	}
+
+	return addressRange{}, false
+}
+
+func (a addressRanges) contains(ip net.IP) bool {
+	for _, r := range a {
+		if r.contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r addressRange) contains(ip net.IP) bool {
+	v4 := ip.To4()
+	if v4 == nil {
+		return false
+	}
+
+	i := binary.BigEndian.Uint32(v4)
+	return i >= r.start && i <= r.end
+}
+
+func (r addressRange) overlaps(other addressRange) bool {
+	return r.start <= other.end && other.start <= r.end
+}
+
+func uint32ToIP(i uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
 }
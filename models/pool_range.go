@@ -0,0 +1,85 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type PoolRangeForm struct {
+	StartAddress string `json:"start_address" gorm:"type:varchar(15);not null" binding:"required" `
+	EndAddress   string `json:"end_address" gorm:"type:varchar(15);not null" binding:"required" `
+	Exclude      bool   `json:"exclude" gorm:"type:boolean"`
+}
+
+type PoolRange struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	PoolID int `json:"pool_id" gorm:"type:BIGINT;index"`
+	PoolRangeForm
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+func (r *PoolRange) BeforeCreate(tx *gorm.DB) error {
+	return r.BeforeSave(tx)
+}
+
+func (r *PoolRange) BeforeSave(tx *gorm.DB) error {
+	ar, err := newAddressRange(r.StartAddress, r.EndAddress)
+	if err != nil {
+		return err
+	}
+
+	if uint32ToIP(ar.start).IsUnspecified() {
+		return fmt.Errorf("start address is unspecified")
+	}
+
+	// the range has to be within the network of the pool it belongs to
+	var pool Pool
+	if res := tx.Session(&gorm.Session{NewDB: true}).First(&pool, r.PoolID); res.Error != nil {
+		return fmt.Errorf("could not load pool %d: %w", r.PoolID, res.Error)
+	}
+
+	_, poolNet, err := net.ParseCIDR(pool.NetAddress + "/" + strconv.Itoa(pool.Netmask))
+	if err != nil {
+		return err
+	}
+
+	if !poolNet.Contains(net.ParseIP(r.StartAddress)) || !poolNet.Contains(net.ParseIP(r.EndAddress)) {
+		return fmt.Errorf("the range is not within the network of the pool")
+	}
+
+	// ranges may not overlap the primary range or each other, and exclusions may not overlap each other, an
+	// exclusion is only meant to overlap the ranges it excludes addresses from
+	if !r.Exclude {
+		primary, err := newAddressRange(pool.StartAddress, pool.EndAddress)
+		if err != nil {
+			return err
+		}
+		if ar.overlaps(primary) {
+			return fmt.Errorf("the range overlaps the range of the pool %s-%s", pool.StartAddress, pool.EndAddress)
+		}
+	}
+
+	var others []PoolRange
+	if res := tx.Session(&gorm.Session{NewDB: true}).Where("pool_id = ? AND id <> ? AND exclude = ?", r.PoolID, r.ID, r.Exclude).Find(&others); res.Error != nil {
+		return res.Error
+	}
+	for _, v := range others {
+		other, err := newAddressRange(v.StartAddress, v.EndAddress)
+		if err != nil {
+			continue
+		}
+		if ar.overlaps(other) {
+			return fmt.Errorf("the range overlaps %s-%s (%d)", v.StartAddress, v.EndAddress, v.ID)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/maxiepax/go-via/db"
+)
+
+func TestPoolRangeOverlap(t *testing.T) {
+	testDB(t)
+
+	pool := Pool{PoolForm: PoolForm{Name: "p", StartAddress: "10.0.0.10", EndAddress: "10.0.0.99", Netmask: 24, LeaseTime: 3600, Gateway: "10.0.0.1"}}
+	if res := db.DB.Create(&pool); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	tests := []struct {
+		name    string
+		start   string
+		end     string
+		exclude bool
+		ok      bool
+	}{
+		{"additional range", "10.0.0.150", "10.0.0.199", false, true},
+		{"overlaps the primary range", "10.0.0.90", "10.0.0.110", false, false},
+		{"overlaps an additional range", "10.0.0.190", "10.0.0.210", false, false},
+		{"adjacent range", "10.0.0.200", "10.0.0.220", false, true},
+		{"exclusion in the primary range", "10.0.0.20", "10.0.0.29", true, true},
+		{"exclusion overlaps an exclusion", "10.0.0.25", "10.0.0.35", true, false},
+		{"exclusion in an additional range", "10.0.0.160", "10.0.0.169", true, true},
+		{"outside the network", "10.0.1.10", "10.0.1.20", false, false},
+	}
+
+	for _, tt := range tests {
+		r := PoolRange{PoolID: pool.ID, PoolRangeForm: PoolRangeForm{StartAddress: tt.start, EndAddress: tt.end, Exclude: tt.exclude}}
+		err := db.DB.Create(&r).Error
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: the range was accepted", tt.name)
+		}
+	}
+
+	// an updated range doesn't overlap itself
+	var r PoolRange
+	db.DB.Where("start_address = ?", "10.0.0.150").First(&r)
+	r.EndAddress = "10.0.0.180"
+	if err := db.DB.Save(&r).Error; err != nil {
+		t.Errorf("update: %v", err)
+	}
+
+	// the primary range can't be moved over an additional range
+	pool.EndAddress = "10.0.0.160"
+	if err := db.DB.Save(&pool).Error; err == nil {
+		t.Errorf("the primary range was moved over an additional range")
+	}
+}
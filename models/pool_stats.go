@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+)
+
+// PoolStats is a summary of the address states within the ranges of a pool
+type PoolStats struct {
+	Total    int `json:"total"`
+	Reserved int `json:"reserved"`
+	Leased   int `json:"leased"`
+	Offered  int `json:"offered"`
+	Declined int `json:"declined"`
+	// Expired leases are still in the database, but the addresses are free to be handed out again
+	Expired int `json:"expired"`
+	Free    int `json:"free"`
+
+	Utilization float64 `json:"utilization"`
+
+	Samples []PoolSample `json:"samples,omitempty"`
+}
+
+// PoolSample is the utilization of a pool at a point in time
+type PoolSample struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	PoolID      int     `json:"pool_id" gorm:"type:BIGINT;index"`
+	Total       int     `json:"total" gorm:"type:integer"`
+	Used        int     `json:"used" gorm:"type:integer"`
+	Free        int     `json:"free" gorm:"type:integer"`
+	Utilization float64 `json:"utilization"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
@@ -0,0 +1,231 @@
+package models
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+)
+
+// testPool creates a pool with the ranges and returns it as used by the dhcp server
+func testPool(tb testing.TB, start, end string, netmask int, ranges ...PoolRangeForm) *PoolWithAddresses {
+	tb.Helper()
+
+	pool := Pool{PoolForm: PoolForm{Name: "pool", StartAddress: start, EndAddress: end, Netmask: netmask, LeaseTime: 3600, Gateway: "10.0.0.1"}}
+	if res := db.DB.Create(&pool); res.Error != nil {
+		tb.Fatal(res.Error)
+	}
+	for _, v := range ranges {
+		if res := db.DB.Create(&PoolRange{PoolID: pool.ID, PoolRangeForm: v}); res.Error != nil {
+			tb.Fatal(res.Error)
+		}
+	}
+
+	var p PoolWithAddresses
+	if res := db.DB.Table("pools").Preload("Ranges").First(&p, pool.ID); res.Error != nil {
+		tb.Fatal(res.Error)
+	}
+	return &p
+}
+
+// lease stores n consecutive leased addresses from the ip
+func lease(tb testing.TB, pool *PoolWithAddresses, ip string, n int) {
+	tb.Helper()
+
+	first := binary.BigEndian.Uint32(net.ParseIP(ip).To4())
+	addresses := make([]Address, 0, n)
+	for i := 0; i < n; i++ {
+		a := Address{AddressForm: AddressForm{IP: uint32ToIP(first + uint32(i)).String(), Mac: fmt.Sprintf("00:50:56:%02x:%02x:%02x", i>>16&0xff, i>>8&0xff, i&0xff)}, Expires: time.Now().Add(time.Hour)}
+		a.PoolID.Int32, a.PoolID.Valid = int32(pool.ID), true
+		addresses = append(addresses, a)
+	}
+	if res := db.DB.CreateInBatches(addresses, 500); res.Error != nil {
+		tb.Fatal(res.Error)
+	}
+}
+
+func TestNext(t *testing.T) {
+	testDB(t)
+	Offers = NewOfferCache(time.Minute)
+
+	pool := testPool(t, "10.0.0.1", "10.0.0.20", 24,
+		PoolRangeForm{StartAddress: "10.0.0.5", EndAddress: "10.0.0.7", Exclude: true},
+		PoolRangeForm{StartAddress: "10.0.0.100", EndAddress: "10.0.0.110"},
+	)
+
+	next := func(want string) {
+		t.Helper()
+		ip, err := pool.Next()
+		if err != nil {
+			t.Fatalf("want %s: %v", want, err)
+		}
+		if ip.String() != want {
+			t.Fatalf("want %s, got %s", want, ip)
+		}
+	}
+
+	// the gateway is skipped
+	next("10.0.0.2")
+
+	lease(t, pool, "10.0.0.2", 2)
+	next("10.0.0.4")
+
+	// offered addresses and exclusions are skipped
+	Offers.Add(net.ParseIP("10.0.0.4"), "aa")
+	next("10.0.0.8")
+
+	// an expired lease is free again, a reservation for re-imaging isn't
+	expired := Address{AddressForm: AddressForm{IP: "10.0.0.9", Mac: "bb"}, Expires: time.Now().Add(-time.Minute)}
+	expired.PoolID.Int32, expired.PoolID.Valid = int32(pool.ID), true
+	db.DB.Create(&expired)
+	next("10.0.0.9")
+
+	db.DB.Create(&Address{AddressForm: AddressForm{IP: "10.0.0.10", Mac: "cc", Reimage: true}})
+	next("10.0.0.11")
+
+	// when the primary range is used up, the additional range is used
+	lease(t, pool, "10.0.0.11", 10)
+	next("10.0.0.100")
+
+	// the search wraps around to the addresses before the last one that was found
+	lease(t, pool, "10.0.0.100", 11)
+	next("10.0.0.8")
+	Offers.Add(net.ParseIP("10.0.0.8"), "dd")
+	next("10.0.0.9")
+	Offers.Add(net.ParseIP("10.0.0.9"), "ee")
+
+	if ip, err := pool.Next(); err == nil {
+		t.Fatalf("the pool is exhausted, got %s", ip)
+	}
+
+	// any stored address is taken for new hosts, even when its lease expired
+	pool = testPool(t, "10.0.1.10", "10.0.1.20", 24)
+	expired = Address{AddressForm: AddressForm{IP: "10.0.1.10", Mac: "ff"}, Expires: time.Now().Add(-time.Minute)}
+	db.DB.Create(&expired)
+	if ip, err := pool.NextUnassigned(db.DB); err != nil || ip.String() != "10.0.1.11" {
+		t.Fatalf("want 10.0.1.11, got %s %v", ip, err)
+	}
+}
+
+// nextLinear is how Next used to find a free address, by loading every unavailable address of the pool and scanning
+// the ranges. It's only kept to compare with in BenchmarkDiscover.
+func (p *PoolWithAddresses) nextLinear() (net.IP, error) {
+	var ips []string
+	if res := db.DB.Model(&Address{}).Where("(pool_id = ? AND expires > ?) OR reimage", p.ID, time.Now()).Pluck("ip", &ips); res.Error != nil {
+		return nil, res.Error
+	}
+
+	used := make(map[uint32]struct{}, len(ips))
+	for _, v := range ips {
+		if ip := net.ParseIP(v).To4(); ip != nil {
+			used[binary.BigEndian.Uint32(ip)] = struct{}{}
+		}
+	}
+	for _, v := range Offers.pending() {
+		if ip := v.To4(); ip != nil {
+			used[binary.BigEndian.Uint32(ip)] = struct{}{}
+		}
+	}
+
+	ranges, err := p.dynamicRanges()
+	if err != nil {
+		return nil, err
+	}
+	exclusions := p.exclusions()
+	gateway := net.ParseIP(p.Gateway)
+
+	for _, r := range ranges {
+		for i := r.start; i >= r.start && i <= r.end; i++ {
+			ip := uint32ToIP(i)
+			if ip.IsMulticast() || ip.IsLoopback() || ip.IsUnspecified() || ip.Equal(gateway) {
+				continue
+			}
+			if _, ok := used[i]; ok {
+				continue
+			}
+			if exclusions.contains(ip) {
+				continue
+			}
+			return ip, nil
+		}
+	}
+
+	return nil, fmt.Errorf("could not find a free address")
+}
+
+// BenchmarkDiscover measures finding the address to offer in a pool with 10k leases, every offer is held like the dhcp
+// server does. Cold searches start at the beginning of the pool, like the first discover after a restart.
+func BenchmarkDiscover(b *testing.B) {
+	testDB(b)
+
+	pool := testPool(b, "10.0.0.10", "10.0.63.250", 18)
+	lease(b, pool, "10.0.0.10", 10000)
+
+	for _, bm := range []struct {
+		name string
+		next func() (net.IP, error)
+		cold bool
+	}{
+		{"indexed", pool.Next, false},
+		{"indexed-cold", pool.Next, true},
+		{"linear", pool.nextLinear, false},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			Offers = NewOfferCache(time.Minute)
+			cursors.next[pool.ID] = 0
+
+			for i := 0; i < b.N; i++ {
+				if bm.cold {
+					cursors.next[pool.ID] = 0
+				}
+				ip, err := bm.next()
+				if err != nil {
+					b.Fatal(err)
+				}
+				Offers.Add(ip, fmt.Sprintf("client-%d", i))
+			}
+		})
+	}
+}
+
+func TestStatsRegisteredHost(t *testing.T) {
+	testDB(t)
+	Offers = NewOfferCache(time.Minute)
+
+	pool := testPool(t, "10.0.0.2", "10.0.0.4", 24)
+
+	// hosts registered to a group keep their address without a lease
+	register := func(ip string) {
+		t.Helper()
+		a := Address{AddressForm: AddressForm{IP: ip, Mac: "00:50:56:00:00:" + ip[len(ip)-1:] + "0"}}
+		a.PoolID.Int32, a.PoolID.Valid = int32(pool.ID), true
+		a.GroupID.Int32, a.GroupID.Valid = 1, true
+		if res := db.DB.Create(&a); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+	register("10.0.0.2")
+	register("10.0.0.3")
+
+	stats, err := pool.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 3 || stats.Reserved != 2 || stats.Free != 1 || stats.Expired != 0 {
+		t.Fatalf("got %+v, want 2 of 3 addresses reserved", stats)
+	}
+	if ip, err := pool.Next(); err != nil || ip.String() != "10.0.0.4" {
+		t.Fatalf("next: got %s, %v, want the only free address 10.0.0.4", ip, err)
+	}
+
+	register("10.0.0.4")
+	if stats, err = pool.Stats(); err != nil || stats.Free != 0 || stats.Utilization != 100 {
+		t.Fatalf("got %+v, %v, want the pool full", stats, err)
+	}
+	if ip, err := pool.Next(); err == nil {
+		t.Fatalf("next: got %s from a full pool", ip)
+	}
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	// ErrNotFlaggedForReimage is returned when a client is ignored by pools that only serve hosts flagged for re-imaging
+	ErrNotFlaggedForReimage = errors.New("ignored because mac address is not flagged for re-imaging")
+
+	// ErrPoolExhausted is returned when none of the pools have a free address left
+	ErrPoolExhausted = errors.New("could not find a free address in any pool of the shared network")
+)
+
+// SharedNetwork is a list of pools serving the same broadcast domain, in the order they should be tried
+type SharedNetwork []*PoolWithAddresses
+
+// PoolFor returns the pool that an ip belongs to. Pools that hand out the ip in one of their ranges are preferred over pools that only share the network
+func (s SharedNetwork) PoolFor(ip net.IP) *PoolWithAddresses {
+	for _, p := range s {
+		if p.InRange(ip) {
+			return p
+		}
+	}
+
+	for _, p := range s {
+		if ok, _ := p.Contains(ip); ok {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// IDs returns the ids of all pools in the shared network
+func (s SharedNetwork) IDs() []int {
+	var ids []int
+	for _, p := range s {
+		ids = append(ids, p.ID)
+	}
+
+	return ids
+}
+
+// Next returns the next free address in the first pool of the shared network that is not exhausted
+func (s SharedNetwork) Next() (*PoolWithAddresses, net.IP, error) {
+	served := false
+	for _, p := range s {
+		// Dont hand out dynamic addresses from pools with "only serve requested" flag set
+		if p.OnlyServeReimage {
+			continue
+		}
+		served = true
+
+		ip, err := p.Next()
+		if err == nil {
+			return p, ip, nil
+		}
+	}
+
+	if !served {
+		return nil, nil, ErrNotFlaggedForReimage
+	}
+
+	return nil, nil, ErrPoolExhausted
+}
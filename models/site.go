@@ -0,0 +1,88 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/datatypes"
+)
+
+// Site is the declarative configuration reconciled by `go-via apply` and /v1/apply. Device classes, pools and groups
+// are identified by name, hosts by ip and mac (by mac when they have no ip), and images and templates are referenced by the name they already have.
+type Site struct {
+	DeviceClasses []DeviceClassForm `json:"device_classes"`
+	Pools         []PoolForm        `json:"pools"`
+	Groups        []SiteGroup       `json:"groups"`
+	Addresses     []SiteAddress     `json:"addresses"`
+	Options       []SiteOption      `json:"options"`
+}
+
+// SiteGroup is a group, the password is encrypted with the secrets key (see `go-via encrypt`) and kept when empty
+type SiteGroup struct {
+	Name            string         `json:"name"`
+	Pool            string         `json:"pool"`
+	Image           string         `json:"image"` // iso_image of an uploaded image
+	Template        string         `json:"template"`
+	TemplateVersion int            `json:"template_version"`
+	DNS             string         `json:"dns"`
+	NTP             string         `json:"ntp"`
+	Password        string         `json:"password"`
+	Ks              string         `json:"ks"`
+	Syslog          string         `json:"syslog"`
+	Vlan            string         `json:"vlan"`
+	CallbackURL     string         `json:"callbackurl"`
+	BootDisk        string         `json:"bootdisk"`
+	Options         datatypes.JSON `json:"options"`
+	Attributes      datatypes.JSON `json:"attributes"`
+	HostnamePattern string         `json:"hostname_pattern"`
+}
+
+// SiteAddress is a host, the pool is the pool of its group
+type SiteAddress struct {
+	IP           string         `json:"ip"`
+	Mac          string         `json:"mac"`
+	Hostname     string         `json:"hostname"`
+	Domain       string         `json:"domain"`
+	Group        string         `json:"group"`
+	SecondaryIPs string         `json:"secondary_ips"`
+	Attributes   datatypes.JSON `json:"attributes"`
+	ClientID     string         `json:"client_id"`
+	UUID         string         `json:"uuid"`
+	Serial       string         `json:"serial"`
+}
+
+// SiteOption is a dhcp option, scoped to a pool, host and/or device class by name and ip
+type SiteOption struct {
+	Pool        string `json:"pool"`
+	Address     string `json:"address"`
+	DeviceClass string `json:"device_class"`
+	OpCode      byte   `json:"opcode"`
+	Data        string `json:"data"`
+	Priority    int    `json:"priority"`
+}
+
+// ApplyChange is a change made, or planned, to reconcile the database with a site
+type ApplyChange struct {
+	Action string   `json:"action"` // create, update or delete
+	Kind   string   `json:"kind"`
+	ID     int      `json:"id,omitempty"` // 0 for the items created by a plan
+	Name   string   `json:"name"`
+	Diff   []string `json:"diff,omitempty"`
+}
+
+func (c ApplyChange) String() string {
+	symbol := map[string]string{"create": "+", "update": "~", "delete": "-"}[c.Action]
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s", symbol, c.Kind, c.Name)
+	for _, v := range c.Diff {
+		fmt.Fprintf(&b, "\n    %s", v)
+	}
+	return b.String()
+}
+
+type ApplyResult struct {
+	Plan    bool          `json:"plan"`
+	Prune   bool          `json:"prune"`
+	Changes []ApplyChange `json:"changes"`
+}
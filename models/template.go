@@ -0,0 +1,55 @@
+package models
+
+import (
+	"time"
+)
+
+type TemplateForm struct {
+	Name        string `json:"name" gorm:"type:varchar(255);not null;uniqueIndex" binding:"required" `
+	Description string `json:"description" gorm:"type:text"`
+	// Snippets are not used as a kickstart on their own, but are included by other templates with {{ template "name" . }}
+	Snippet bool `json:"snippet" gorm:"type:bool"`
+}
+
+type Template struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	TemplateForm
+
+	LatestVersion int               `json:"latest_version" gorm:"type:integer"`
+	Versions      []TemplateVersion `json:"versions,omitempty" gorm:"foreignkey:TemplateID"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+type TemplateVersionForm struct {
+	Content string `json:"content" gorm:"type:text;not null" binding:"required" `
+	Comment string `json:"comment" gorm:"type:varchar(255)"`
+}
+
+// TemplateVersion is an immutable revision of a template, a new version is created for every change
+type TemplateVersion struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	TemplateID int `json:"template_id" gorm:"type:BIGINT;not null;index:uniqTemplateVersion,unique"`
+	Version    int `json:"version" gorm:"type:integer;not null;index:uniqTemplateVersion,unique"`
+
+	TemplateVersionForm
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewTemplateForm creates a template together with its first version
+type NewTemplateForm struct {
+	TemplateForm
+	TemplateVersionForm
+}
+
+// TemplateDiff is the line by line difference between two versions of a template
+type TemplateDiff struct {
+	From int    `json:"from"`
+	To   int    `json:"to"`
+	Diff string `json:"diff"`
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+)
+
+type TokenForm struct {
+	Name string `json:"name" gorm:"type:varchar(255)" binding:"required" `
+	// Scope is the role the token acts as, at most the role of the user. Empty uses the role of the user.
+	Scope string `json:"scope" gorm:"type:varchar(16)" binding:"omitempty,oneof=admin operator readonly"`
+	// ExpiresIn is the number of days the token is valid, 0 never expires
+	ExpiresIn int `json:"expires_in" gorm:"-" binding:"min=0"`
+}
+
+// Token is a personal api token or a session of the web interface, only the sha256 of the secret is stored
+type Token struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	UserID int `json:"user_id" gorm:"type:BIGINT;not null;index"`
+
+	TokenForm
+
+	// Prefix is the start of the secret, to recognize tokens
+	Prefix  string `json:"prefix" gorm:"type:varchar(16)"`
+	Hash    string `json:"-" gorm:"type:varchar(64);not null;uniqueIndex"`
+	Session bool   `json:"session" gorm:"type:boolean"`
+
+	ExpiresAt *time.Time `json:"expires_at"`
+	LastUsed  *time.Time `json:"last_used"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TokenCreated is returned once when a token is created, the secret can't be retrieved later
+type TokenCreated struct {
+	Token
+	Secret string `json:"token"`
+}
+
+// LoginForm starts a session of the web interface
+type LoginForm struct {
+	Username string `json:"username" binding:"required" `
+	Password string `json:"password" binding:"required" `
+}
+
+// Expired returns true when the token can no longer be used
+func (t Token) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// Limit returns the user with the role reduced to the scope of the token
+func (t Token) Limit(u User) User {
+	if t.Scope != "" && roleRank[t.Scope] < roleRank[u.Role] {
+		u.Role = t.Scope
+	}
+	return u
+}
@@ -4,11 +4,36 @@ import (
 	"time"
 )
 
+// Roles of the users, each role includes the permissions of the roles before it
+const (
+	RoleReadOnly = "readonly"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// Providers of the users
+const (
+	ProviderLocal = "local"
+	ProviderLDAP  = "ldap"
+	ProviderOIDC  = "oidc"
+)
+
+var roleRank = map[string]int{
+	RoleReadOnly: 1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
 type UserForm struct {
 	Username string `json:"username" gorm:"type:varchar(255)"`
 	Password string `json:"password" gorm:"type:varchar(255)"`
 	Email    string `json:"email" gorm:"type:varchar(255)"`
 	Comment  string `json:"comment" gorm:"type:varchar(255)"`
+	// Role is admin, operator or readonly. Readonly users can view everything, operators can also manage and reimage
+	// hosts, and only admins can change pools, groups, images, templates, options and users.
+	Role string `json:"role" gorm:"type:varchar(16)" binding:"omitempty,oneof=admin operator readonly"`
+	// GroupID limits an operator to the hosts of one group
+	GroupID NullInt32 `json:"group_id" gorm:"type:BIGINT" swaggertype:"integer"`
 }
 
 type User struct {
@@ -16,7 +41,51 @@ type User struct {
 
 	UserForm
 
+	// Provider is the provider that authenticates the user. LDAP and OIDC users are created at their first login and their role
+	// is updated from their groups at every login.
+	Provider string `json:"provider" gorm:"type:varchar(16)"`
+
+	// PasswordChange requires the user to choose a new password before anything else, e.g. the default admin
+	PasswordChange bool `json:"password_change" gorm:"type:boolean"`
+	// FailedLogins counts the failed logins since the last successful one, the user is locked until LockedUntil
+	// when it reaches the lockout threshold
+	FailedLogins int        `json:"failed_logins" gorm:"type:INT"`
+	LockedUntil  *time.Time `json:"locked_until"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
+
+// PasswordForm changes the password of the authenticated user
+type PasswordForm struct {
+	Current  string `json:"current" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// Locked returns true when the user can't log in because of failed logins
+func (u User) Locked() bool {
+	return u.LockedUntil != nil && time.Now().Before(*u.LockedUntil)
+}
+
+// HasRole returns true when the role of the user includes the permissions of the given role
+func (u User) HasRole(role string) bool {
+	return roleRank[u.Role] >= roleRank[role]
+}
+
+// InScope returns true when the user may manage hosts of the group
+func (u User) InScope(groupID NullInt32) bool {
+	scope := u.Scope()
+	if !scope.Valid {
+		return true
+	}
+	return groupID.Valid && groupID.Int32 == scope.Int32
+}
+
+// Scope returns the only group the user may manage hosts of, it is not valid when the user may manage all hosts
+func (u User) Scope() NullInt32 {
+	if u.Role == RoleAdmin {
+		return NullInt32{}
+	}
+	return u.GroupID
+}
@@ -0,0 +1,242 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The key is taken from the first of these that is set, or from secret/secret.key
+const (
+	// EnvKey holds the key itself
+	EnvKey = "GOVIA_SECRET_KEY"
+	// EnvKeyFD is the number of an open file descriptor the key is read from, e.g. passed by systemd
+	EnvKeyFD = "GOVIA_SECRET_KEY_FD"
+	// EnvKeystore is a directory that keeps the keys by id, a local stand-in for a key management server. The id of
+	// the current key is in the file current, the keys in <id>.key.
+	EnvKeystore = "GOVIA_KEYSTORE"
+)
+
+// Sources of the key
+const (
+	SourceEnv      = "env"
+	SourceFD       = "fd"
+	SourceKeystore = "keystore"
+	SourceFile     = "file"
+)
+
+const keyFile = "secret/secret.key"
+
+// ring keeps the keys of the keystore by id, the secrets of a previous key can still be decrypted after a rotation,
+// e.g. the passwords in a site file
+var (
+	ringMu sync.RWMutex
+	ring   = make(map[string]string)
+)
+
+// previousKey returns a key of the keystore by its id
+func previousKey(id string) (string, bool) {
+	ringMu.RLock()
+	defer ringMu.RUnlock()
+
+	key, ok := ring[id]
+	return key, ok
+}
+
+// loadRing adds the keys of the keystore to the key ring, keys that don't match the id in their name are skipped
+func loadRing(dir string) error {
+	names, err := filepath.Glob(filepath.Join(dir, "*.key"))
+	if err != nil {
+		return err
+	}
+
+	ringMu.Lock()
+	defer ringMu.Unlock()
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSpace(string(b))
+		id := strings.TrimSuffix(filepath.Base(name), ".key")
+		if _, err := decodeKey(key); err != nil || KeyID(key) != id {
+			logrus.WithFields(logrus.Fields{
+				"key": name,
+			}).Warning("secrets: the key doesn't match its id, skipping it")
+			continue
+		}
+		ring[id] = key
+	}
+	return nil
+}
+
+// Init returns the secret key, and exits when it can't be loaded
+func Init() string {
+	key, source, err := Load()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"source": source,
+			"err":    err,
+		}).Fatal("secrets")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"source": source,
+		"id":     KeyID(key),
+	}).Info("secrets")
+	return key
+}
+
+// Load returns the secret key and where it was loaded from. A new key is created in the keystore or the key file
+// when there is none.
+func Load() (string, string, error) {
+	var key string
+	var err error
+
+	source := SourceFile
+	switch {
+	case os.Getenv(EnvKey) != "":
+		source = SourceEnv
+		key = os.Getenv(EnvKey)
+	case os.Getenv(EnvKeyFD) != "":
+		source = SourceFD
+		key, err = readFD(os.Getenv(EnvKeyFD))
+	case os.Getenv(EnvKeystore) != "":
+		source = SourceKeystore
+		key, err = readKeystore(os.Getenv(EnvKeystore))
+	default:
+		key, err = readKeyFile()
+	}
+	if err != nil {
+		return "", source, err
+	}
+
+	key = strings.TrimSpace(key)
+	if _, err := decodeKey(key); err != nil {
+		return "", source, err
+	}
+	return key, source, nil
+}
+
+// GenerateKey returns a new random AES-256 key
+func GenerateKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Stage prepares storing a new key in the source of the current one. The key only replaces the current one when
+// commit is called, after the secrets have been encrypted with it. Keys from the environment or a file descriptor
+// can't be stored, and have to be replaced by the operator.
+func Stage(source string, key string) (commit func() error, err error) {
+	switch source {
+	case SourceKeystore:
+		dir := os.Getenv(EnvKeystore)
+		if err := writeFile(filepath.Join(dir, KeyID(key)+".key"), key); err != nil {
+			return nil, err
+		}
+		return func() error {
+			return writeFile(filepath.Join(dir, "current"), KeyID(key))
+		}, nil
+	case SourceFile:
+		if err := writeFile(keyFile+".new", key); err != nil {
+			return nil, err
+		}
+		return func() error {
+			return os.Rename(keyFile+".new", keyFile)
+		}, nil
+	}
+	return func() error { return nil }, nil
+}
+
+func readFD(s string) (string, error) {
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", EnvKeyFD, err)
+	}
+	f := os.NewFile(uintptr(fd), "secret-key")
+	if f == nil {
+		return "", fmt.Errorf("%s: file descriptor %d is not open", EnvKeyFD, fd)
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	return string(b), err
+}
+
+func readKeystore(dir string) (string, error) {
+	id, err := ioutil.ReadFile(filepath.Join(dir, "current"))
+	if os.IsNotExist(err) {
+		key, err := GenerateKey()
+		if err != nil {
+			return "", err
+		}
+		logrus.WithFields(logrus.Fields{
+			"keystore": dir,
+			"id":       KeyID(key),
+		}).Info("secrets: no key in the keystore, created a new one")
+
+		commit, err := Stage(SourceKeystore, key)
+		if err != nil {
+			return "", err
+		}
+		return key, commit()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	key, err := ioutil.ReadFile(filepath.Join(dir, strings.TrimSpace(string(id))+".key"))
+	if err != nil {
+		return "", err
+	}
+	if KeyID(strings.TrimSpace(string(key))) != strings.TrimSpace(string(id)) {
+		return "", fmt.Errorf("the key in the keystore doesn't match its id %s", strings.TrimSpace(string(id)))
+	}
+	return string(key), loadRing(dir)
+}
+
+func readKeyFile() (string, error) {
+	key, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		//secrets file does not exist, create folder and file
+		logrus.WithFields(logrus.Fields{
+			"key": "no secrets file has been detected, attempting to create a new one and generate secret key",
+		}).Info("secrets")
+
+		key, err := GenerateKey()
+		if err != nil {
+			return "", err
+		}
+		if err := writeFile(keyFile, key); err != nil {
+			return "", err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"key": keyFile + " created",
+		}).Info("secrets")
+		return key, nil
+	}
+	return string(key), err
+}
+
+// writeFile replaces a file at once with one only the owner can read
+func writeFile(name string, content string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(name+".tmp", []byte(content), 0600); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
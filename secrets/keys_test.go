@@ -0,0 +1,64 @@
+package secrets
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestDecryptPreviousKey(t *testing.T) {
+	previous, set := os.LookupEnv(EnvKeystore)
+	os.Setenv(EnvKeystore, t.TempDir())
+	t.Cleanup(func() {
+		if set {
+			os.Setenv(EnvKeystore, previous)
+		} else {
+			os.Unsetenv(EnvKeystore)
+		}
+	})
+
+	oldKey, source, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := Encrypt("VMware1!", oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate the key, the old one is kept in the keystore
+	newKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := Stage(source, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(); err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != newKey {
+		t.Fatalf("got key %s, want the new key %s", KeyID(key), KeyID(newKey))
+	}
+
+	if plaintext, err := Decrypt(secret, key); err != nil || plaintext != "VMware1!" {
+		t.Errorf("a secret of the previous key: got %q, %v", plaintext, err)
+	}
+
+	unknown, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err = Encrypt("VMware1!", unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(secret, key); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("a secret of a key not in the keystore: got %v, want %v", err, ErrWrongKey)
+	}
+}
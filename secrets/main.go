@@ -4,111 +4,97 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
-
-	"github.com/sirupsen/logrus"
+	"strings"
 )
 
-// Credits to this person for excellent code: https://www.melvinvivas.com/how-to-encrypt-and-decrypt-data-using-aes/
-
-func Init() string {
-	var key []byte
-	if _, err := os.Stat("secret/secret.key"); os.IsNotExist(err) {
-		//secrets file does not exist, create folder and file
-		os.MkdirAll("secret", os.ModePerm)
-		logrus.WithFields(logrus.Fields{
-			"key": "no secrets file has been detected, attempting to create a new one and generate secret key",
-		}).Info("secrets")
-		file, err := os.Create("secret/secret.key")
-		if err != nil {
-			logrus.Fatal(err.Error())
-		}
-		logrus.WithFields(logrus.Fields{
-			"key": "secret/secret.key created",
-		}).Info("secrets")
-
-		//generate a random 32 byte AES-256 key
-		bytes := make([]byte, 32)
-		if _, err := rand.Read(bytes); err != nil {
-			panic(err.Error())
-		}
+// ErrWrongKey is returned when a secret can't be decrypted with the key
+var ErrWrongKey = errors.New("the secret can't be decrypted with the key")
 
-		//convert key to string and write to file
-		hexkey := hex.EncodeToString(bytes)
-		wr, err := file.WriteString(hexkey)
-		if err != nil {
-			logrus.Fatal(err.Error())
-		}
-		logrus.WithFields(logrus.Fields{
-			"key":   "secret key persisted to file",
-			"bytes": wr,
-		}).Info("secrets")
-		file.Close()
-		key, _ = ioutil.ReadFile("secret/secret.key")
-	} else {
-		//Database exists, moving on.
-		logrus.WithFields(logrus.Fields{
-			"key": "found existing secret key!",
-		}).Info("secrets")
-		key, _ = ioutil.ReadFile("secret/secret.key")
-	}
-	return string(key)
-}
+// Credits to this person for excellent code: https://www.melvinvivas.com/how-to-encrypt-and-decrypt-data-using-aes/
 
-func Encrypt(stringToEncrypt string, keyString string) (encryptedString string) {
+// Encrypt encrypts a secret with AES-256-GCM. The id of the key is stored in front of the ciphertext, so a secret of
+// another key is recognized when it is decrypted.
+func Encrypt(stringToEncrypt string, keyString string) (string, error) {
 
 	//Since the key is in string, we need to convert decode it to bytes
-	key, _ := hex.DecodeString(keyString)
+	key, err := decodeKey(keyString)
+	if err != nil {
+		return "", err
+	}
 	plaintext := []byte(stringToEncrypt)
 
 	//Create a new Cipher Block from the key
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
 	//Create a new GCM - https://en.wikipedia.org/wiki/Galois/Counter_Mode
 	//https://golang.org/pkg/crypto/cipher/#NewGCM
 	aesGCM, err := cipher.NewGCM(block)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
 	//Create a nonce. Nonce should be from GCM
 	nonce := make([]byte, aesGCM.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
 	//Encrypt the data using aesGCM.Seal
 	//Since we don't want to save the nonce somewhere else in this case, we add it as a prefix to the encrypted data. The first nonce argument in Seal is the prefix.
 	ciphertext := aesGCM.Seal(nonce, nonce, plaintext, nil)
-	return fmt.Sprintf("%x", ciphertext)
+	return fmt.Sprintf("%s:%x", KeyID(keyString), ciphertext), nil
 }
 
-func Decrypt(encryptedString string, keyString string) (decryptedString string) {
+// Decrypt decrypts a secret of Encrypt. A secret of a previous key is decrypted with that key when it is in the
+// keystore. Secrets from before key ids were introduced have no id and are decrypted with the given key.
+func Decrypt(encryptedString string, keyString string) (string, error) {
+
+	if i := strings.IndexByte(encryptedString, ':'); i >= 0 {
+		if id := encryptedString[:i]; id != KeyID(keyString) {
+			previous, ok := previousKey(id)
+			if !ok {
+				return "", fmt.Errorf("%w: the secret is encrypted with key %s, the current key is %s", ErrWrongKey, id, KeyID(keyString))
+			}
+			keyString = previous
+		}
+		encryptedString = encryptedString[i+1:]
+	}
+
+	key, err := decodeKey(keyString)
+	if err != nil {
+		return "", err
+	}
 
-	key, _ := hex.DecodeString(keyString)
-	enc, _ := hex.DecodeString(encryptedString)
+	enc, err := hex.DecodeString(encryptedString)
+	if err != nil {
+		return "", fmt.Errorf("invalid secret: %w", err)
+	}
 
 	//Create a new Cipher Block from the key
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
 	//Create a new GCM
 	aesGCM, err := cipher.NewGCM(block)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
 	//Get the nonce size
 	nonceSize := aesGCM.NonceSize()
+	if len(enc) < nonceSize {
+		return "", fmt.Errorf("invalid secret: too short")
+	}
 
 	//Extract the nonce from the encrypted data
 	nonce, ciphertext := enc[:nonceSize], enc[nonceSize:]
@@ -116,8 +102,22 @@ func Decrypt(encryptedString string, keyString string) (decryptedString string)
 	//Decrypt the data
 	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		panic(err.Error())
+		return "", fmt.Errorf("%w: %s", ErrWrongKey, err)
 	}
 
-	return fmt.Sprintf("%s", plaintext)
+	return string(plaintext), nil
+}
+
+// KeyID identifies a key without revealing it
+func KeyID(keyString string) string {
+	sum := sha256.Sum256([]byte(keyString))
+	return hex.EncodeToString(sum[:4])
+}
+
+func decodeKey(keyString string) ([]byte, error) {
+	key, err := hex.DecodeString(keyString)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("the secret key must be 64 hex characters")
+	}
+	return key, nil
 }
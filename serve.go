@@ -96,6 +96,11 @@ func serve(intf string) {
 				continue
 			}
 
+			// Some messages like decline are handled without sending a response
+			if resp == nil {
+				continue
+			}
+
 			// Copy some information from the request like option 82 (agent info) to the response
 			resp.Flags = req.Flags
 			for _, v := range req.Options {
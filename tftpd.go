@@ -27,8 +27,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/maxiepax/go-via/api"
 	"github.com/maxiepax/go-via/config"
 	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/metrics"
 	"github.com/maxiepax/go-via/models"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm/clause"
@@ -46,6 +48,9 @@ func readHandler(conf *config.Config) func(string, io.ReaderFrom) error {
 		//strip the port
 		ip, _, _ := net.SplitHostPort(raddr.String())
 
+		//keep the requested filename for the metrics, as it is rewritten to the path on disk below
+		requested := filename
+
 		//get the object that correlates with the ip
 		var address models.Address
 		db.DB.Preload(clause.Associations).First(&address, "ip = ?", ip)
@@ -54,6 +59,11 @@ func readHandler(conf *config.Config) func(string, io.ReaderFrom) error {
 		var image models.Image
 		db.DB.First(&image, "id = ?", address.Group.ImageID)
 
+		//unregistered clients of a discovery pool boot the discovery image to report their hardware
+		if discovering(address) {
+			db.DB.First(&image, "id = ?", address.Pool.DiscoveryImageID)
+		}
+
 		logrus.WithFields(logrus.Fields{
 			"raddr":     raddr,
 			"laddr":     laddr,
@@ -91,9 +101,9 @@ func readHandler(conf *config.Config) func(string, io.ReaderFrom) error {
 			address.Progresstext = "crypto64.efi"
 			db.DB.Save(&address)
 		case "boot.cfg":
-			serveBootCfg(filename, address, image, rf, conf)
+			return serveBootCfg(filename, address, image, rf, conf)
 		case "/boot.cfg":
-			serveBootCfg(filename, address, image, rf, conf)
+			return serveBootCfg(filename, address, image, rf, conf)
 		default:
 			//if no case matches, chroot to /tftp
 			if _, err := os.Stat("tftp/" + filename); err == nil {
@@ -114,6 +124,7 @@ func readHandler(conf *config.Config) func(string, io.ReaderFrom) error {
 		// get the filesize to send filelength
 		fi, err := os.Stat(filename)
 		if err != nil {
+			metrics.TFTPTransfer(requested, 0, err)
 			return err
 		}
 
@@ -125,9 +136,12 @@ func readHandler(conf *config.Config) func(string, io.ReaderFrom) error {
 			logrus.WithFields(logrus.Fields{
 				"could not open file": err,
 			}).Debug("tftpd")
+			metrics.TFTPTransfer(requested, 0, err)
 			return err
 		}
+		defer file.Close()
 		n, err := rf.ReadFrom(file)
+		metrics.TFTPTransfer(requested, n, err)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"could not read from file": err,
@@ -185,7 +199,7 @@ func crypto64Path(imagePath string) (string, error) {
 
 }
 
-func serveBootCfg(filename string, address models.Address, image models.Image, rf io.ReaderFrom, conf *config.Config) {
+func serveBootCfg(filename string, address models.Address, image models.Image, rf io.ReaderFrom, conf *config.Config) error {
 	//if the filename is boot.cfg, or /boot.cfg, we serve the boot cfg that belongs to that build. unfortunately, it seems boot.cfg or /boot.cfg varies in builds.
 
 	// get the requesting ip-address and our source address
@@ -210,7 +224,8 @@ func serveBootCfg(filename string, address models.Address, image models.Image, r
 	bc, err := ioutil.ReadFile(image.Path + "/BOOT.CFG")
 	if err != nil {
 		logrus.Warn(err)
-		return
+		metrics.TFTPTransfer(filename, 0, err)
+		return err
 	}
 
 	// strip slashes from paths in file
@@ -220,15 +235,25 @@ func serveBootCfg(filename string, address models.Address, image models.Image, r
 	// add kickstart path to kernelopt
 	re = regexp.MustCompile("kernelopt=.*")
 	o := re.Find(bc)
-	bc = re.ReplaceAllLiteral(bc, append(o, []byte(" ks=https://"+laddr.String()+":"+strconv.Itoa(conf.Port)+"/ks.cfg")...))
+	ks := "/discovery/ks.cfg"
+	if !discovering(address) {
+		// the kickstart contains the root password, so only the host that fetched this boot.cfg may download it once
+		token, err := api.IssueKsToken(&address, time.Duration(conf.Kickstart.TokenTTL)*time.Second)
+		if err != nil {
+			metrics.TFTPTransfer(filename, 0, err)
+			return err
+		}
+		ks = "/ks.cfg?token=" + token
+	}
+	bc = re.ReplaceAllLiteral(bc, append(o, []byte(" ks=https://"+laddr.String()+":"+strconv.Itoa(conf.Port)+ks)...))
 
-	// append the mac address of the hardware interface to ensure ks.cfg request comes from the right interface, along with ip, netmask and gateway.
+	// append the mac address of the booting interface to ensure ks.cfg request comes from the right interface, along with ip, netmask and gateway.
 	nm := net.CIDRMask(address.Pool.Netmask, 32)
 	netmask := ipv4MaskString(nm)
 
 	re = regexp.MustCompile("kernelopt=.*")
 	o = re.Find(bc)
-	bc = re.ReplaceAllLiteral(bc, append(o, []byte(" netdevice="+address.Mac+" ip="+address.IP+" netmask="+netmask+" gateway="+address.Pool.Gateway)...))
+	bc = re.ReplaceAllLiteral(bc, append(o, []byte(" netdevice="+address.DeviceMac()+" ip="+address.IP+" netmask="+netmask+" gateway="+address.Pool.Gateway)...))
 
 	// if vlan is configured for the group, append the vlan to kernelopts
 	if address.Group.Vlan != "" {
@@ -268,19 +293,25 @@ func serveBootCfg(filename string, address models.Address, image models.Image, r
 	// Send the data from the buffer to the client
 	rf.(tftp.OutgoingTransfer).SetSize(int64(buff.Len()))
 	n, err := rf.ReadFrom(buff)
+	metrics.TFTPTransfer(filename, n, err)
 	if err != nil {
 		//fmt.Fprintf(os.Stderr, "%v\n", err)
 		logrus.WithFields(logrus.Fields{
 			"os.Stderr": err,
 		}).Debug("tftpd")
-		return
+		return err
 	}
 
 	logrus.WithFields(logrus.Fields{
 		"file":  filename,
 		"bytes": n,
 	}).Info("tftpd")
-	//return nil
+	return nil
+}
+
+// discovering returns true for clients that are not registered to a group and boot the discovery image of their pool
+func discovering(address models.Address) bool {
+	return !address.GroupID.Valid && address.Pool.Discovery && address.Pool.DiscoveryImageID != 0
 }
 
 func ipv4MaskString(m []byte) string {